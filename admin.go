@@ -0,0 +1,187 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// adminEntry describes a cached entry to the admin endpoint.
+type adminEntry struct {
+	Key       string              `json:"key"`
+	StoredAt  time.Time           `json:"storedAt"`
+	ExpiresAt time.Time           `json:"expiresAt"`
+	Status    int                 `json:"status,omitempty"`
+	Size      int                 `json:"size"`
+	Vary      []string            `json:"vary,omitempty"`
+	Headers   map[string][]string `json:"headers,omitempty"`
+}
+
+// serveAdmin serves the admin endpoint, listing the cached entries at
+// {adminPath}/entries, or describing the one whose key is given by the key
+// query parameter, reporting or switching whether caching is enabled at
+// {adminPath}/enabled, warming the cache at {adminPath}/warm, and exporting or
+// importing its entries at {adminPath}/snapshot. Access is restricted like
+// purging.
+func (m *cache) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if !m.purgeAuthorized(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	switch r.URL.Path {
+	case m.cfg.AdminPath + "/entries":
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		if key := r.URL.Query().Get("key"); key != "" {
+			m.serveAdminEntry(w, key)
+			return
+		}
+
+		m.serveAdminEntries(w)
+	case m.cfg.AdminPath + "/enabled":
+		m.serveAdminEnabled(w, r)
+	case m.cfg.AdminPath + "/warm":
+		m.serveWarm(w, r)
+	case m.cfg.AdminPath + "/snapshot":
+		m.serveSnapshot(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+// adminEnabled is the state reported and accepted by {adminPath}/enabled.
+type adminEnabled struct {
+	Enabled bool `json:"enabled"`
+}
+
+// serveAdminEnabled reports whether caching is enabled on GET, and switches
+// it on PUT with a JSON body such as {"enabled": false}.
+func (m *cache) serveAdminEnabled(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var state adminEnabled
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m.setEnabled(state.Enabled)
+		m.log.Infof("Caching switched to enabled=%t through the admin endpoint", state.Enabled)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, adminEnabled{Enabled: m.isEnabled()})
+}
+
+// isEnabled reports whether requests go through the cache, rather than
+// straight to the service.
+func (m *cache) isEnabled() bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+func (m *cache) setEnabled(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+
+	atomic.StoreInt32(&m.enabled, v)
+}
+
+func (m *cache) serveAdminEntries(w http.ResponseWriter) {
+	lister, ok := m.cache.(keyLister)
+	if !ok {
+		http.Error(w, "backend cannot list keys", http.StatusNotImplemented)
+		return
+	}
+
+	keys, err := lister.Keys(m.keyConfig.prefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sort.Strings(keys)
+
+	entries := []adminEntry{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, m.tagKey("")) {
+			continue
+		}
+
+		entry, err := m.adminEntry(key)
+		if err != nil {
+			continue
+		}
+
+		entry.Headers = nil
+		entries = append(entries, entry)
+	}
+
+	writeJSON(w, entries)
+}
+
+func (m *cache) serveAdminEntry(w http.ResponseWriter, key string) {
+	entry, err := m.adminEntry(key)
+	switch {
+	case errors.Is(err, ErrCacheMiss):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, entry)
+}
+
+// adminEntry reads the metadata of the entry at key, leaving its body aside.
+func (m *cache) adminEntry(key string) (adminEntry, error) {
+	b, err := m.cache.Get(key)
+	if err != nil {
+		return adminEntry{}, err
+	}
+
+	data, err := unmarshalCacheData(b)
+	if err != nil {
+		return adminEntry{}, err
+	}
+
+	size := data.Size
+	if size == 0 {
+		size = len(data.Body)
+	}
+
+	return adminEntry{
+		Key:       key,
+		StoredAt:  data.StoredAt,
+		ExpiresAt: data.ExpiresAt,
+		Status:    data.Status,
+		Size:      size,
+		Vary:      data.Vary,
+		Headers:   data.Headers,
+	}, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(b)
+}
@@ -0,0 +1,180 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCache_ServeHTTPAdmin(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Cache-Tags", "some-tag")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{
+		Enabled:     true,
+		Backend:     backendMemory,
+		MaxExpiry:   "10",
+		Cleanup:     "20",
+		AdminPath:   "/_cache",
+		PurgeSecret: "secret",
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	admin := func(target string, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Purge-Secret", secret)
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	if rw := admin("http://localhost/_cache/entries", "wrong"); rw.Code != http.StatusForbidden {
+		t.Errorf("unexpected status without secret: want %d, got %d", http.StatusForbidden, rw.Code)
+	}
+
+	rw := admin("http://localhost/_cache/entries", "secret")
+
+	var entries []adminEntry
+	if err = json.Unmarshal(rw.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("unexpected entries response %q: %v", rw.Body.String(), err)
+	}
+
+	if len(entries) != 1 || entries[0].Key != "GETlocalhost/some/path" || entries[0].Size != 9 || entries[0].Status != http.StatusOK {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+
+	rw = admin("http://localhost/_cache/entries?key="+url.QueryEscape("GETlocalhost/some/path"), "secret")
+
+	var entry adminEntry
+	if err = json.Unmarshal(rw.Body.Bytes(), &entry); err != nil {
+		t.Fatalf("unexpected entry response %q: %v", rw.Body.String(), err)
+	}
+
+	if entry.Headers["Cache-Control"][0] != "max-age=20" {
+		t.Errorf("unexpected entry headers: %v", entry.Headers)
+	}
+
+	if rw = admin("http://localhost/_cache/entries?key=missing", "secret"); rw.Code != http.StatusNotFound {
+		t.Errorf("unexpected status for missing entry: want %d, got %d", http.StatusNotFound, rw.Code)
+	}
+}
+
+func TestCache_ServeHTTPAdminEnabled(t *testing.T) {
+	var calls int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{
+		Enabled:     true,
+		Backend:     backendMemory,
+		MaxExpiry:   "10",
+		Cleanup:     "20",
+		AdminPath:   "/_cache",
+		PurgeSecret: "secret",
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toggle := func(body string, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "http://localhost/_cache/enabled", strings.NewReader(body))
+		req.Header.Set("X-Purge-Secret", secret)
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	serve := func() {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+	}
+
+	serve()
+	serve()
+
+	if calls != 1 {
+		t.Fatalf("unexpected origin calls while enabled: want 1, got %d", calls)
+	}
+
+	if rw := toggle(`{"enabled": false}`, "wrong"); rw.Code != http.StatusForbidden {
+		t.Errorf("unexpected status without secret: want %d, got %d", http.StatusForbidden, rw.Code)
+	}
+
+	if rw := toggle(`{"enabled": false}`, "secret"); rw.Body.String() != `{"enabled":false}` {
+		t.Errorf("unexpected toggle response: want %q, got: %q", `{"enabled":false}`, rw.Body.String())
+	}
+
+	serve()
+	serve()
+
+	if calls != 3 {
+		t.Errorf("unexpected origin calls while disabled: want 3, got %d", calls)
+	}
+
+	if rw := toggle("yes", "secret"); rw.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status for invalid body: want %d, got %d", http.StatusBadRequest, rw.Code)
+	}
+
+	toggle(`{"enabled": true}`, "secret")
+	serve()
+
+	if calls != 3 {
+		t.Errorf("unexpected origin calls once enabled again: want 3, got %d", calls)
+	}
+}
+
+func TestNew_Disabled(t *testing.T) {
+	var calls int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != "" {
+			t.Errorf("unexpected cache state: want \"\", got: %q", state)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("unexpected origin calls: want 2, got %d", calls)
+	}
+}
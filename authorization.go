@@ -0,0 +1,55 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// authorizationCacheable reports whether the response to the request may be
+// stored with regard to its credentials. A shared cache must not store the
+// response to an authorized request unless the response explicitly allows it,
+// or the entries are keyed by credentials.
+func (m *cache) authorizationCacheable(r *http.Request, h http.Header) bool {
+	if r.Header.Get("Authorization") == "" || m.cfg.CacheAuthorization {
+		return true
+	}
+
+	cc, err := cacheobject.ParseResponseCacheControl(h.Get("Cache-Control"))
+	if err != nil {
+		return false
+	}
+
+	return cc.Public || cc.SMaxAge >= 0 || cc.MustRevalidate
+}
+
+// credentialsKeySeparator separates the key of a request from the hash of its
+// credentials.
+const credentialsKeySeparator = "|Authorization="
+
+// credentialsKey returns the key of the response to the request for its
+// credentials, keeping entries of different users apart. The credentials are
+// hashed so that they are not stored in clear.
+func credentialsKey(key string, r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return key
+	}
+
+	h := sha256.Sum256([]byte(auth))
+
+	return key + credentialsKeySeparator + hex.EncodeToString(h[:])
+}
+
+// credentialsKeys returns the keys of the entries stored for key under any
+// credentials, provided the backend can list them.
+func (m *cache) credentialsKeys(key string) ([]string, error) {
+	lister, ok := m.cache.(keyLister)
+	if !m.cfg.CacheAuthorization || !ok {
+		return nil, nil
+	}
+
+	return lister.Keys(key + credentialsKeySeparator)
+}
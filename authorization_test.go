@@ -0,0 +1,69 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_ServeHTTPAuthorization(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		allow        bool
+		wantStates   []string
+	}{
+		{
+			name:         "should not cache authorized request by default",
+			cacheControl: "max-age=20",
+			wantStates:   []string{cacheMissStatus, cacheMissStatus, cacheMissStatus},
+		},
+		{
+			name:         "should cache authorized request when response is public",
+			cacheControl: "public, max-age=20",
+			wantStates:   []string{cacheMissStatus, cacheHitStatus, cacheHitStatus},
+		},
+		{
+			name:         "should cache authorized request per credentials when allowed",
+			cacheControl: "max-age=20",
+			allow:        true,
+			wantStates:   []string{cacheMissStatus, cacheHitStatus, cacheMissStatus},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", test.cacheControl)
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{
+				Enabled:            true,
+				Backend:            backendMemory,
+				MaxExpiry:          "10",
+				Cleanup:            "20",
+				AddStatusHeader:    true,
+				CacheAuthorization: test.allow,
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, token := range []string{"Bearer alice", "Bearer alice", "Bearer bob"} {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+				req.Header.Set("Authorization", token)
+
+				rw := httptest.NewRecorder()
+				c.ServeHTTP(rw, req)
+
+				if state := rw.Header().Get("Cache-Status"); state != test.wantStates[i] {
+					t.Errorf("unexpected cache state for request %d: want %q, got: %q", i, test.wantStates[i], state)
+				}
+			}
+		})
+	}
+}
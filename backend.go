@@ -0,0 +1,64 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const backendFile = "file"
+
+// ErrCacheMiss is returned by backends when no value is stored at a key.
+var ErrCacheMiss = errors.New("cache miss")
+
+// errCorruptEntry is returned by backends storing a value they cannot read
+// back, such as a truncated file.
+var errCorruptEntry = errors.New("corrupt entry")
+
+// Backend stores serialized cache entries.
+type Backend interface {
+	// Get returns the value stored at key, or ErrCacheMiss if there is none
+	// or it has expired.
+	Get(key string) ([]byte, error)
+	// Set stores the value at key for the given ttl.
+	Set(key string, val []byte, ttl time.Duration) error
+	// Delete removes the value stored at key, returning ErrCacheMiss if there
+	// was none.
+	Delete(key string) error
+	// Close stops the background work of the backend and releases its
+	// resources.
+	Close() error
+}
+
+// bodyStreamer is implemented by backends able to store bodies apart from the
+// rest of their entry, letting hits be streamed to the client. The value and
+// body of an entry are replaced and read together, so that a reader never gets
+// the value of one write with the body of another.
+type bodyStreamer interface {
+	// SetWithBody stores the value at key for the given ttl like Set, along
+	// with a body.
+	SetWithBody(key string, val, body []byte, ttl time.Duration) error
+	// GetWithBody returns the value stored at key like Get, along with its
+	// body if it was stored by SetWithBody, or nil otherwise.
+	GetWithBody(key string) ([]byte, io.ReadCloser, error)
+}
+
+// keyLister is implemented by backends able to list the keys they hold.
+type keyLister interface {
+	// Keys returns the keys starting with prefix, expired ones included.
+	Keys(prefix string) ([]string, error)
+}
+
+func newBackend(cfg *Config, logger Logger) (Backend, error) {
+	switch cfg.Backend {
+	case "", backendFile:
+		return newFileCache(cfg.Path, cfg.Cleanup.Duration(), cfg.MaxDiskBytes, cfg.MaxEntries, cfg.CleanupBatchSize, evictHook(cfg.Hooks))
+	case backendMemory:
+		return newMemoryCache(cfg.MaxEntries, cfg.MaxBytes, evictHook(cfg.Hooks)), nil
+	case backendRedis:
+		return newRedisCache(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB, cfg.RedisKeyPrefix, logger)
+	default:
+		return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+}
@@ -0,0 +1,81 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"sync"
+)
+
+// defaultMaxBackgroundRefresh bounds the revalidations running at once by
+// default.
+const defaultMaxBackgroundRefresh = 10
+
+// workGroup tracks the work a cache carries on after responding, such as
+// revalidating stale entries, so that it can be cancelled and waited for when
+// the cache is closed. The work running at once may be bounded.
+type workGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// sem holds a token for each running work, when bounded.
+	sem chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// newWorkGroup returns a group running at most limit works at once, or any
+// number of them when limit is zero.
+func newWorkGroup(limit int) *workGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	g := &workGroup{ctx: ctx, cancel: cancel}
+	if limit > 0 {
+		g.sem = make(chan struct{}, limit)
+	}
+
+	return g
+}
+
+// run calls fn in a new goroutine with a context cancelled on close, and
+// reports whether it did. Nothing is started once the group is closed, nor
+// when the limit of running works is reached.
+func (g *workGroup) run(fn func(ctx context.Context)) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return false
+	}
+
+	if g.sem != nil {
+		select {
+		case g.sem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+
+	g.wg.Add(1)
+
+	go func() {
+		defer g.wg.Done()
+		if g.sem != nil {
+			defer func() { <-g.sem }()
+		}
+
+		fn(g.ctx)
+	}()
+
+	return true
+}
+
+// close cancels the running work and waits for it to return. It may be
+// called several times.
+func (g *workGroup) close() {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+
+	g.cancel()
+	g.wg.Wait()
+}
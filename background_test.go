@@ -0,0 +1,143 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkGroup(t *testing.T) {
+	g := newWorkGroup(0)
+
+	var cancelled int32
+
+	started := make(chan struct{})
+
+	if !g.run(func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		atomic.StoreInt32(&cancelled, 1)
+	}) {
+		t.Fatal("expected work to start")
+	}
+
+	<-started
+
+	g.close()
+
+	if atomic.LoadInt32(&cancelled) != 1 {
+		t.Error("expected close to wait for the cancelled work")
+	}
+
+	if g.run(func(context.Context) {}) {
+		t.Error("unexpected work started once closed")
+	}
+
+	g.close()
+}
+
+func TestWorkGroup_Limit(t *testing.T) {
+	const limit = 2
+
+	g := newWorkGroup(limit)
+	defer g.close()
+
+	var running, peak int32
+
+	release := make(chan struct{})
+
+	var started int
+	for i := 0; i < 5; i++ {
+		ok := g.run(func(context.Context) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+
+			<-release
+			atomic.AddInt32(&running, -1)
+		})
+		if ok {
+			started++
+		}
+	}
+
+	if started != limit {
+		t.Errorf("unexpected started works: want %d, got %d", limit, started)
+	}
+
+	close(release)
+	g.wg.Wait()
+
+	if p := atomic.LoadInt32(&peak); p > limit {
+		t.Errorf("unexpected concurrency: want at most %d, got %d", limit, p)
+	}
+
+	if !g.run(func(context.Context) {}) {
+		t.Error("expected work to start once the others returned")
+	}
+}
+
+func TestCache_Close(t *testing.T) {
+	var calls, cancelled int32
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			<-req.Context().Done()
+			atomic.StoreInt32(&cancelled, 1)
+			return
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=10")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20"}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	time.Sleep(1100 * time.Millisecond)
+
+	// Served stale, revalidating in the background.
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&calls) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("entry was not revalidated")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err = c.Close(); err != nil {
+		t.Errorf("unexpected close error: %v", err)
+	}
+
+	if atomic.LoadInt32(&cancelled) != 1 {
+		t.Error("expected close to cancel the revalidation")
+	}
+
+	select {
+	case <-c.cache.(*fileCache).stop:
+	default:
+		t.Error("expected cleanup to be stopped")
+	}
+
+	if err = c.Close(); err != nil {
+		t.Errorf("unexpected error closing twice: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// compileNoCachePatterns compiles the patterns of the URLs never cached.
+// Invalid patterns are skipped unless strict is set.
+func compileNoCachePatterns(patterns []string, strict bool, logger Logger) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			if strict {
+				return nil, fmt.Errorf("invalid no-cache pattern %q: %w", pattern, err)
+			}
+
+			logger.Warnf("Skipping invalid no-cache pattern %q: %v", pattern, err)
+			continue
+		}
+
+		res = append(res, re)
+	}
+
+	return res, nil
+}
+
+// bypass reports whether the cache is neither read nor written for the
+// request, because its URL matches a no-cache pattern or it carries one of
+// the bypass cookies or headers, such as the session cookie of logged-in
+// users.
+func (m *cache) bypass(r *http.Request) bool {
+	if len(m.noCache) > 0 {
+		requestURL := r.URL.String()
+		for _, re := range m.noCache {
+			if re.MatchString(requestURL) {
+				return true
+			}
+		}
+	}
+
+	for _, name := range m.cfg.BypassHeaders {
+		if r.Header.Get(name) != "" {
+			return true
+		}
+	}
+
+	for _, name := range m.cfg.BypassCookies {
+		if _, err := r.Cookie(name); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bust reports whether the request carries one of the headers forcing a miss.
+// Such requests skip reading the cache, like those with Cache-Control:
+// no-cache, but their response is stored as usual.
+func (m *cache) bust(r *http.Request) bool {
+	for _, name := range m.cfg.BustOnHeaders {
+		if _, ok := r.Header[http.CanonicalHeaderKey(name)]; ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,234 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_ServeHTTPBypass(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		value     string
+		wantBody  string
+		wantCalls int
+	}{
+		{
+			name:      "should bypass cache with session cookie",
+			header:    "Cookie",
+			value:     "theme=dark; session=abc",
+			wantBody:  "private",
+			wantCalls: 2,
+		},
+		{
+			name:      "should bypass cache with header",
+			header:    "X-Preview",
+			value:     "1",
+			wantBody:  "private",
+			wantCalls: 2,
+		},
+		{
+			name:      "should serve cache with other cookies",
+			header:    "Cookie",
+			value:     "theme=dark",
+			wantBody:  "public",
+			wantCalls: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+
+				if calls == 1 {
+					_, _ = rw.Write([]byte("public"))
+					return
+				}
+				_, _ = rw.Write([]byte("private"))
+			}
+
+			cfg := &Config{
+				Enabled:       true,
+				Backend:       backendMemory,
+				MaxExpiry:     "10",
+				Cleanup:       "20",
+				BypassCookies: []string{"session"},
+				BypassHeaders: []string{"X-Preview"},
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+			req.Header.Set(test.header, test.value)
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, req)
+
+			if body := rw.Body.String(); body != test.wantBody {
+				t.Errorf("unexpected body: want %q, got: %q", test.wantBody, body)
+			}
+
+			if calls != test.wantCalls {
+				t.Errorf("unexpected origin calls: want %d, got %d", test.wantCalls, calls)
+			}
+
+			c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+			if calls != test.wantCalls {
+				t.Errorf("expected bypassed response not to be stored: want %d calls, got %d", test.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPNoCachePatterns(t *testing.T) {
+	tests := []struct {
+		name      string
+		url       string
+		wantCalls int
+	}{
+		{
+			name:      "should pass through matching path",
+			url:       "http://localhost/account/settings",
+			wantCalls: 3,
+		},
+		{
+			name:      "should pass through matching query",
+			url:       "http://localhost/search?preview=1",
+			wantCalls: 3,
+		},
+		{
+			name:      "should cache other paths",
+			url:       "http://localhost/some/path",
+			wantCalls: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write([]byte("body"))
+			}
+
+			cfg := &Config{
+				Enabled:         true,
+				Backend:         backendMemory,
+				MaxExpiry:       "10",
+				Cleanup:         "20",
+				AddStatusHeader: true,
+				NoCachePatterns: []string{"/account/", "preview=1"},
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 3; i++ {
+				c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, test.url, nil))
+			}
+
+			if calls != test.wantCalls {
+				t.Errorf("unexpected origin calls: want %d, got %d", test.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestNew_NoCachePatterns(t *testing.T) {
+	cfg := &Config{
+		Enabled:                 true,
+		Backend:                 backendMemory,
+		MaxExpiry:               "10",
+		Cleanup:                 "20",
+		StrictPatternValidation: true,
+		NoCachePatterns:         []string{"("},
+	}
+
+	_, err := New(context.Background(), nil, cfg, "simplecache")
+	if err == nil {
+		t.Fatal("expected an invalid no-cache pattern to be rejected")
+	}
+
+	cfg.StrictPatternValidation = false
+	cfg.LogLevel = "off"
+
+	if _, err := New(context.Background(), nil, cfg, "simplecache"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCache_ServeHTTPBustOnHeaders(t *testing.T) {
+	var calls int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(rw, "v%d", calls)
+	}
+
+	cfg := &Config{
+		Enabled:         true,
+		Backend:         backendMemory,
+		MaxExpiry:       "10",
+		Cleanup:         "20",
+		AddStatusHeader: true,
+		BustOnHeaders:   []string{"x-debug"},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		debug     bool
+		wantState string
+		wantBody  string
+	}{
+		{wantState: cacheMissStatus, wantBody: "v1"},
+		{debug: true, wantState: cacheMissStatus, wantBody: "v2"},
+		{debug: true, wantState: cacheMissStatus, wantBody: "v3"},
+		{wantState: cacheHitStatus, wantBody: "v3"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		if test.debug {
+			req.Header.Set("X-Debug", "")
+		}
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+			t.Errorf("unexpected cache state: want %q, got: %q", test.wantState, state)
+		}
+
+		if body := rw.Body.String(); body != test.wantBody {
+			t.Errorf("unexpected body: want %q, got: %q", test.wantBody, body)
+		}
+	}
+}
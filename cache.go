@@ -2,218 +2,1447 @@
 package traefik_plugin_cache_by_route
 
 import (
+	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net"
 	"net/http"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pquerna/cachecontrol"
+	"github.com/pquerna/cachecontrol/cacheobject"
 )
 
 // Config configures the middleware.
 type Config struct {
-	Path                   string   `json:"path" yaml:"path" toml:"path"`
-	MaxExpiry              int      `json:"maxExpiry" yaml:"maxExpiry" toml:"maxExpiry"`
-	Cleanup                int      `json:"cleanup" yaml:"cleanup" toml:"cleanup"`
-	AddStatusHeader        bool     `json:"addStatusHeader" yaml:"addStatusHeader" toml:"addStatusHeader"`
-	AllowedHTTPMethods     []string `json:"allowedHTTPMethods" yaml:"allowedHTTPMethods" toml:"allowedHTTPMethods"`
-	SkipCacheControlHeader bool     `json:"skipCacheControlHeader" yaml:"skipCacheControlHeader" toml:"skipCacheControlHeader"`
-	DefaultTTL             int      `json:"defaultTTL" yaml:"defaultTTL" toml:"defaultTTL"`
-	URIs                   []Uri    `json:"uris" yaml:"uris" toml:"uris"`
+	Enabled                     bool        `json:"enabled" yaml:"enabled" toml:"enabled"`
+	LogLevel                    string      `json:"logLevel" yaml:"logLevel" toml:"logLevel"`
+	Backend                     string      `json:"backend" yaml:"backend" toml:"backend"`
+	Path                        string      `json:"path" yaml:"path" toml:"path"`
+	RedisAddr                   string      `json:"redisAddr" yaml:"redisAddr" toml:"redisAddr"`
+	RedisPassword               string      `json:"redisPassword" yaml:"redisPassword" toml:"redisPassword"`
+	RedisDB                     int         `json:"redisDB" yaml:"redisDB" toml:"redisDB"`
+	RedisKeyPrefix              string      `json:"redisKeyPrefix" yaml:"redisKeyPrefix" toml:"redisKeyPrefix"`
+	MaxEntries                  int         `json:"maxEntries" yaml:"maxEntries" toml:"maxEntries"`
+	MaxBytes                    int         `json:"maxBytes" yaml:"maxBytes" toml:"maxBytes"`
+	MaxDiskBytes                int         `json:"maxDiskBytes" yaml:"maxDiskBytes" toml:"maxDiskBytes"`
+	MaxExpiry                   Seconds     `json:"maxExpiry" yaml:"maxExpiry" toml:"maxExpiry"`
+	Cleanup                     Seconds     `json:"cleanup" yaml:"cleanup" toml:"cleanup"`
+	CleanupBatchSize            int         `json:"cleanupBatchSize" yaml:"cleanupBatchSize" toml:"cleanupBatchSize"`
+	FailOpen                    bool        `json:"failOpen" yaml:"failOpen" toml:"failOpen"`
+	MaxBackgroundRefresh        int         `json:"maxBackgroundRefresh" yaml:"maxBackgroundRefresh" toml:"maxBackgroundRefresh"`
+	StandardCacheStatus         bool        `json:"standardCacheStatus" yaml:"standardCacheStatus" toml:"standardCacheStatus"`
+	AddStatusHeader             bool        `json:"addStatusHeader" yaml:"addStatusHeader" toml:"addStatusHeader"`
+	StatusHeaderName            string      `json:"statusHeaderName" yaml:"statusHeaderName" toml:"statusHeaderName"`
+	DebugHeaders                bool        `json:"debugHeaders" yaml:"debugHeaders" toml:"debugHeaders"`
+	AllowedHTTPMethods          []string    `json:"allowedHTTPMethods" yaml:"allowedHTTPMethods" toml:"allowedHTTPMethods"`
+	SkipCacheControlHeader      bool        `json:"skipCacheControlHeader" yaml:"skipCacheControlHeader" toml:"skipCacheControlHeader"`
+	ForceCacheIgnoreDirectives  bool        `json:"forceCacheIgnoreDirectives" yaml:"forceCacheIgnoreDirectives" toml:"forceCacheIgnoreDirectives"`
+	DefaultTTL                  Seconds     `json:"defaultTTL" yaml:"defaultTTL" toml:"defaultTTL"`
+	CacheKey                    CacheKey    `json:"cacheKey" yaml:"cacheKey" toml:"cacheKey"`
+	KeyPrefix                   string      `json:"keyPrefix" yaml:"keyPrefix" toml:"keyPrefix"`
+	CacheKeyHeader              string      `json:"cacheKeyHeader" yaml:"cacheKeyHeader" toml:"cacheKeyHeader"`
+	TrustedProxies              []string    `json:"trustedProxies" yaml:"trustedProxies" toml:"trustedProxies"`
+	IgnoreQueryString           bool        `json:"ignoreQueryString" yaml:"ignoreQueryString" toml:"ignoreQueryString"`
+	IgnoreQueryParams           []string    `json:"ignoreQueryParams" yaml:"ignoreQueryParams" toml:"ignoreQueryParams"`
+	LowercasePathKey            bool        `json:"lowercasePathKey" yaml:"lowercasePathKey" toml:"lowercasePathKey"`
+	TrimTrailingSlash           bool        `json:"trimTrailingSlash" yaml:"trimTrailingSlash" toml:"trimTrailingSlash"`
+	CacheAuthorization          bool        `json:"cacheAuthorization" yaml:"cacheAuthorization" toml:"cacheAuthorization"`
+	CacheSetCookie              bool        `json:"cacheSetCookie" yaml:"cacheSetCookie" toml:"cacheSetCookie"`
+	GenerateETags               bool        `json:"generateETags" yaml:"generateETags" toml:"generateETags"`
+	StoreHeaderAllowlist        []string    `json:"storeHeaderAllowlist" yaml:"storeHeaderAllowlist" toml:"storeHeaderAllowlist"`
+	StoreHeaderDenylist         []string    `json:"storeHeaderDenylist" yaml:"storeHeaderDenylist" toml:"storeHeaderDenylist"`
+	CompressStorage             bool        `json:"compressStorage" yaml:"compressStorage" toml:"compressStorage"`
+	MinCacheableBodyBytes       int         `json:"minCacheableBodyBytes" yaml:"minCacheableBodyBytes" toml:"minCacheableBodyBytes"`
+	MaxCacheableBodyBytes       int         `json:"maxCacheableBodyBytes" yaml:"maxCacheableBodyBytes" toml:"maxCacheableBodyBytes"`
+	MaxStoredHeaderBytes        int         `json:"maxStoredHeaderBytes" yaml:"maxStoredHeaderBytes" toml:"maxStoredHeaderBytes"`
+	CachePostBodies             bool        `json:"cachePostBodies" yaml:"cachePostBodies" toml:"cachePostBodies"`
+	MaxPostBodyBytes            int         `json:"maxPostBodyBytes" yaml:"maxPostBodyBytes" toml:"maxPostBodyBytes"`
+	NoCachePatterns             []string    `json:"noCachePatterns" yaml:"noCachePatterns" toml:"noCachePatterns"`
+	BypassCookies               []string    `json:"bypassCookies" yaml:"bypassCookies" toml:"bypassCookies"`
+	BypassHeaders               []string    `json:"bypassHeaders" yaml:"bypassHeaders" toml:"bypassHeaders"`
+	BustOnHeaders               []string    `json:"bustOnHeaders" yaml:"bustOnHeaders" toml:"bustOnHeaders"`
+	VaryCookieAllowlist         []string    `json:"varyCookieAllowlist" yaml:"varyCookieAllowlist" toml:"varyCookieAllowlist"`
+	InvalidateOnWrite           bool        `json:"invalidateOnWrite" yaml:"invalidateOnWrite" toml:"invalidateOnWrite"`
+	ShadowMode                  bool        `json:"shadowMode" yaml:"shadowMode" toml:"shadowMode"`
+	ShadowWrites                bool        `json:"shadowWrites" yaml:"shadowWrites" toml:"shadowWrites"`
+	EnablePurge                 bool        `json:"enablePurge" yaml:"enablePurge" toml:"enablePurge"`
+	PurgeAllowlist              []string    `json:"purgeAllowlist" yaml:"purgeAllowlist" toml:"purgeAllowlist"`
+	PurgeSecret                 string      `json:"purgeSecret" yaml:"purgeSecret" toml:"purgeSecret"`
+	WarmURLs                    []string    `json:"warmUrls" yaml:"warmUrls" toml:"warmUrls"`
+	AdminPath                   string      `json:"adminPath" yaml:"adminPath" toml:"adminPath"`
+	MetricsPath                 string      `json:"metricsPath" yaml:"metricsPath" toml:"metricsPath"`
+	HealthPath                  string      `json:"healthPath" yaml:"healthPath" toml:"healthPath"`
+	DefaultStaleIfError         Seconds     `json:"defaultStaleIfError" yaml:"defaultStaleIfError" toml:"defaultStaleIfError"`
+	DefaultStaleWhileRevalidate Seconds     `json:"defaultStaleWhileRevalidate" yaml:"defaultStaleWhileRevalidate" toml:"defaultStaleWhileRevalidate"`
+	StrictPatternValidation     bool        `json:"strictPatternValidation" yaml:"strictPatternValidation" toml:"strictPatternValidation"`
+	NegativeTTL                 Seconds     `json:"negativeTTL" yaml:"negativeTTL" toml:"negativeTTL"`
+	NegativeStatuses            []int       `json:"negativeStatuses" yaml:"negativeStatuses" toml:"negativeStatuses"`
+	CacheableStatusCodes        []int       `json:"cacheableStatusCodes" yaml:"cacheableStatusCodes" toml:"cacheableStatusCodes"`
+	TTLJitter                   float64     `json:"ttlJitter" yaml:"ttlJitter" toml:"ttlJitter"`
+	StatusTTLs                  []StatusTTL `json:"statusTTLs" yaml:"statusTTLs" toml:"statusTTLs"`
+	URIs                        []Uri       `json:"uris" yaml:"uris" toml:"uris"`
+	Logger                      Logger      `json:"-" yaml:"-" toml:"-"`
+	Hooks                       Hooks       `json:"-" yaml:"-" toml:"-"`
 }
 
+// StatusTTL sets the time responses with the given status code are cached for.
+type StatusTTL struct {
+	Status int     `json:"status" yaml:"status" toml:"status"`
+	TTL    Seconds `json:"ttl" yaml:"ttl" toml:"ttl"`
+}
+
+// Uri is the caching policy of the requests whose URL matches its pattern.
+// Its settings override the global ones when set.
 type Uri struct {
-	Pattern string `json:"pattern" yaml:"pattern" toml:"pattern"`
-	TTL     int    `json:"ttl" yaml:"ttl" toml:"ttl"`
+	Pattern              string   `json:"pattern" yaml:"pattern" toml:"pattern"`
+	TTL                  Seconds  `json:"ttl" yaml:"ttl" toml:"ttl"`
+	Methods              []string `json:"methods" yaml:"methods" toml:"methods"`
+	VaryHeaders          []string `json:"varyHeaders" yaml:"varyHeaders" toml:"varyHeaders"`
+	CacheableStatusCodes []int    `json:"cacheableStatusCodes" yaml:"cacheableStatusCodes" toml:"cacheableStatusCodes"`
+	IgnoreQueryParams    []string `json:"ignoreQueryParams" yaml:"ignoreQueryParams" toml:"ignoreQueryParams"`
+}
+
+// route is the compiled form of a Uri.
+type route struct {
+	pattern      *regexp.Regexp
+	ttl          time.Duration
+	methods      map[string]struct{}
+	vary         []string
+	statuses     map[int]struct{}
+	ignoreParams map[string]struct{}
 }
 
 // CreateConfig returns a config instance.
 func CreateConfig() *Config {
 	return &Config{
-		MaxExpiry:              int((5 * time.Minute).Seconds()),
-		Cleanup:                int((5 * time.Minute).Seconds()),
-		AllowedHTTPMethods:     []string{"GET", "HEAD"},
-		DefaultTTL:             0,
-		SkipCacheControlHeader: false,
-		AddStatusHeader:        true,
+		Enabled:                 true,
+		Backend:                 backendFile,
+		MaxExpiry:               "300",
+		Cleanup:                 "300",
+		FailOpen:                true,
+		MaxBackgroundRefresh:    defaultMaxBackgroundRefresh,
+		AllowedHTTPMethods:      defaultAllowedHTTPMethods,
+		CacheKey:                defaultCacheKey,
+		DefaultTTL:              "0",
+		CacheableStatusCodes:    defaultCacheableStatusCodes,
+		MaxPostBodyBytes:        defaultMaxPostBodyBytes,
+		StoreHeaderDenylist:     defaultStoreHeaderDenylist,
+		SkipCacheControlHeader:  false,
+		AddStatusHeader:         true,
+		StatusHeaderName:        cacheHeader,
+		ShadowWrites:            true,
+		StrictPatternValidation: true,
 	}
 }
 
 const (
-	cacheHeader      = "Cache-Status"
-	cacheHitStatus   = "hit"
-	cacheMissStatus  = "miss"
-	cacheErrorStatus = "error"
+	cacheHeader           = "Cache-Status"
+	cacheHitStatus        = "hit"
+	cacheMissStatus       = "miss"
+	cacheStaleStatus      = "stale"
+	cacheStaleErrorStatus = "stale; error"
+	cacheErrorStatus      = "error"
 )
 
+var defaultAllowedHTTPMethods = []string{http.MethodGet, http.MethodHead}
+
 type cache struct {
-	name   string
-	cache  *fileCache
-	cfg    *Config
-	uriMap map[*regexp.Regexp]int
-	next   http.Handler
+	name              string
+	statusHeader      string
+	log               Logger
+	cache             Backend
+	cfg               *Config
+	keyConfig         CacheKey
+	enabled           int32
+	routes            []*route
+	noCache           []*regexp.Regexp
+	statusTTLs        map[int]time.Duration
+	negatives         map[int]struct{}
+	cacheableStatuses map[int]struct{}
+	methods           map[string]struct{}
+	storeAllow        map[string]struct{}
+	storeDeny         map[string]struct{}
+	purgeAllowlist    []*net.IPNet
+	flights           *flightGroup
+	refreshes         *flightGroup
+	work              *workGroup
+	writes            writeHealth
+	probes            int32
+	tags              *tagIndex
+	metrics           *metrics
+	random            func() float64
+	next              http.Handler
 }
 
 // New returns a plugin instance.
-func New(_ context.Context, next http.Handler, cfg *Config, name string) (http.Handler, error) {
-	if cfg.MaxExpiry <= 1 {
+func New(ctx context.Context, next http.Handler, cfg *Config, name string) (http.Handler, error) {
+	if err := validateDurations(cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxExpiry.Duration() <= time.Second {
 		return nil, errors.New("maxExpiry must be greater or equal to 1")
 	}
 
-	if cfg.Cleanup <= 1 {
+	if cfg.Cleanup.Duration() <= time.Second {
 		return nil, errors.New("cleanup must be greater or equal to 1")
 	}
 
-	fc, err := newFileCache(cfg.Path, time.Duration(cfg.Cleanup)*time.Second)
+	if cfg.DefaultTTL.Duration() < 0 {
+		return nil, errors.New("defaultTTL must not be negative")
+	}
+
+	if cfg.NegativeTTL.Duration() < 0 {
+		return nil, errors.New("negativeTTL must not be negative")
+	}
+
+	if cfg.DefaultStaleWhileRevalidate.Duration() < 0 {
+		return nil, errors.New("defaultStaleWhileRevalidate must not be negative")
+	}
+
+	if cfg.DefaultStaleIfError.Duration() < 0 {
+		return nil, errors.New("defaultStaleIfError must not be negative")
+	}
+
+	if cfg.CleanupBatchSize < 0 {
+		return nil, errors.New("cleanupBatchSize must not be negative")
+	}
+
+	if cfg.MaxStoredHeaderBytes < 0 {
+		return nil, errors.New("maxStoredHeaderBytes must not be negative")
+	}
+
+	if cfg.MaxBackgroundRefresh < 0 {
+		return nil, errors.New("maxBackgroundRefresh must not be negative")
+	}
+
+	if cfg.MinCacheableBodyBytes < 0 {
+		return nil, errors.New("minCacheableBodyBytes must not be negative")
+	}
+
+	if cfg.MaxCacheableBodyBytes > 0 && cfg.MinCacheableBodyBytes > cfg.MaxCacheableBodyBytes {
+		return nil, errors.New("minCacheableBodyBytes must not exceed maxCacheableBodyBytes")
+	}
+
+	if cfg.CachePostBodies && cfg.MaxPostBodyBytes <= 0 {
+		return nil, errors.New("maxPostBodyBytes must be positive when cachePostBodies is set")
+	}
+
+	if cfg.TTLJitter < 0 || cfg.TTLJitter >= 1 {
+		return nil, errors.New("ttlJitter must be between 0 and 1")
+	}
+
+	// The admin endpoint can disable the cache, so it is never left open.
+	if cfg.AdminPath != "" && cfg.PurgeSecret == "" && len(cfg.PurgeAllowlist) == 0 {
+		return nil, errors.New("adminPath requires purgeSecret or purgeAllowlist to be set")
+	}
+
+	logger, err := configLogger(cfg, name)
 	if err != nil {
 		return nil, err
 	}
 
-	uriMap := make(map[*regexp.Regexp]int)
-	for _, uri := range cfg.URIs {
-		re, err := regexp.Compile(uri.Pattern)
-		if err != nil {
-			continue // skip invalid regex patterns to avoid crashing the plugin
-		}
-		uriMap[re] = uri.TTL
+	if neverCaches(cfg) {
+		logger.Warnf("Nothing will be cached: skipCacheControlHeader is set without any defaultTTL, statusTTLs, uris ttl or negativeTTL, so only responses setting their own TTL with X-Cache-TTL or Surrogate-Control can be stored")
+	}
+
+	backend, err := newBackend(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	routes, err := compileRoutes(cfg.URIs, cfg.StrictPatternValidation, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	noCache, err := compileNoCachePatterns(cfg.NoCachePatterns, cfg.StrictPatternValidation, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	statusTTLs, err := parseStatusTTLs(cfg.StatusTTLs)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheableStatuses, err := parseCacheableStatusCodes(cfg.CacheableStatusCodes)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := cfg.AllowedHTTPMethods
+	if len(allowed) == 0 {
+		allowed = defaultAllowedHTTPMethods
+	}
+
+	methods := methodSet(allowed)
+
+	purgeAllowlist, err := parsePurgeAllowlist(cfg.PurgeAllowlist)
+	if err != nil {
+		return nil, err
+	}
+
+	kc, err := keyConfig(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	m := &cache{
-		name:   name,
-		cache:  fc,
-		cfg:    cfg,
-		uriMap: uriMap,
-		next:   next,
+		name:              name,
+		statusHeader:      statusHeaderName(cfg),
+		log:               logger,
+		cache:             backend,
+		cfg:               cfg,
+		keyConfig:         kc,
+		routes:            routes,
+		noCache:           noCache,
+		statusTTLs:        statusTTLs,
+		negatives:         negativeStatusSet(cfg.NegativeStatuses),
+		cacheableStatuses: cacheableStatuses,
+		methods:           methods,
+		storeAllow:        headerSet(cfg.StoreHeaderAllowlist),
+		storeDeny:         headerSet(cfg.StoreHeaderDenylist),
+		purgeAllowlist:    purgeAllowlist,
+		flights:           newFlightGroup(),
+		refreshes:         newFlightGroup(),
+		work:              newWorkGroup(cfg.MaxBackgroundRefresh),
+		tags:              &tagIndex{},
+		metrics:           newMetrics(),
+		random:            newLockedRand(time.Now().UnixNano()).Float64,
+		next:              next,
+	}
+
+	m.setEnabled(cfg.Enabled)
+
+	// The background work stops with the context, such as when the
+	// middleware is torn down.
+	if done := ctx.Done(); done != nil {
+		go func() {
+			<-done
+			if err := m.Close(); err != nil {
+				logger.Errorf("Error closing cache: %v", err)
+			}
+		}()
 	}
 
 	return m, nil
 }
 
+// Close cancels the revalidations running in the background and waits for
+// them to return, then stops the background work of the backend. It is called
+// once the context given to New is done, and may be called several times.
+func (m *cache) Close() error {
+	m.work.close()
+
+	return m.cache.Close()
+}
+
 type cacheData struct {
-	ExpiresAt time.Time
-	Status    int
-	Headers   map[string][]string
-	Body      []byte
+	StoredAt             time.Time
+	ExpiresAt            time.Time
+	Status               int
+	Headers              map[string][]string
+	Body                 []byte `json:",omitempty"`
+	Size                 int
+	Vary                 []string
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	MustRevalidate       bool
+	Streamed             bool
+	Compressed           bool
+
+	// body streams the body of entries stored apart from their metadata.
+	body io.ReadCloser
+}
+
+func (d *cacheData) closeBody() {
+	if d != nil && d.body != nil {
+		_ = d.body.Close()
+	}
+}
+
+func (d *cacheData) fresh() bool {
+	return time.Now().Before(d.ExpiresAt)
+}
+
+// revalidatable reports whether the expired entry may be served while it is
+// refreshed in the background. Entries that must be revalidated never are.
+func (d *cacheData) revalidatable() bool {
+	return !d.MustRevalidate && time.Now().Before(d.ExpiresAt.Add(d.StaleWhileRevalidate))
+}
+
+// usableOnError reports whether the entry may replace an error of the origin.
+// Entries that must be revalidated never are once expired.
+func (d *cacheData) usableOnError() bool {
+	if d == nil || d.MustRevalidate && !d.fresh() {
+		return false
+	}
+
+	return time.Now().Before(d.ExpiresAt.Add(d.StaleIfError))
 }
 
 // ServeHTTP serves an HTTP request.
 func (m *cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.cfg.MetricsPath != "" && r.URL.Path == m.cfg.MetricsPath {
+		m.serveMetrics(w)
+		return
+	}
+
+	if m.cfg.HealthPath != "" && r.URL.Path == m.cfg.HealthPath {
+		m.serveHealth(w)
+		return
+	}
+
+	if m.cfg.AdminPath != "" && strings.HasPrefix(r.URL.Path, m.cfg.AdminPath+"/") {
+		m.serveAdmin(w, r)
+		return
+	}
+
+	if m.cfg.EnablePurge && r.Method == methodPurge {
+		m.purge(w, r)
+		return
+	}
+
+	if !m.isEnabled() {
+		m.debug(w.Header(), "", "disabled", 0)
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	if !m.methodAllowed(r) {
+		m.debug(w.Header(), "", "method-not-allowed", 0)
+		m.next.ServeHTTP(w, r)
+
+		if m.cfg.InvalidateOnWrite && mutating(r.Method) {
+			m.invalidate(r)
+		}
+		return
+	}
+
+	r, ok := m.readPostBody(r)
+	if !ok {
+		m.debug(w.Header(), "", "body-too-large", 0)
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	if m.cfg.ShadowMode {
+		m.shadow(w, r)
+		return
+	}
+
 	cs := cacheMissStatus
 
-	key := cacheKey(r)
+	key := m.requestKey(r)
 
-	b, err := m.cache.Get(key)
-	if err == nil {
-		var data cacheData
+	r, traced := m.traceRequest(r, key)
+	defer traced()
 
-		err := json.Unmarshal(b, &data)
-		if err != nil {
-			cs = cacheErrorStatus
-		} else {
-			for key, vals := range data.Headers {
-				for _, val := range vals {
-					w.Header().Add(key, val)
-				}
-			}
-			if m.cfg.AddStatusHeader {
-				maxAge := data.ExpiresAt.Sub(time.Now()).Seconds()
-				w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge)))
-				w.Header().Set(cacheHeader, cacheHitStatus)
-			}
-			w.WriteHeader(data.Status)
-			_, _ = w.Write(data.Body)
+	reqCC := requestDirectives(r)
+	switch {
+	case reqCC.NoStore, m.bypass(r):
+		m.debug(w.Header(), key, "bypass", 0)
+		m.next.ServeHTTP(w, r)
+		return
+	case m.failClosed():
+		m.debug(w.Header(), key, "write-failing", 0)
+		m.unavailable(w, r, key)
+		return
+	case reqCC.NoCache, m.bust(r):
+		m.fetch(w, r, key, cs, nil)
+		return
+	}
+
+	stale, err := m.lookup(key, r)
+	if errors.Is(err, ErrCacheMiss) && r.Method == http.MethodHead {
+		stale, err = m.lookupGet(r)
+	}
+	defer stale.closeBody()
+
+	switch {
+	case err == nil && stale.fresh():
+		m.debug(w.Header(), key, "hit", time.Until(stale.ExpiresAt))
+		m.serve(w, r, stale, cacheHitStatus)
+		return
+	case reqCC.OnlyIfCached:
+		m.debug(w.Header(), key, "only-if-cached", 0)
+		m.unsatisfiable(w, r, key)
+		return
+	case err == nil && stale.revalidatable():
+		m.revalidate(key, r)
+		m.debug(w.Header(), key, "stale", 0)
+		m.serve(w, r, stale, cacheStaleStatus)
+		return
+	case err != nil && !errors.Is(err, ErrCacheMiss):
+		cs = cacheErrorStatus
+	}
+
+	done, leader := m.flights.join(key)
+	if leader {
+		defer m.flights.leave(key)
+	} else {
+		data, err := m.awaitLeader(done, key, r)
+		switch {
+		case err == nil:
+			m.debug(w.Header(), key, "hit", time.Until(data.ExpiresAt))
+			m.serve(w, r, data, cacheHitStatus)
+			data.closeBody()
+			return
+		case r.Context().Err() != nil:
 			return
 		}
 	}
 
-	if m.cfg.AddStatusHeader {
-		w.Header().Set(cacheHeader, cs)
+	m.fetch(w, r, key, cs, stale)
+}
+
+// fetch forwards the request to the origin and stores the response if it is
+// cacheable. When a stale entry may be served on error, the origin response
+// is buffered so that a 5xx can be replaced by the stale entry.
+func (m *cache) fetch(w http.ResponseWriter, r *http.Request, key, cs string, stale *cacheData) {
+	m.log.Debugf("Fetching %s %s from origin", r.Method, r.URL)
+
+	// Requests without a status, made in the background or in shadow mode,
+	// leave the response untouched.
+	if m.cfg.AddStatusHeader && cs != "" {
+		w.Header().Set(m.statusHeader, m.cacheStatus(cs, nil, key))
+	}
+
+	rw := &responseWriter{ResponseWriter: w, status: http.StatusOK, limit: m.cfg.MaxCacheableBodyBytes}
+
+	out := w
+	var buf *errorBuffer
+	if stale.usableOnError() {
+		// The whole body is needed to replay the response, so it cannot be
+		// bounded in this case.
+		buf = newErrorBuffer(w)
+		out = buf
+		rw = &responseWriter{ResponseWriter: out, status: http.StatusOK}
+	}
+	rw.onHeaders = m.debugDecision(r, key)
+
+	req := originRequest(r)
+	if cs != "" {
+		req = withCacheStatus(req, cs, key)
+	}
+
+	start := time.Now()
+	m.next.ServeHTTP(rw, req)
+	m.metrics.observeOrigin(time.Since(start))
+	rw.takeHeaders()
+
+	// A flushed response was already streamed to the client, so it cannot
+	// be replaced by the stale entry anymore.
+	if buf != nil && !buf.streaming {
+		if rw.status >= http.StatusInternalServerError {
+			m.serve(w, r, stale, cacheStaleErrorStatus)
+			return
+		}
+
+		buf.commit()
+	}
+
+	m.metrics.request(cs)
+	if cs != "" {
+		m.hookMiss(key, r, cs, rw.status, len(rw.body))
+		m.trace(r).outcome(cs, time.Time{})
+	}
+
+	if rw.overflow {
+		return
 	}
 
-	rw := &responseWriter{ResponseWriter: w}
-	m.next.ServeHTTP(rw, r)
+	// The headers of the origin, without those the plugin injected.
+	headers := m.storedHeaders(out.Header())
 
-	expiry, ok := m.cacheable(r, w, rw.status)
+	if reason := incomplete(r, headers, rw.body); reason != "" {
+		m.log.Debugf("Not storing %q: %s", key, reason)
+		return
+	}
+
+	if r.Method != http.MethodHead && len(rw.body) < m.cfg.MinCacheableBodyBytes {
+		m.log.Debugf("Not storing %q: body of %d bytes is too small", key, len(rw.body))
+		return
+	}
+
+	if n := headerBytes(headers); m.cfg.MaxStoredHeaderBytes > 0 && n > m.cfg.MaxStoredHeaderBytes {
+		m.log.Warnf("Not storing %q: headers of %d bytes exceed maxStoredHeaderBytes", key, n)
+		return
+	}
+
+	expiry, ok := m.cacheable(r, headers, rw.status, rw.surrogate)
 	if !ok {
+		m.log.Debugf("Not storing %q: response is not cacheable", key)
+		return
+	}
+
+	expiry = m.jitter(expiry)
+
+	m.log.Debugf("Storing %q for %v", key, expiry)
+
+	swr, sie := m.staleWindows(headers)
+	m.addETag(r, headers, rw.body)
+
+	now := time.Now()
+
+	m.store(key, r, &cacheData{
+		StoredAt:             now,
+		ExpiresAt:            now.Add(expiry),
+		Status:               rw.status,
+		Headers:              headers,
+		Body:                 rw.body,
+		Size:                 len(rw.body),
+		Vary:                 m.variantHeaders(r, headers),
+		StaleWhileRevalidate: swr,
+		StaleIfError:         sie,
+		MustRevalidate:       mustRevalidate(headers),
+	}, expiry)
+}
+
+// incomplete returns why the response may have been cut short, either because
+// the request was cancelled or because its body does not match its
+// Content-Length, or an empty string if it looks complete.
+func incomplete(r *http.Request, h http.Header, body []byte) string {
+	if err := r.Context().Err(); err != nil {
+		return fmt.Sprintf("request ended early: %v", err)
+	}
+
+	if r.Method == http.MethodHead || h.Get("Content-Length") == "" {
+		return ""
+	}
+
+	length, err := strconv.Atoi(h.Get("Content-Length"))
+	if err != nil || length != len(body) {
+		return fmt.Sprintf("body of %d bytes does not match Content-Length %q", len(body), h.Get("Content-Length"))
+	}
+
+	return ""
+}
+
+// unsatisfiable responds to a request with the only-if-cached directive for
+// which no fresh response is stored, without contacting the origin.
+func (m *cache) unsatisfiable(w http.ResponseWriter, r *http.Request, key string) {
+	m.log.Debugf("No cached response for %s %s with only-if-cached", r.Method, r.URL)
+	m.metrics.request(cacheMissStatus)
+	m.trace(r).outcome(cacheMissStatus, time.Time{})
+
+	if m.cfg.AddStatusHeader {
+		w.Header().Set(m.statusHeader, m.cacheStatus(cacheMissStatus, nil, key))
+	}
+
+	http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+}
+
+// awaitLeader waits for the request already fetching the key from the origin
+// and returns what it stored, if anything.
+func (m *cache) awaitLeader(done <-chan struct{}, key string, r *http.Request) (*cacheData, error) {
+	select {
+	case <-done:
+		data, err := m.lookup(key, r)
+		if err == nil && !data.fresh() {
+			data.closeBody()
+			return nil, ErrCacheMiss
+		}
+		return data, err
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+}
+
+// lookup returns the cached response for the request, resolving the variant
+// to use when the stored response varies on request headers. A gzip response
+// the client does not accept is decoded for it, and one with any other content
+// coding the client does not accept is a miss.
+func (m *cache) lookup(key string, r *http.Request) (*cacheData, error) {
+	defer m.trace(r).backendSince(time.Now())
+
+	data, err := m.get(key)
+	if err == nil && len(data.Vary) > 0 {
+		data, err = m.get(m.varyKey(key, data.Vary, r))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ce := http.Header(data.Headers).Get("Content-Encoding")
+	if acceptsEncoding(r, ce) {
+		return data, nil
+	}
+
+	if !gzipCoding(ce) || !acceptsEncoding(r, "identity") {
+		data.closeBody()
+		return nil, ErrCacheMiss
+	}
+
+	if err = data.decode(); err != nil {
+		data.closeBody()
+		m.log.Debugf("Not serving %q: error decoding gzip body: %v", key, err)
+		return nil, ErrCacheMiss
+	}
+
+	return data, nil
+}
+
+func (m *cache) get(key string) (*cacheData, error) {
+	b, body, err := m.read(key)
+	if errors.Is(err, errCorruptEntry) {
+		m.evictCorrupt(key, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := unmarshalCacheData(b)
+	if err != nil {
+		if body != nil {
+			_ = body.Close()
+		}
+		m.evictCorrupt(key, err)
+		return nil, fmt.Errorf("error deserializing cache item: %w", err)
+	}
+
+	switch {
+	case data.Streamed && body == nil:
+		return nil, ErrCacheMiss
+	case data.Streamed:
+		data.body = body
+	case body != nil:
+		_ = body.Close()
+	}
+
+	if data.Compressed {
+		if err = data.decompress(); err != nil {
+			data.closeBody()
+			m.evictCorrupt(key, err)
+			return nil, fmt.Errorf("error decompressing cache item: %w", err)
+		}
+	}
+
+	return data, nil
+}
+
+// evictCorrupt deletes an entry which cannot be read, so that the next request
+// stores it again rather than failing on it as well.
+func (m *cache) evictCorrupt(key string, err error) {
+	m.log.Warnf("Evicting corrupt cache item %q: %v", key, err)
+
+	if err = m.cache.Delete(key); err != nil && !errors.Is(err, ErrCacheMiss) {
+		m.log.Errorf("Error evicting corrupt cache item %q: %v", key, err)
+		return
+	}
+
+	m.hookEvict(key)
+}
+
+// read returns the value stored at key, along with its body for backends
+// storing it apart.
+func (m *cache) read(key string) ([]byte, io.ReadCloser, error) {
+	if bs, ok := m.cache.(bodyStreamer); ok {
+		return bs.GetWithBody(key)
+	}
+
+	b, err := m.cache.Get(key)
+
+	return b, nil, err
+}
+
+func (m *cache) serve(w http.ResponseWriter, r *http.Request, data *cacheData, cs string) {
+	m.log.Debugf("Serving %s %s from cache: %s", r.Method, r.URL, cs)
+	m.metrics.request(cs)
+	m.hookHit(r, data, cs)
+	m.trace(r).outcome(cs, data.ExpiresAt)
+
+	// Headers sent already, such as by another middleware, can be neither
+	// changed nor sent again.
+	if committed(w) {
+		m.log.Warnf("Headers of %s %s already written, serving the cached body alone", r.Method, r.URL)
+		writeBody(w, r, data)
+		return
+	}
+
+	headers := http.Header(data.Headers).Clone()
+	removeHopByHopHeaders(headers)
+
+	for key, vals := range headers {
+		for _, val := range vals {
+			w.Header().Add(key, val)
+		}
+	}
+	// The stored Date is when the origin generated the response, which the
+	// Age accounts for.
+	w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if !data.StoredAt.IsZero() {
+		w.Header().Set("Age", strconv.Itoa(int(time.Since(data.StoredAt).Seconds())))
+	}
+	if m.cfg.AddStatusHeader {
+		// Replaces the stored Cache-Control with the time left, which is
+		// zero for stale entries.
+		maxAge := time.Until(data.ExpiresAt)
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+		w.Header().Set(m.statusHeader, m.cacheStatus(cs, data, m.requestKey(r)))
+	}
+	if data.Status == http.StatusOK && notModified(r, data.Headers) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
+	if data.Status == http.StatusOK && w.Header().Get("Accept-Ranges") == "" {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+	if servesRange(r, data) {
+		serveRange(w, r, data)
+		return
+	}
+	setContentLength(w.Header(), r, data)
+	w.WriteHeader(data.Status)
+	writeBody(w, r, data)
+}
+
+// writeBody writes the body of the cached response, but for HEAD requests.
+func writeBody(w http.ResponseWriter, r *http.Request, data *cacheData) {
+	if r.Method == http.MethodHead {
+		return
+	}
+	if data.body != nil {
+		_, _ = io.Copy(w, data.body)
+		return
+	}
+	_, _ = w.Write(data.Body)
+}
+
+// committed reports whether the headers of the response were written already,
+// for writers telling so through a Written method, like those of the plugin
+// and of common middleware libraries.
+func committed(w http.ResponseWriter) bool {
+	c, ok := w.(interface{ Written() bool })
+
+	return ok && c.Written()
+}
+
+// setContentLength sets the Content-Length of a hit to the size of the body
+// served, as the stored one may not match it, for instance after a change of
+// the storage compression. HEAD responses stored without a body keep the
+// Content-Length of the origin.
+func setContentLength(h http.Header, r *http.Request, data *cacheData) {
+	switch {
+	case data.Status == http.StatusNoContent, data.Status == http.StatusNotModified:
+		h.Del("Content-Length")
+	case data.body == nil && r.Method != http.MethodHead:
+		h.Set("Content-Length", strconv.Itoa(len(data.Body)))
+	case data.Size > 0:
+		h.Set("Content-Length", strconv.Itoa(data.Size))
+	case r.Method != http.MethodHead:
+		// A streamed body of unknown size.
+		h.Del("Content-Length")
+	}
+}
+
+// store saves the response under the key. Responses that vary on request
+// headers are stored under a variant key, with a marker entry left at the
+// key recording which headers select the variant. The headers of an existing
+// marker are kept so that storing one variant does not hide the others.
+// Entries are kept in the backend past their expiry for as long as they may
+// be served stale.
+func (m *cache) store(key string, r *http.Request, data *cacheData, expiry time.Duration) {
+	defer m.trace(r).backendSince(time.Now())
+
+	ttl := expiry + data.StaleWhileRevalidate
+	if data.StaleWhileRevalidate < data.StaleIfError {
+		ttl = expiry + data.StaleIfError
+	}
+
+	if marker, err := m.get(key); err == nil {
+		marker.closeBody()
+		data.Vary = mergeHeaderNames(data.Vary, marker.Vary)
+	}
+
+	if len(data.Vary) > 0 {
+		m.set(key, &cacheData{ExpiresAt: data.ExpiresAt, Vary: data.Vary}, ttl)
+		key = m.varyKey(key, data.Vary, r)
+	}
+
+	tags := parseTags(http.Header(data.Headers).Values(cacheTagsHeader))
+	noCache := noCacheFields(data.Headers)
+
+	data.Headers = m.storableHeaders(data.Headers)
+	for name := range noCache {
+		delete(data.Headers, name)
+	}
+
+	if m.set(key, data, ttl) {
+		m.hookStore(key, r, data)
+		m.trace(r).setTTL(data.ExpiresAt)
+	}
+	m.tag(key, tags, ttl)
+}
+
+// set writes the entry at key, reporting whether it was stored.
+func (m *cache) set(key string, data *cacheData, expiry time.Duration) bool {
+	// Bodies already encoded by the origin are stored as they are, so that
+	// they are served with their Content-Encoding untouched.
+	if m.cfg.CompressStorage && len(data.Body) > 0 && !encoded(data.Headers) {
+		compressed, err := data.compress()
+		if err != nil {
+			m.log.Errorf("Error compressing cache item: %v", err)
+			return false
+		}
+
+		data = compressed
+	}
 
-	data := cacheData{
-		ExpiresAt: time.Now().Add(expiry),
-		Status:    rw.status,
-		Headers:   w.Header(),
-		Body:      rw.body,
+	bs, streams := m.cache.(bodyStreamer)
+	streams = streams && len(data.Body) > 0
+
+	meta := data
+	if streams {
+		stripped := *data
+		stripped.Body = nil
+		stripped.Streamed = true
+		meta = &stripped
 	}
 
-	b, err = json.Marshal(data)
+	b, err := marshalCacheData(meta)
 	if err != nil {
-		log.Printf("Error serializing cache item: %v", err)
+		m.log.Errorf("Error serializing cache item: %v", err)
+		return false
+	}
+
+	if streams {
+		err = bs.SetWithBody(key, b, data.Body, expiry)
+	} else {
+		err = m.cache.Set(key, b, expiry)
 	}
 
-	if err = m.cache.Set(key, b, expiry); err != nil {
-		log.Printf("Error setting cache item: %v", err)
+	m.writes.record(err)
+	if err != nil {
+		m.metrics.writeError()
+		m.log.Errorf("Error setting cache item: %v", err)
+		return false
 	}
+
+	return true
+}
+
+// cacheable returns how long the response with the status and headers produced
+// by the origin may be stored, if at all. The headers must not include those
+// injected by the plugin.
+func (m *cache) cacheable(r *http.Request, h http.Header, status int, surrogate http.Header) (time.Duration, bool) {
+	ttl, ok, _ := m.decide(r, h, status, surrogate)
+	return ttl, ok
 }
 
-func (m *cache) cacheable(r *http.Request, w http.ResponseWriter, status int) (time.Duration, bool) {
+// decide is cacheable, along with the reason of the decision reported in the
+// debug headers.
+func (m *cache) decide(r *http.Request, h http.Header, status int, surrogate http.Header) (time.Duration, bool, string) {
+	// A 304 has no body to replay, and a 206 only part of it.
+	if status == http.StatusNotModified || status == http.StatusPartialContent {
+		return 0, false, "status-not-cacheable"
+	}
+
+	if !m.statusAllowed(r, status) {
+		return 0, false, "status-not-cacheable"
+	}
+
+	// A wildcard Vary means the response can never be selected by a cache.
+	if strings.Contains(strings.Join(h.Values("Vary"), ","), "*") {
+		return 0, false, "vary-wildcard"
+	}
+
+	// Cookies are usually set for a single user and must not leak to others,
+	// unless they are left out of the entry by a field-scoped no-cache.
+	if !m.cfg.CacheSetCookie && h.Get("Set-Cookie") != "" && !noCacheFields(h)["Set-Cookie"] {
+		return 0, false, "set-cookie"
+	}
+
+	if !m.authorizationCacheable(r, h) {
+		return 0, false, "authorization"
+	}
+
+	// The origin setting the TTL for the cache overrides everything else.
+	if ttl, ok := surrogateTTL(surrogate); ok {
+		return m.clampExpiry(ttl), ttl > 0, "surrogate-control"
+	}
+
+	if m.negative(status) {
+		ttl, ok := m.negativeExpiry(h)
+		return ttl, ok, "negative-status"
+	}
+
 	if !m.cfg.SkipCacheControlHeader {
-		reasons, expireBy, err := cachecontrol.CachableResponseWriter(r, status, w, cachecontrol.Options{})
-		if err != nil || len(reasons) > 0 {
+		ttl, ok := m.cacheControlExpiry(r, h, status)
+		return ttl, ok, "cache-control"
+	}
+
+	// Only the freshness lifetime of the origin is ignored, unless told
+	// otherwise, as a shared cache must not store private responses.
+	if !m.cfg.ForceCacheIgnoreDirectives && forbidsStoring(h) {
+		return 0, false, "no-store"
+	}
+
+	// A zero TTL keeps responses with the status from being cached.
+	if ttl, ok := m.statusTTLs[status]; ok {
+		return m.clampExpiry(ttl), ttl > 0, "status-ttl:" + strconv.Itoa(status)
+	}
+
+	if rt := m.route(r); rt != nil {
+		return m.clampExpiry(rt.ttl), true, "pattern-match:" + rt.pattern.String()
+	}
+
+	if m.cfg.DefaultTTL.Duration() > 0 {
+		return m.clampExpiry(m.cfg.DefaultTTL.Duration()), true, "default-ttl"
+	}
+
+	return 0, false, "no-ttl"
+}
+
+// cacheControlExpiry returns the expiry of the response from its headers. As a
+// shared cache, s-maxage takes precedence over max-age, then Expires, then the
+// heuristic freshness of Last-Modified. Responses without any fall back to the
+// default TTL.
+func (m *cache) cacheControlExpiry(r *http.Request, h http.Header, status int) (time.Duration, bool) {
+	// Entries keyed by credentials can be stored whatever the response says
+	// about authorized requests.
+	if m.cfg.CacheAuthorization && r.Header.Get("Authorization") != "" {
+		r = r.Clone(r.Context())
+		r.Header.Del("Authorization")
+	}
+
+	// POST requests keyed by their body are cached like GET ones.
+	if _, ok := postBodyFrom(r.Context()); ok {
+		r = r.Clone(r.Context())
+		r.Method = http.MethodGet
+	}
+
+	resp := &http.Response{StatusCode: status, Header: h}
+
+	reasons, expireBy, err := cachecontrol.CachableResponse(r, resp, cachecontrol.Options{})
+	if err != nil || len(reasons) > 0 || expiredByHeader(h) {
+		return 0, false
+	}
+
+	if expireBy.IsZero() {
+		if m.cfg.DefaultTTL.Duration() <= 0 {
 			return 0, false
 		}
 
-		if m.cfg.SkipCacheControlHeader {
-			expireBy = time.Now().Add(time.Duration(m.cfg.DefaultTTL) * time.Second)
+		return m.clampExpiry(m.cfg.DefaultTTL.Duration()), true
+	}
+
+	expiry := time.Until(expireBy)
+	if expiry <= 0 {
+		return 0, false
+	}
+
+	return m.clampExpiry(expiry), true
+}
+
+// forbidsStoring reports whether the response is marked no-store or private.
+func forbidsStoring(h http.Header) bool {
+	cc, err := cacheobject.ParseResponseCacheControl(h.Get("Cache-Control"))
+	if err != nil {
+		return false
+	}
+
+	return cc.NoStore || cc.PrivatePresent
+}
+
+// noCacheFields returns the header names listed by the no-cache directive of
+// the response, such as no-cache="Set-Cookie". The response may be stored
+// without these headers, which must not be sent without revalidation.
+func noCacheFields(h http.Header) cacheobject.FieldNames {
+	cc, err := cacheobject.ParseResponseCacheControl(h.Get("Cache-Control"))
+	if err != nil {
+		return nil
+	}
+
+	return cc.NoCache
+}
+
+// expiredByHeader reports whether the response has no max-age or s-maxage
+// directive and an Expires header which is not a valid date, such as "0",
+// meaning it is already expired.
+func expiredByHeader(h http.Header) bool {
+	expires := h.Get("Expires")
+	if expires == "" {
+		return false
+	}
+
+	cc, err := cacheobject.ParseResponseCacheControl(h.Get("Cache-Control"))
+	if err == nil && (cc.MaxAge >= 0 || cc.SMaxAge >= 0) {
+		return false
+	}
+
+	_, err = http.ParseTime(expires)
+
+	return err != nil
+}
+
+// neverCaches reports whether the configuration leaves no TTL to cache
+// responses for, but the one the origin may set itself. The headers of the
+// origin being ignored, responses are only cached for the configured TTLs.
+func neverCaches(cfg *Config) bool {
+	if !cfg.SkipCacheControlHeader || cfg.DefaultTTL.Duration() > 0 || cfg.NegativeTTL.Duration() > 0 {
+		return false
+	}
+
+	for _, uri := range cfg.URIs {
+		if uri.TTL.Duration() > 0 {
+			return false
+		}
+	}
+
+	for _, st := range cfg.StatusTTLs {
+		if st.TTL.Duration() > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// clampExpiry limits the expiry to the configured maximum.
+func (m *cache) clampExpiry(expiry time.Duration) time.Duration {
+	if maxExpiry := m.cfg.MaxExpiry.Duration(); maxExpiry < expiry {
+		return maxExpiry
+	}
+
+	return expiry
+}
+
+// parseStatusTTLs indexes the configured TTLs by status code.
+func parseStatusTTLs(statusTTLs []StatusTTL) (map[int]time.Duration, error) {
+	ttls := make(map[int]time.Duration, len(statusTTLs))
+
+	for _, st := range statusTTLs {
+		if st.Status < 100 || st.Status > 599 {
+			return nil, fmt.Errorf("invalid status code %d in statusTTLs", st.Status)
+		}
+
+		if st.TTL.Duration() < 0 {
+			return nil, fmt.Errorf("ttl of status %d must not be negative", st.Status)
+		}
+
+		ttls[st.Status] = st.TTL.Duration()
+	}
+
+	return ttls, nil
+}
+
+// compileRoutes compiles the configured URIs, in order. Invalid patterns are
+// skipped with a warning unless strict is set.
+func compileRoutes(uris []Uri, strict bool, logger Logger) ([]*route, error) {
+	routes := make([]*route, 0, len(uris))
+
+	for _, uri := range uris {
+		if uri.TTL.Duration() < 0 {
+			return nil, fmt.Errorf("ttl of pattern %q must not be negative", uri.Pattern)
+		}
+
+		re, err := regexp.Compile(uri.Pattern)
+		if err != nil {
+			if strict {
+				return nil, fmt.Errorf("invalid pattern %q: %w", uri.Pattern, err)
+			}
+
+			logger.Warnf("Skipping invalid pattern %q: %v", uri.Pattern, err)
+			continue
+		}
+
+		statuses, err := parseCacheableStatusCodes(uri.CacheableStatusCodes)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", uri.Pattern, err)
+		}
+
+		routes = append(routes, &route{
+			pattern:      re,
+			ttl:          uri.TTL.Duration(),
+			methods:      methodSet(uri.Methods),
+			vary:         varyHeaders(http.Header{"Vary": uri.VaryHeaders}),
+			statuses:     statuses,
+			ignoreParams: paramSet(uri.IgnoreQueryParams),
+		})
+	}
+
+	return routes, nil
+}
+
+// route returns the first configured route matching the request URL, if any.
+func (m *cache) route(r *http.Request) *route {
+	requestURL := r.URL.String()
+	for _, rt := range m.routes {
+		if rt.pattern.MatchString(requestURL) {
+			return rt
+		}
+	}
+
+	return nil
+}
+
+// variantHeaders returns the request headers selecting the variant of the
+// response, adding those the matching route varies on to the response's.
+func (m *cache) variantHeaders(r *http.Request, h http.Header) []string {
+	names := storedVary(h)
+	if rt := m.route(r); rt != nil {
+		names = mergeHeaderNames(names, rt.vary)
+	}
+
+	return names
+}
+
+// methodAllowed reports whether the request method may be cached. The methods
+// of the matching route, when set, take precedence over the global ones.
+func (m *cache) methodAllowed(r *http.Request) bool {
+	methods := m.methods
+	if rt := m.route(r); rt != nil && len(rt.methods) > 0 {
+		methods = rt.methods
+	}
+
+	_, ok := methods[r.Method]
+
+	return ok
+}
+
+func methodSet(methods []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(methods))
+	for _, method := range methods {
+		set[strings.ToUpper(method)] = struct{}{}
+	}
+
+	return set
+}
+
+// requestDirectives returns the Cache-Control directives of the request.
+// Invalid directives are ignored. Without Cache-Control, Pragma: no-cache,
+// sent by HTTP/1.0 clients, stands for no-cache.
+func requestDirectives(r *http.Request) *cacheobject.RequestCacheDirectives {
+	cc, err := cacheobject.ParseRequestCacheControl(r.Header.Get("Cache-Control"))
+	if err != nil {
+		return &cacheobject.RequestCacheDirectives{MaxAge: -1, MaxStale: -1, MinFresh: -1}
+	}
+
+	if _, ok := r.Header["Cache-Control"]; !ok && pragmaNoCache(r) {
+		cc.NoCache = true
+	}
+
+	return cc
+}
+
+// pragmaNoCache reports whether the Pragma header of the request includes
+// no-cache.
+func pragmaNoCache(r *http.Request) bool {
+	for _, v := range r.Header.Values("Pragma") {
+		for _, directive := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+				return true
+			}
 		}
+	}
+
+	return false
+}
+
+// requestKey returns the key of the entry cached for the request.
+func (m *cache) requestKey(r *http.Request) string {
+	key := cacheKey(r, m.keyFor(r))
+	if pb, ok := postBodyFrom(r.Context()); ok {
+		key += "|body=" + pb.hash
+	}
+	if m.cfg.CacheAuthorization {
+		key = credentialsKey(key, r)
+	}
 
-		expiry := time.Until(expireBy)
-		maxExpiry := time.Duration(m.cfg.MaxExpiry) * time.Second
+	return key
+}
+
+// lookupGet returns the fresh response cached for a GET request to the URL of
+// the HEAD request, whose status and headers answer it as well.
+func (m *cache) lookupGet(r *http.Request) (*cacheData, error) {
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+
+	data, err := m.lookup(m.requestKey(req), req)
+	if err == nil && !data.fresh() {
+		data.closeBody()
+		return nil, ErrCacheMiss
+	}
 
-		if maxExpiry < expiry {
-			expiry = maxExpiry
+	return data, err
+}
+
+// headerBytes returns the size of the headers, as written on the wire.
+func headerBytes(h http.Header) int {
+	var n int
+	for name, vals := range h {
+		for _, val := range vals {
+			n += len(name) + len(": ") + len(val) + len("\r\n")
 		}
+	}
 
-		return expiry, true
+	return n
+}
+
+// statusHeaderName returns the name of the cache status header, Cache-Status
+// unless configured otherwise.
+func statusHeaderName(cfg *Config) string {
+	if cfg.StatusHeaderName == "" {
+		return cacheHeader
 	}
 
-	requestUrl := r.URL.String()
-	for re, ttl := range m.uriMap {
-		if re.MatchString(requestUrl) {
-			expiry := time.Duration(ttl) * time.Second
-			maxExpiry := time.Duration(m.cfg.MaxExpiry) * time.Second
+	return http.CanonicalHeaderKey(cfg.StatusHeaderName)
+}
+
+// storedHeaders returns a copy of the response headers without the headers
+// the plugin injects itself, which must be recomputed on every hit. A
+// Cache-Status set by an upstream cache is kept unless it is the status
+// header of the plugin.
+func (m *cache) storedHeaders(h http.Header) http.Header {
+	stored := h.Clone()
+	stored.Del(m.statusHeader)
+	stored.Del("Age")
+	stored.Del(debugKeyHeader)
+	stored.Del(debugTTLHeader)
+	stored.Del(debugReasonHeader)
+	removeHopByHopHeaders(stored)
 
-			if maxExpiry < expiry {
-				expiry = maxExpiry
+	return stored
+}
+
+// hopByHopHeaders describe a single connection and must not be cached.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers from h, along with the
+// headers listed in its Connection header.
+func removeHopByHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
 			}
+		}
+	}
 
-			return expiry, true
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// varyHeaders returns the sorted, canonical request header names listed in the
+// Vary header.
+func varyHeaders(h http.Header) []string {
+	seen := make(map[string]struct{})
+
+	var names []string
+	for _, val := range h.Values("Vary") {
+		for _, name := range strings.Split(val, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			names = append(names, name)
 		}
 	}
-	if m.cfg.DefaultTTL > 0 {
-		expiry := time.Duration(m.cfg.DefaultTTL) * time.Second
-		maxExpiry := time.Duration(m.cfg.MaxExpiry) * time.Second
 
-		if maxExpiry < expiry {
-			expiry = maxExpiry
+	sort.Strings(names)
+
+	return names
+}
+
+// mergeHeaderNames returns the sorted union of the header name lists.
+func mergeHeaderNames(a, b []string) []string {
+	if len(b) == 0 {
+		return a
+	}
+
+	seen := make(map[string]struct{}, len(a)+len(b))
+
+	var names []string
+	for _, name := range append(append([]string(nil), a...), b...) {
+		if _, ok := seen[name]; ok {
+			continue
 		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// varyKey returns the key of the variant selected by the request's values for
+// the given headers.
+func (m *cache) varyKey(key string, names []string, r *http.Request) string {
+	var b strings.Builder
 
-		return expiry, true
+	b.WriteString(key)
+	for _, name := range names {
+		b.WriteString("|")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(m.varyValue(name, r))
 	}
-	return 0, false
+
+	return b.String()
 }
 
-func cacheKey(r *http.Request) string {
-	return r.Method + r.Host + r.URL.Path
+// varyValue returns the request's value for a header listed in Vary. When an
+// allowlist is configured, a response varying on Cookie is only selected by
+// the allowlisted cookies, so that volatile ones such as session identifiers
+// do not split it into one variant per client.
+func (m *cache) varyValue(name string, r *http.Request) string {
+	if name != "Cookie" || len(m.cfg.VaryCookieAllowlist) == 0 {
+		return strings.Join(r.Header.Values(name), ",")
+	}
+
+	var vals []string
+	for _, cookie := range m.cfg.VaryCookieAllowlist {
+		if c, err := r.Cookie(cookie); err == nil {
+			vals = append(vals, c.Name+"="+c.Value)
+		}
+	}
+
+	return strings.Join(vals, "; ")
 }
 
+// responseWriter captures the response written through it. Once more than
+// limit bytes have been written, the body is no longer buffered and the
+// response is flagged as overflowing. A zero limit is unbounded.
 type responseWriter struct {
 	http.ResponseWriter
-	status int
-	body   []byte
+	status      int
+	body        []byte
+	limit       int
+	overflow    bool
+	wroteHeader bool
+	surrogate   http.Header
+	// onHeaders is called with the status and headers of the response, and
+	// the surrogate headers taken from them, before they are written.
+	onHeaders func(h http.Header, status int, surrogate http.Header)
 }
 
 func (rw *responseWriter) Header() http.Header {
@@ -221,11 +1450,92 @@ func (rw *responseWriter) Header() http.Header {
 }
 
 func (rw *responseWriter) Write(p []byte) (int, error) {
-	rw.body = append(rw.body, p...)
+	switch {
+	case rw.overflow:
+	case rw.limit > 0 && len(rw.body)+len(p) > rw.limit:
+		rw.overflow = true
+		rw.body = nil
+	default:
+		rw.body = append(rw.body, p...)
+	}
+	rw.takeHeaders()
 	return rw.ResponseWriter.Write(p)
 }
 
+// WriteHeader sends the status of the response. Informational statuses go
+// through as they precede the final one, but the status is only recorded the
+// first time the headers are committed: later calls are superfluous, and
+// ignored by the client writer too, so the stored status matches the one
+// sent.
 func (rw *responseWriter) WriteHeader(s int) {
+	if s >= 100 && s < 200 && s != http.StatusSwitchingProtocols {
+		rw.ResponseWriter.WriteHeader(s)
+		return
+	}
+
+	if rw.wroteHeader {
+		return
+	}
+
 	rw.status = s
+	rw.takeHeaders()
 	rw.ResponseWriter.WriteHeader(s)
 }
+
+// Written reports whether the headers of the response were written.
+func (rw *responseWriter) Written() bool {
+	return rw.wroteHeader
+}
+
+// Flush sends the response written so far to the client. A flushed response
+// is streamed, such as server-sent events, so it is no longer buffered nor
+// stored, like one over the limit.
+func (rw *responseWriter) Flush() {
+	rw.takeHeaders()
+	rw.overflow = true
+	rw.body = nil
+
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands the connection over to the handler, for instance to upgrade it
+// to a WebSocket. The response is then never stored.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not implement http.Hijacker", rw.ResponseWriter)
+	}
+
+	rw.overflow = true
+	rw.body = nil
+
+	return h.Hijack()
+}
+
+// Push initiates an HTTP/2 server push, when the client connection supports
+// it.
+func (rw *responseWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := rw.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+
+	return p.Push(target, opts)
+}
+
+// takeHeaders keeps the surrogate headers from being sent, the first time the
+// headers are written.
+func (rw *responseWriter) takeHeaders() {
+	if rw.wroteHeader {
+		return
+	}
+
+	rw.wroteHeader = true
+	rw.surrogate = takeSurrogateHeaders(rw.Header())
+
+	if rw.onHeaders != nil {
+		rw.onHeaders(rw.Header(), rw.status, rw.surrogate)
+	}
+}
@@ -1,12 +1,21 @@
 package traefik_plugin_cache_by_route
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestNew(t *testing.T) {
@@ -17,22 +26,114 @@ func TestNew(t *testing.T) {
 	}{
 		{
 			name:    "should error if path is not valid",
-			cfg:     &Config{Path: "/foo/bar", MaxExpiry: 300, Cleanup: 600},
+			cfg:     &Config{Path: "/foo/bar", MaxExpiry: "300", Cleanup: "600"},
 			wantErr: true,
 		},
 		{
 			name:    "should error if maxExpiry <= 1",
-			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 1, Cleanup: 600},
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: "1", Cleanup: "600"},
 			wantErr: true,
 		},
 		{
 			name:    "should error if cleanup <= 1",
-			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 1},
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: "300", Cleanup: "1"},
 			wantErr: true,
 		},
+		{
+			name:    "should error if defaultTTL is negative",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: "300", Cleanup: "600", DefaultTTL: "-1"},
+			wantErr: true,
+		},
+		{
+			name:    "should error if defaultStaleWhileRevalidate is negative",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: "300", Cleanup: "600", DefaultStaleWhileRevalidate: "-1"},
+			wantErr: true,
+		},
+		{
+			name:    "should error if defaultStaleIfError is negative",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: "300", Cleanup: "600", DefaultStaleIfError: "-1"},
+			wantErr: true,
+		},
+		{
+			name: "should error on invalid pattern in strict mode",
+			cfg: &Config{
+				Path: os.TempDir(), MaxExpiry: "300", Cleanup: "600",
+				StrictPatternValidation: true, URIs: []Uri{{Pattern: "/api/(", TTL: "10"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "should skip invalid pattern in lenient mode",
+			cfg: &Config{
+				Path: os.TempDir(), MaxExpiry: "300", Cleanup: "600",
+				URIs: []Uri{{Pattern: "/api/(", TTL: "10"}},
+			},
+			wantErr: false,
+		},
+		{
+			name: "should error on invalid status in statusTTLs",
+			cfg: &Config{
+				Path: os.TempDir(), MaxExpiry: "300", Cleanup: "600",
+				StatusTTLs: []StatusTTL{{Status: 99, TTL: "10"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "should error on negative ttl in statusTTLs",
+			cfg: &Config{
+				Path: os.TempDir(), MaxExpiry: "300", Cleanup: "600",
+				StatusTTLs: []StatusTTL{{Status: http.StatusNotFound, TTL: "-1"}},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "should error if ttlJitter is not a fraction",
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: "300", Cleanup: "600", TTLJitter: 1},
+			wantErr: true,
+		},
+		{
+			name:    "should error if minCacheableBodyBytes exceeds maxCacheableBodyBytes",
+			cfg:     &Config{Backend: backendMemory, MaxExpiry: "300", Cleanup: "600", MinCacheableBodyBytes: 10, MaxCacheableBodyBytes: 5},
+			wantErr: true,
+		},
+		{
+			name:    "should error if cachePostBodies has no body limit",
+			cfg:     &Config{Backend: backendMemory, MaxExpiry: "300", Cleanup: "600", CachePostBodies: true},
+			wantErr: true,
+		},
+		{
+			name:    "should error if trusted proxies are invalid",
+			cfg:     &Config{Backend: backendMemory, MaxExpiry: "300", Cleanup: "600", TrustedProxies: []string{"proxy"}},
+			wantErr: true,
+		},
+		{
+			name:    "should error if maxBackgroundRefresh is negative",
+			cfg:     &Config{Backend: backendMemory, MaxExpiry: "300", Cleanup: "600", MaxBackgroundRefresh: -1},
+			wantErr: true,
+		},
+		{
+			name:    "should error if maxStoredHeaderBytes is negative",
+			cfg:     &Config{Backend: backendMemory, MaxExpiry: "300", Cleanup: "600", MaxStoredHeaderBytes: -1},
+			wantErr: true,
+		},
+		{
+			name:    "should error if backend is unknown",
+			cfg:     &Config{Backend: "foo", Path: os.TempDir(), MaxExpiry: "300", Cleanup: "600"},
+			wantErr: true,
+		},
+		{
+			name:    "should error if admin path is not restricted",
+			cfg:     &Config{Backend: backendMemory, MaxExpiry: "300", Cleanup: "600", AdminPath: "/_cache"},
+			wantErr: true,
+		},
+		{
+			name:    "should be valid with restricted admin path",
+			cfg:     &Config{Backend: backendMemory, MaxExpiry: "300", Cleanup: "600", AdminPath: "/_cache", PurgeAllowlist: []string{"10.0.0.0/8"}},
+			wantErr: false,
+		},
 		{
 			name:    "should be valid",
-			cfg:     &Config{Path: os.TempDir(), MaxExpiry: 300, Cleanup: 600},
+			cfg:     &Config{Path: os.TempDir(), MaxExpiry: "300", Cleanup: "600"},
 			wantErr: false,
 		},
 	}
@@ -44,10 +145,80 @@ func TestNew(t *testing.T) {
 			if test.wantErr && err == nil {
 				t.Fatal("expected error on bad regexp format")
 			}
+
+			if !test.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNeverCaches(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *Config
+		want bool
+	}{
+		{
+			name: "should cache according to headers",
+			cfg:  &Config{},
+			want: false,
+		},
+		{
+			name: "should never cache without any ttl",
+			cfg:  &Config{SkipCacheControlHeader: true, DefaultTTL: "0", URIs: []Uri{{Pattern: "/api/.*"}}},
+			want: true,
+		},
+		{
+			name: "should cache with default ttl",
+			cfg:  &Config{SkipCacheControlHeader: true, DefaultTTL: "60"},
+			want: false,
+		},
+		{
+			name: "should cache with uri ttl",
+			cfg:  &Config{SkipCacheControlHeader: true, URIs: []Uri{{Pattern: "/api/.*", TTL: "60"}}},
+			want: false,
+		},
+		{
+			name: "should cache with status ttl",
+			cfg:  &Config{SkipCacheControlHeader: true, StatusTTLs: []StatusTTL{{Status: http.StatusOK, TTL: "60"}}},
+			want: false,
+		},
+		{
+			name: "should cache with negative ttl",
+			cfg:  &Config{SkipCacheControlHeader: true, NegativeTTL: "60"},
+			want: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := neverCaches(test.cfg); got != test.want {
+				t.Errorf("unexpected result: want %t, got %t", test.want, got)
+			}
 		})
 	}
 }
 
+func TestNew_ClosesBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cfg := &Config{Path: createTempDir(t), MaxExpiry: "300", Cleanup: "600"}
+
+	c, err := New(ctx, nil, cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	select {
+	case <-c.(*cache).cache.(*fileCache).stop:
+	case <-time.After(time.Second):
+		t.Error("expected backend to be closed with the context")
+	}
+}
+
 func TestCache_ServeHTTP(t *testing.T) {
 	dir := createTempDir(t)
 
@@ -56,7 +227,7 @@ func TestCache_ServeHTTP(t *testing.T) {
 		rw.WriteHeader(http.StatusOK)
 	}
 
-	cfg := &Config{Path: dir, MaxExpiry: 10, Cleanup: 20, AddStatusHeader: true}
+	cfg := &Config{Enabled: true, Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
 
 	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
 	if err != nil {
@@ -76,24 +247,1836 @@ func TestCache_ServeHTTP(t *testing.T) {
 
 	c.ServeHTTP(rw, req)
 
+	if state := rw.Header().Values("Cache-Status"); len(state) != 1 || state[0] != "hit" {
+		t.Errorf("unexprect cache state: want [\"hit\"], got: %q", state)
+	}
+
+	data, err := c.(*cache).get(cacheKey(req, defaultCacheKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state, ok := data.Headers["Cache-Status"]; ok {
+		t.Errorf("unexpected stored cache state: %q", state)
+	}
+}
+
+func TestCache_ServeHTTPStatusHeaderName(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Cache-Status", "upstream; hit")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, StatusHeaderName: "x-cache"}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+	for _, want := range []string{cacheMissStatus, cacheHitStatus} {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Values("X-Cache"); len(state) != 1 || state[0] != want {
+			t.Errorf("unexpected cache state: want [%q], got: %q", want, state)
+		}
+
+		if state := rw.Header().Get("Cache-Status"); state != "upstream; hit" {
+			t.Errorf("unexpected Cache-Status: want %q, got: %q", "upstream; hit", state)
+		}
+	}
+
+	data, err := c.(*cache).get(cacheKey(req, defaultCacheKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state, ok := data.Headers["X-Cache"]; ok {
+		t.Errorf("unexpected stored cache state: %q", state)
+	}
+}
+
+func TestCache_ServeHTTPStreamsBody(t *testing.T) {
+	dir := createTempDir(t)
+
+	body := strings.Repeat("some large body ", 1024)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte(body))
+	}
+
+	cfg := &Config{Enabled: true, Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	b, err := c.(*cache).cache.Get(cacheKey(req, defaultCacheKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(b, []byte(body)) {
+		t.Error("expected body to be stored apart from metadata")
+	}
+
+	rw := httptest.NewRecorder()
+
+	c.ServeHTTP(rw, req)
+
 	if state := rw.Header().Get("Cache-Status"); state != "hit" {
-		t.Errorf("unexprect cache state: want \"hit\", got: %q", state)
+		t.Errorf("unexpected cache state: want \"hit\", got: %q", state)
+	}
+
+	if rw.Body.String() != body {
+		t.Errorf("unexpected body length: want %d, got %d", len(body), rw.Body.Len())
 	}
 }
 
-func createTempDir(tb testing.TB) string {
-	tb.Helper()
+func TestCache_ServeHTTPMaxCacheableBodyBytes(t *testing.T) {
+	dir := createTempDir(t)
 
-	dir, err := ioutil.TempDir("./", "example")
+	var calls int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("some body"))
+		_, _ = rw.Write([]byte(" over the limit"))
+	}
+
+	cfg := &Config{Enabled: true, Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, MaxCacheableBodyBytes: 10}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
 	if err != nil {
-		tb.Fatal(err)
+		t.Fatal(err)
 	}
 
-	tb.Cleanup(func() {
-		if err = os.RemoveAll(dir); err != nil {
-			tb.Fatal(err)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != "miss" {
+			t.Errorf("unexpected cache state: want \"miss\", got: %q", state)
 		}
-	})
 
-	return dir
+		if body := rw.Body.String(); body != "some body over the limit" {
+			t.Errorf("unexpected body: %q", body)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("unexpected origin calls: want 2, got %d", calls)
+	}
+}
+
+func TestCache_ServeHTTPCorruptEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, c *cache, dir, key string)
+	}{
+		{
+			name: "should evict truncated file",
+			corrupt: func(t *testing.T, c *cache, dir, key string) {
+				t.Helper()
+
+				if err := ioutil.WriteFile(keyPath(dir, key), []byte("garbage"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "should evict undecodable entry",
+			corrupt: func(t *testing.T, c *cache, dir, key string) {
+				t.Helper()
+
+				if err := c.cache.Set(key, []byte("{not json"), time.Minute); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := createTempDir(t)
+
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write([]byte("some body"))
+			}
+
+			cfg := &Config{Enabled: true, Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, LogLevel: "off"}
+
+			h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := h.(*cache)
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+			c.ServeHTTP(httptest.NewRecorder(), req)
+
+			key := cacheKey(req, defaultCacheKey)
+
+			test.corrupt(t, c, dir, key)
+
+			if _, err = c.get(key); err == nil {
+				t.Fatal("expected error reading corrupt entry")
+			}
+
+			if _, err = c.cache.Get(key); !errors.Is(err, ErrCacheMiss) {
+				t.Errorf("expected corrupt entry to be evicted, got %v", err)
+			}
+
+			for _, wantState := range []string{cacheMissStatus, cacheHitStatus} {
+				rw := httptest.NewRecorder()
+				c.ServeHTTP(rw, req)
+
+				if state := rw.Header().Get("Cache-Status"); state != wantState {
+					t.Errorf("unexpected cache state: want %q, got: %q", wantState, state)
+				}
+
+				if body := rw.Body.String(); body != "some body" {
+					t.Errorf("unexpected body: want %q, got: %q", "some body", body)
+				}
+			}
+
+			if calls != 2 {
+				t.Errorf("unexpected origin calls: want 2, got %d", calls)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPSuperfluousWriteHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		next func(rw http.ResponseWriter)
+	}{
+		{
+			name: "should keep status written before",
+			next: func(rw http.ResponseWriter) {
+				rw.WriteHeader(http.StatusOK)
+				rw.WriteHeader(http.StatusInternalServerError)
+				_, _ = rw.Write([]byte("some body"))
+			},
+		},
+		{
+			name: "should keep implicit status of body",
+			next: func(rw http.ResponseWriter) {
+				_, _ = rw.Write([]byte("some body"))
+				rw.WriteHeader(http.StatusInternalServerError)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				test.next(rw)
+			}
+
+			cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, wantState := range []string{cacheMissStatus, cacheHitStatus} {
+				rw := httptest.NewRecorder()
+				c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+				if state := rw.Header().Get("Cache-Status"); state != wantState {
+					t.Errorf("unexpected cache state: want %q, got: %q", wantState, state)
+				}
+
+				if rw.Code != http.StatusOK {
+					t.Errorf("unexpected status: want %d, got: %d", http.StatusOK, rw.Code)
+				}
+
+				if body := rw.Body.String(); body != "some body" {
+					t.Errorf("unexpected body: want %q, got: %q", "some body", body)
+				}
+			}
+		})
+	}
+}
+
+// writtenRecorder reports whether its headers were written, like the writers
+// of middleware libraries.
+type writtenRecorder struct {
+	*httptest.ResponseRecorder
+	written bool
+}
+
+func (r *writtenRecorder) WriteHeader(status int) {
+	r.written = true
+	r.ResponseRecorder.WriteHeader(status)
+}
+
+func (r *writtenRecorder) Written() bool {
+	return r.written
+}
+
+func TestCache_ServeHTTPHitCommittedHeaders(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	rw := &writtenRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rw.WriteHeader(http.StatusAccepted)
+
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	if rw.Code != http.StatusAccepted {
+		t.Errorf("unexpected status: want %d, got: %d", http.StatusAccepted, rw.Code)
+	}
+
+	if state := rw.Header().Get("Cache-Status"); state != "" {
+		t.Errorf("unexpected cache state after headers were written: %q", state)
+	}
+
+	if body := rw.Body.String(); body != "some body" {
+		t.Errorf("unexpected body: want %q, got: %q", "some body", body)
+	}
+}
+
+func TestCache_ServeHTTPFlush(t *testing.T) {
+	var calls int32
+
+	release := make(chan struct{})
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("data: first\n\n"))
+		rw.(http.Flusher).Flush()
+
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+		_, _ = rw.Write([]byte("data: second\n\n"))
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20"}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first event arrives while the origin is still streaming.
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error reading event: %v", err)
+	}
+
+	if line != "data: first\n" {
+		t.Errorf("unexpected event: want %q, got: %q", "data: first\n", line)
+	}
+
+	close(release)
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	resp, err = http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("unexpected origin calls for a streamed response: want 2, got %d", n)
+	}
+}
+
+func TestCache_ServeHTTPMinCacheableBodyBytes(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantState string
+	}{
+		{
+			name:      "should not store smaller body",
+			body:      "tiny",
+			wantState: cacheMissStatus,
+		},
+		{
+			name:      "should store body of minimum size",
+			body:      "some body",
+			wantState: cacheHitStatus,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write([]byte(test.body))
+			}
+
+			cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, MinCacheableBodyBytes: 9}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rw *httptest.ResponseRecorder
+			for i := 0; i < 2; i++ {
+				rw = httptest.NewRecorder()
+				c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+			}
+
+			if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+				t.Errorf("unexpected cache state: want %q, got: %q", test.wantState, state)
+			}
+
+			if body := rw.Body.String(); body != test.body {
+				t.Errorf("unexpected body: want %q, got: %q", test.body, body)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPMaxStoredHeaderBytes(t *testing.T) {
+	tests := []struct {
+		name      string
+		headers   int
+		wantState string
+	}{
+		{
+			name:      "should store small headers",
+			headers:   1,
+			wantState: cacheHitStatus,
+		},
+		{
+			name:      "should not store oversized headers",
+			headers:   100,
+			wantState: cacheMissStatus,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				for i := 0; i < test.headers; i++ {
+					rw.Header().Set(fmt.Sprintf("X-Header-%d", i), strings.Repeat("a", 16))
+				}
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write([]byte("body"))
+			}
+
+			cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, MaxStoredHeaderBytes: 1024}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rw *httptest.ResponseRecorder
+			for i := 0; i < 2; i++ {
+				rw = httptest.NewRecorder()
+				c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+			}
+
+			if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+				t.Errorf("unexpected cache state: want %q, got: %q", test.wantState, state)
+			}
+
+			if body := rw.Body.String(); body != "body" {
+				t.Errorf("unexpected body: want \"body\", got: %q", body)
+			}
+		})
+	}
+}
+
+func TestHeaderBytes(t *testing.T) {
+	h := http.Header{"Etag": {`"abc"`}, "Vary": {"Accept", "Origin"}}
+
+	// "Etag: \"abc\"\r\n", "Vary: Accept\r\n" and "Vary: Origin\r\n".
+	if got := headerBytes(h); got != 13+14+14 {
+		t.Errorf("unexpected header bytes: want %d, got %d", 13+14+14, got)
+	}
+}
+
+func TestCache_ServeHTTPOnlyIfCached(t *testing.T) {
+	tests := []struct {
+		name       string
+		warm       bool
+		wantCalls  int
+		wantStatus int
+		wantState  string
+	}{
+		{
+			name:       "should serve stored response",
+			warm:       true,
+			wantCalls:  1,
+			wantStatus: http.StatusOK,
+			wantState:  cacheHitStatus,
+		},
+		{
+			name:       "should respond gateway timeout without stored response",
+			wantCalls:  0,
+			wantStatus: http.StatusGatewayTimeout,
+			wantState:  cacheMissStatus,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.warm {
+				c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+			req.Header.Set("Cache-Control", "only-if-cached")
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, req)
+
+			if calls != test.wantCalls {
+				t.Errorf("unexpected origin calls: want %d, got %d", test.wantCalls, calls)
+			}
+
+			if rw.Code != test.wantStatus {
+				t.Errorf("unexpected status: want %d, got: %d", test.wantStatus, rw.Code)
+			}
+
+			if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+				t.Errorf("unexpected cache state: want %q, got: %q", test.wantState, state)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPRequestCacheControl(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		pragma       string
+		wantCalls    int
+		wantState    string
+		wantStored   bool
+	}{
+		{
+			name:         "should revalidate on no-cache",
+			cacheControl: "no-cache",
+			wantCalls:    2,
+			wantState:    "miss",
+			wantStored:   true,
+		},
+		{
+			name:         "should bypass the cache on no-store",
+			cacheControl: "no-store",
+			wantCalls:    2,
+			wantState:    "",
+			wantStored:   false,
+		},
+		{
+			name:       "should revalidate on pragma no-cache",
+			pragma:     "no-cache",
+			wantCalls:  2,
+			wantState:  "miss",
+			wantStored: true,
+		},
+		{
+			name:         "should ignore pragma with cache-control",
+			cacheControl: "max-age=60",
+			pragma:       "no-cache",
+			wantCalls:    1,
+			wantState:    "hit",
+			wantStored:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+			if test.cacheControl != "" {
+				req.Header.Set("Cache-Control", test.cacheControl)
+			}
+			if test.pragma != "" {
+				req.Header.Set("Pragma", test.pragma)
+			}
+
+			var rw *httptest.ResponseRecorder
+
+			for i := 0; i < 2; i++ {
+				rw = httptest.NewRecorder()
+
+				c.ServeHTTP(rw, req)
+			}
+
+			if calls != test.wantCalls {
+				t.Errorf("unexpected origin calls: want %d, got %d", test.wantCalls, calls)
+			}
+
+			if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+				t.Errorf("unexpected cache state: want %q, got: %q", test.wantState, state)
+			}
+
+			_, err = c.(*cache).get(cacheKey(req, defaultCacheKey))
+			if stored := err == nil; stored != test.wantStored {
+				t.Errorf("unexpected stored entry: want %t, got %t", test.wantStored, stored)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPAge(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Age", "5")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "60", Cleanup: "20", AddStatusHeader: true}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	key := cacheKey(req, defaultCacheKey)
+
+	data, err := c.get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data.StoredAt = time.Now().Add(-30 * time.Second)
+	c.set(key, data, time.Minute)
+
+	rw := httptest.NewRecorder()
+
+	c.ServeHTTP(rw, req)
+
+	if age := rw.Header().Values("Age"); len(age) != 1 || age[0] != "30" {
+		t.Errorf("unexpected age: want [\"30\"], got %q", age)
+	}
+}
+
+func TestCache_ServeHTTPDate(t *testing.T) {
+	generated := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Date", generated)
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "60", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get(cacheHeader); state != cacheHitStatus {
+		t.Fatalf("unexpected cache state: want %q, got: %q", cacheHitStatus, state)
+	}
+
+	dates := rw.Header().Values("Date")
+	if len(dates) != 1 {
+		t.Fatalf("unexpected dates: want 1, got %q", dates)
+	}
+
+	date, err := http.ParseTime(dates[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(date) > 5*time.Second {
+		t.Errorf("unexpected date: want recent, got: %q", dates[0])
+	}
+}
+
+func TestCache_ServeHTTPSetCookie(t *testing.T) {
+	tests := []struct {
+		name           string
+		cacheSetCookie bool
+		wantCalls      int
+	}{
+		{
+			name:      "should not store responses setting cookies",
+			wantCalls: 2,
+		},
+		{
+			name:           "should store responses setting cookies when allowed",
+			cacheSetCookie: true,
+			wantCalls:      1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.Header().Set("Set-Cookie", "session=abc")
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", CacheSetCookie: test.cacheSetCookie}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				rw := httptest.NewRecorder()
+
+				c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+				if cookie := rw.Header().Get("Set-Cookie"); cookie != "session=abc" {
+					t.Errorf("unexpected cookie: %q", cookie)
+				}
+			}
+
+			if calls != test.wantCalls {
+				t.Errorf("unexpected origin calls: want %d, got %d", test.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPNoCacheFields(t *testing.T) {
+	var calls int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", `max-age=20, no-cache="Set-Cookie, X-Session"`)
+		rw.Header().Set("Set-Cookie", "session=abc")
+		rw.Header().Set("X-Session", "abc")
+		rw.Header().Set("X-Other", "kept")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("body"))
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if cookie := rw.Header().Get("Set-Cookie"); cookie != "session=abc" {
+		t.Errorf("unexpected cookie on miss: want %q, got: %q", "session=abc", cookie)
+	}
+
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get(cacheHeader); state != cacheHitStatus {
+		t.Errorf("unexpected cache state: want %q, got: %q", cacheHitStatus, state)
+	}
+
+	for _, name := range []string{"Set-Cookie", "X-Session"} {
+		if v := rw.Header().Get(name); v != "" {
+			t.Errorf("unexpected %s on hit: %q", name, v)
+		}
+	}
+
+	if other := rw.Header().Get("X-Other"); other != "kept" {
+		t.Errorf("unexpected X-Other on hit: want \"kept\", got: %q", other)
+	}
+
+	if body := rw.Body.String(); body != "body" {
+		t.Errorf("unexpected body: want \"body\", got: %q", body)
+	}
+
+	if calls != 1 {
+		t.Errorf("unexpected origin calls: want 1, got %d", calls)
+	}
+}
+
+func TestCache_ServeHTTPImplicitStatus(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		_, _ = rw.Write([]byte("body"))
+	}
+
+	cfg := &Config{Enabled: true, Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, wantState := range []string{"miss", "hit"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != wantState {
+			t.Errorf("unexpected cache state: want %q, got: %q", wantState, state)
+		}
+
+		if rw.Code != http.StatusOK {
+			t.Errorf("unexpected status: want %d, got %d", http.StatusOK, rw.Code)
+		}
+
+		if body := rw.Body.String(); body != "body" {
+			t.Errorf("unexpected body: want \"body\", got: %q", body)
+		}
+	}
+}
+
+func TestCache_ServeHTTPAllowedMethods(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		wantCalls int
+		wantState string
+	}{
+		{
+			name:      "should pass POST through uncached",
+			method:    http.MethodPost,
+			wantCalls: 2,
+			wantState: "",
+		},
+		{
+			name:      "should cache GET",
+			method:    http.MethodGet,
+			wantCalls: 1,
+			wantState: "hit",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := createTempDir(t)
+
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{
+				Enabled:            true,
+				Path:               dir,
+				MaxExpiry:          "10",
+				Cleanup:            "20",
+				AddStatusHeader:    true,
+				AllowedHTTPMethods: []string{http.MethodGet},
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rw *httptest.ResponseRecorder
+
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest(test.method, "http://localhost/some/path", nil)
+				rw = httptest.NewRecorder()
+
+				c.ServeHTTP(rw, req)
+			}
+
+			if calls != test.wantCalls {
+				t.Errorf("unexpected origin calls: want %d, got %d", test.wantCalls, calls)
+			}
+
+			if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+				t.Errorf("unexpected cache state: want %q, got: %q", test.wantState, state)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPVary(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Vary", "Accept-Language")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte(req.Header.Get("Accept-Language")))
+	}
+
+	cfg := &Config{Enabled: true, Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		lang      string
+		wantState string
+	}{
+		{lang: "en", wantState: "miss"},
+		{lang: "fr", wantState: "miss"},
+		{lang: "en", wantState: "hit"},
+		{lang: "fr", wantState: "hit"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		req.Header.Set("Accept-Language", test.lang)
+
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+			t.Errorf("unexpected cache state for %q: want %q, got: %q", test.lang, test.wantState, state)
+		}
+
+		if body := rw.Body.String(); body != test.lang {
+			t.Errorf("unexpected body: want %q, got: %q", test.lang, body)
+		}
+	}
+}
+
+func TestCache_ServeHTTPVaryWildcard(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Vary", "*")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != "miss" {
+			t.Errorf("unexpected cache state: want \"miss\", got: %q", state)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("unexpected origin calls: want 2, got %d", calls)
+	}
+}
+
+func TestCache_CacheableVaryWildcard(t *testing.T) {
+	tests := []struct {
+		name string
+		vary string
+		skip bool
+	}{
+		{name: "should not cache wildcard", vary: "*"},
+		{name: "should not cache wildcard among headers", vary: "Accept, *"},
+		{name: "should not cache wildcard when ignoring directives", vary: "*", skip: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{
+				Enabled:                    true,
+				Backend:                    backendMemory,
+				MaxExpiry:                  "3600",
+				Cleanup:                    "20",
+				SkipCacheControlHeader:     test.skip,
+				ForceCacheIgnoreDirectives: test.skip,
+				DefaultTTL:                 "60",
+			}
+
+			c, err := New(context.Background(), nil, cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := http.Header{"Cache-Control": {"max-age=60"}, "Vary": {test.vary}}
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+			if _, ok := c.(*cache).cacheable(req, h, http.StatusOK, nil); ok {
+				t.Error("unexpected cacheable response")
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPVaryCookie(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Vary", "Cookie")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, VaryCookieAllowlist: []string{"theme"}}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		cookie    string
+		wantState string
+	}{
+		{cookie: "theme=dark; session=a", wantState: "miss"},
+		{cookie: "theme=dark; session=b", wantState: "hit"},
+		{cookie: "session=c; theme=dark", wantState: "hit"},
+		{cookie: "theme=light; session=a", wantState: "miss"},
+		{cookie: "session=a", wantState: "miss"},
+		{cookie: "", wantState: "hit"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		if test.cookie != "" {
+			req.Header.Set("Cookie", test.cookie)
+		}
+
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+			t.Errorf("unexpected cache state for %q: want %q, got: %q", test.cookie, test.wantState, state)
+		}
+	}
+}
+
+func TestCache_ServeHTTPRouteMethods(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		url       string
+		wantCalls int
+	}{
+		{
+			name:      "should cache GET on route",
+			method:    http.MethodGet,
+			url:       "http://localhost/api/items",
+			wantCalls: 1,
+		},
+		{
+			name:      "should not cache HEAD on GET only route",
+			method:    http.MethodHead,
+			url:       "http://localhost/api/items",
+			wantCalls: 2,
+		},
+		{
+			name:      "should cache HEAD outside of route",
+			method:    http.MethodHead,
+			url:       "http://localhost/static/app.js",
+			wantCalls: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{
+				Enabled:                true,
+				Backend:                backendMemory,
+				MaxExpiry:              "10",
+				Cleanup:                "20",
+				AllowedHTTPMethods:     []string{http.MethodGet, http.MethodHead},
+				SkipCacheControlHeader: true,
+				DefaultTTL:             "10",
+				URIs:                   []Uri{{Pattern: "/api/.*", TTL: "10", Methods: []string{http.MethodGet}}},
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(test.method, test.url, nil))
+			}
+
+			if calls != test.wantCalls {
+				t.Errorf("unexpected origin calls: want %d, got %d", test.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestCache_RouteOrder(t *testing.T) {
+	cfg := &Config{
+		Backend:   backendMemory,
+		MaxExpiry: "300",
+		Cleanup:   "600",
+		URIs: []Uri{
+			{Pattern: "/api/v1/.*", TTL: "300"},
+			{Pattern: "/api/.*", TTL: "60"},
+		},
+	}
+
+	h, err := New(context.Background(), nil, cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url     string
+		wantTTL time.Duration
+	}{
+		{url: "http://localhost/api/v1/items", wantTTL: 300 * time.Second},
+		{url: "http://localhost/api/v2/items", wantTTL: 60 * time.Second},
+	}
+
+	for _, test := range tests {
+		rt := h.(*cache).route(httptest.NewRequest(http.MethodGet, test.url, nil))
+		if rt == nil {
+			t.Fatalf("expected route for %s", test.url)
+		}
+
+		if rt.ttl != test.wantTTL {
+			t.Errorf("unexpected ttl for %s: want %v, got %v", test.url, test.wantTTL, rt.ttl)
+		}
+	}
+}
+
+func TestCache_CacheableSkipCacheControlHeaderDirectives(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		force        bool
+		wantOK       bool
+	}{
+		{name: "should cache without directives", wantOK: true},
+		{name: "should ignore max-age", cacheControl: "max-age=0", wantOK: true},
+		{name: "should not cache private", cacheControl: "private, max-age=60"},
+		{name: "should not cache no-store", cacheControl: "no-store"},
+		{name: "should cache private when forced", cacheControl: "private", force: true, wantOK: true},
+		{name: "should cache no-store when forced", cacheControl: "no-store", force: true, wantOK: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{
+				Enabled:                    true,
+				Backend:                    backendMemory,
+				MaxExpiry:                  "3600",
+				Cleanup:                    "20",
+				SkipCacheControlHeader:     true,
+				DefaultTTL:                 "60",
+				ForceCacheIgnoreDirectives: test.force,
+			}
+
+			c, err := New(context.Background(), nil, cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := http.Header{}
+			if test.cacheControl != "" {
+				h.Set("Cache-Control", test.cacheControl)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+			if _, ok := c.(*cache).cacheable(req, h, http.StatusOK, nil); ok != test.wantOK {
+				t.Errorf("unexpected cacheable: want %t, got %t", test.wantOK, ok)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPSkipCacheControlHeaderNoStore(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		wantCalls    int
+	}{
+		{name: "should cache by uri ttl", cacheControl: "max-age=0", wantCalls: 1},
+		{name: "should not cache no-store over uri ttl", cacheControl: "no-store", wantCalls: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+
+				rw.Header().Set("Cache-Control", test.cacheControl)
+				_, _ = rw.Write([]byte("body"))
+			}
+
+			cfg := &Config{
+				Enabled:                true,
+				Backend:                backendMemory,
+				MaxExpiry:              "10",
+				Cleanup:                "20",
+				SkipCacheControlHeader: true,
+				URIs:                   []Uri{{Pattern: "/some/.*", TTL: "5"}},
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+			}
+
+			if calls != test.wantCalls {
+				t.Errorf("unexpected origin calls: want %d, got %d", test.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestCache_CacheableOverlappingRoutes(t *testing.T) {
+	cfg := &Config{
+		Enabled:                true,
+		Backend:                backendMemory,
+		MaxExpiry:              "3600",
+		Cleanup:                "20",
+		SkipCacheControlHeader: true,
+		URIs: []Uri{
+			{Pattern: "/api/v1/.*", TTL: "300"},
+			{Pattern: "/api/.*", TTL: "60"},
+			{Pattern: ".*", TTL: "10"},
+		},
+	}
+
+	c, err := New(context.Background(), nil, cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Matching used to depend on the iteration order of a map, so check that
+	// the first declared route wins every time.
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/api/v1/items", nil)
+
+		expiry, ok := c.(*cache).cacheable(req, http.Header{}, http.StatusOK, nil)
+		if !ok || expiry != 300*time.Second {
+			t.Fatalf("unexpected expiry: want %v (true), got: %v (%t)", 300*time.Second, expiry, ok)
+		}
+	}
+}
+
+func TestCache_ServeHTTPRouteVary(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte(req.Header.Get("Accept")))
+	}
+
+	cfg := &Config{
+		Enabled:         true,
+		Backend:         backendMemory,
+		MaxExpiry:       "10",
+		Cleanup:         "20",
+		AddStatusHeader: true,
+		URIs:            []Uri{{Pattern: "/api/.*", VaryHeaders: []string{"accept"}}},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url       string
+		accept    string
+		wantState string
+		wantBody  string
+	}{
+		{url: "http://localhost/api/items", accept: "application/json", wantState: "miss", wantBody: "application/json"},
+		{url: "http://localhost/api/items", accept: "text/html", wantState: "miss", wantBody: "text/html"},
+		{url: "http://localhost/api/items", accept: "application/json", wantState: "hit", wantBody: "application/json"},
+		{url: "http://localhost/other", accept: "application/json", wantState: "miss", wantBody: "application/json"},
+		{url: "http://localhost/other", accept: "text/html", wantState: "hit", wantBody: "application/json"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.url, nil)
+		req.Header.Set("Accept", test.accept)
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+			t.Errorf("unexpected cache state for %s %q: want %q, got: %q", test.url, test.accept, test.wantState, state)
+		}
+
+		if body := rw.Body.String(); body != test.wantBody {
+			t.Errorf("unexpected body for %s %q: want %q, got: %q", test.url, test.accept, test.wantBody, body)
+		}
+	}
+}
+
+func TestCache_CacheableStatusTTLs(t *testing.T) {
+	tests := []struct {
+		name       string
+		url        string
+		status     int
+		wantExpiry time.Duration
+		wantOK     bool
+	}{
+		{
+			name:       "should use status ttl over route ttl",
+			url:        "http://localhost/api/items",
+			status:     http.StatusNotFound,
+			wantExpiry: 30 * time.Second,
+			wantOK:     true,
+		},
+		{
+			name:       "should clamp status ttl to maxExpiry",
+			url:        "http://localhost/api/items",
+			status:     http.StatusMovedPermanently,
+			wantExpiry: time.Hour,
+			wantOK:     true,
+		},
+		{
+			name:   "should not cache status with zero ttl",
+			url:    "http://localhost/api/items",
+			status: http.StatusInternalServerError,
+			wantOK: false,
+		},
+		{
+			name:       "should fall back to route ttl",
+			url:        "http://localhost/api/items",
+			status:     http.StatusOK,
+			wantExpiry: 10 * time.Minute,
+			wantOK:     true,
+		},
+		{
+			name:       "should fall back to default ttl",
+			url:        "http://localhost/static/app.js",
+			status:     http.StatusOK,
+			wantExpiry: time.Minute,
+			wantOK:     true,
+		},
+	}
+
+	cfg := &Config{
+		Enabled:                true,
+		Backend:                backendMemory,
+		MaxExpiry:              "3600",
+		Cleanup:                "20",
+		SkipCacheControlHeader: true,
+		DefaultTTL:             "60",
+		StatusTTLs: []StatusTTL{
+			{Status: http.StatusMovedPermanently, TTL: "86400"},
+			{Status: http.StatusNotFound, TTL: "30"},
+			{Status: http.StatusInternalServerError, TTL: "0"},
+		},
+		URIs: []Uri{{Pattern: "/api/.*", TTL: "600"}},
+	}
+
+	c, err := New(context.Background(), nil, cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+
+			expiry, ok := c.(*cache).cacheable(req, http.Header{}, test.status, nil)
+			if ok != test.wantOK || expiry != test.wantExpiry {
+				t.Errorf("unexpected expiry: want %v (%t), got: %v (%t)", test.wantExpiry, test.wantOK, expiry, ok)
+			}
+		})
+	}
+}
+
+func TestCache_CacheableCacheControl(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantExpiry time.Duration
+		wantOK     bool
+	}{
+		{
+			name:       "should prefer s-maxage over max-age",
+			header:     http.Header{"Cache-Control": {"max-age=10, s-maxage=60"}},
+			wantExpiry: time.Minute,
+			wantOK:     true,
+		},
+		{
+			name:       "should prefer s-maxage over a longer max-age",
+			header:     http.Header{"Cache-Control": {"s-maxage=60, max-age=600"}},
+			wantExpiry: time.Minute,
+			wantOK:     true,
+		},
+		{
+			name:       "should prefer max-age over expires",
+			header:     http.Header{"Cache-Control": {"max-age=10"}, "Expires": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}},
+			wantExpiry: 10 * time.Second,
+			wantOK:     true,
+		},
+		{
+			name:       "should fall back to expires",
+			header:     http.Header{"Expires": {time.Now().Add(2 * time.Minute).UTC().Format(http.TimeFormat)}},
+			wantExpiry: 2 * time.Minute,
+			wantOK:     true,
+		},
+		{
+			name: "should derive expires ttl from date",
+			header: http.Header{
+				"Date":    {time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)},
+				"Expires": {time.Now().Add(-time.Hour + 5*time.Minute).UTC().Format(http.TimeFormat)},
+			},
+			wantExpiry: 5 * time.Minute,
+			wantOK:     true,
+		},
+		{
+			name:       "should clamp expires to max expiry",
+			header:     http.Header{"Expires": {time.Now().Add(2 * time.Hour).UTC().Format(http.TimeFormat)}},
+			wantExpiry: time.Hour,
+			wantOK:     true,
+		},
+		{
+			name:   "should not cache past expires",
+			header: http.Header{"Expires": {time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)}},
+			wantOK: false,
+		},
+		{
+			name:   "should not cache invalid expires",
+			header: http.Header{"Expires": {"0"}},
+			wantOK: false,
+		},
+		{
+			name:   "should not cache invalid expires with last-modified",
+			header: http.Header{"Expires": {"-1"}, "Last-Modified": {time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}},
+			wantOK: false,
+		},
+		{
+			name:       "should fall back to default ttl",
+			header:     http.Header{},
+			wantExpiry: 30 * time.Second,
+			wantOK:     true,
+		},
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "3600", Cleanup: "20", DefaultTTL: "30"}
+
+	c, err := New(context.Background(), nil, cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+			expiry, ok := c.(*cache).cacheable(req, test.header, http.StatusOK, nil)
+			if ok != test.wantOK || expiry > test.wantExpiry || expiry < test.wantExpiry-2*time.Second {
+				t.Errorf("unexpected expiry: want %v (%t), got: %v (%t)", test.wantExpiry, test.wantOK, expiry, ok)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPIncomplete(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   func(rw http.ResponseWriter, req *http.Request, cancel context.CancelFunc)
+		wantCalls int
+	}{
+		{
+			name: "should not store response of cancelled request",
+			handler: func(rw http.ResponseWriter, req *http.Request, cancel context.CancelFunc) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write([]byte("part"))
+
+				// Only the first request is cancelled, the second one must
+				// not wait for its context.
+				cancel()
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "should not store body shorter than content length",
+			handler: func(rw http.ResponseWriter, req *http.Request, _ context.CancelFunc) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.Header().Set("Content-Length", "100")
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write([]byte("part"))
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "should store body matching content length",
+			handler: func(rw http.ResponseWriter, req *http.Request, _ context.CancelFunc) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.Header().Set("Content-Length", "4")
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write([]byte("full"))
+			},
+			wantCalls: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			cancel := func() {}
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+				test.handler(rw, req, cancel)
+			}
+
+			cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20"}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancelRequest := context.WithCancel(context.Background())
+			defer cancelRequest()
+
+			cancel = cancelRequest
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil).WithContext(ctx)
+			c.ServeHTTP(httptest.NewRecorder(), req)
+
+			cancel = func() {}
+
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+			if calls != test.wantCalls {
+				t.Errorf("unexpected origin calls: want %d, got %d", test.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPHeadFromGet(t *testing.T) {
+	var calls int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodHead, "http://localhost/some/path", nil))
+
+	if state := rw.Header().Get("Cache-Status"); state != cacheHitStatus {
+		t.Errorf("unexpected cache state: want %q, got: %q", cacheHitStatus, state)
+	}
+
+	if length := rw.Header().Get("Content-Length"); length != "9" {
+		t.Errorf("unexpected content length: want \"9\", got: %q", length)
+	}
+
+	if rw.Body.Len() != 0 {
+		t.Errorf("unexpected body: %q", rw.Body.String())
+	}
+
+	if calls != 1 {
+		t.Errorf("unexpected origin calls: want 1, got %d", calls)
+	}
+}
+
+func TestCache_ServeHTTPStoredTTL(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "3600", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	data, err := c.(*cache).get(cacheKey(req, defaultCacheKey))
+	if err != nil {
+		t.Fatalf("unexpected cache get error: %v", err)
+	}
+
+	if ttl := time.Until(data.ExpiresAt); ttl > time.Minute || ttl < 58*time.Second {
+		t.Errorf("unexpected stored ttl: want 60s, got %v", ttl)
+	}
+
+	if _, ok := data.Headers[cacheHeader]; ok {
+		t.Errorf("unexpected plugin header stored: %v", data.Headers)
+	}
+}
+
+func TestStoredHeaders(t *testing.T) {
+	h := http.Header{
+		"Cache-Status":      {"miss"},
+		"Connection":        {"keep-alive, X-Hop"},
+		"Content-Type":      {"text/plain"},
+		"Keep-Alive":        {"timeout=5"},
+		"Transfer-Encoding": {"chunked"},
+		"Upgrade":           {"h2c"},
+		"X-Hop":             {"1"},
+	}
+
+	tests := []struct {
+		name         string
+		statusHeader string
+		want         http.Header
+	}{
+		{
+			name:         "should remove status header",
+			statusHeader: cacheHeader,
+			want:         http.Header{"Content-Type": {"text/plain"}},
+		},
+		{
+			name:         "should keep upstream Cache-Status with custom status header",
+			statusHeader: "X-Cache",
+			want:         http.Header{"Cache-Status": {"miss"}, "Content-Type": {"text/plain"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &cache{statusHeader: test.statusHeader}
+
+			if got := m.storedHeaders(h); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("unexpected stored headers: want %v, got: %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHopByHopHeaders(t *testing.T) {
+	m := &cache{cfg: &Config{}, log: &stdLogger{level: levelOff}, metrics: newMetrics()}
+
+	data := &cacheData{
+		Status:  http.StatusOK,
+		Headers: map[string][]string{"Content-Length": {"4"}, "Transfer-Encoding": {"chunked"}},
+		Body:    []byte("body"),
+	}
+
+	rw := httptest.NewRecorder()
+	m.serve(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil), data, cacheHitStatus)
+
+	if te := rw.Header().Get("Transfer-Encoding"); te != "" {
+		t.Errorf("unexpected Transfer-Encoding header: %q", te)
+	}
+
+	if cl := rw.Header().Get("Content-Length"); cl != "4" {
+		t.Errorf("unexpected Content-Length header: want \"4\", got: %q", cl)
+	}
+}
+
+func createTempDir(tb testing.TB) string {
+	tb.Helper()
+
+	dir, err := ioutil.TempDir("./", "example")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() {
+		if err = os.RemoveAll(dir); err != nil {
+			tb.Fatal(err)
+		}
+	})
+
+	return dir
+}
+
+func TestCache_ServeHTTPContentLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		method  string
+	}{
+		{
+			name:    "should correct content length of inline body",
+			backend: backendMemory,
+			method:  http.MethodGet,
+		},
+		{
+			name:    "should correct content length of streamed body",
+			backend: backendFile,
+			method:  http.MethodGet,
+		},
+		{
+			name:    "should correct content length of head response",
+			backend: backendMemory,
+			method:  http.MethodHead,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{Enabled: true, Backend: test.backend, Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20"}
+
+			c, err := New(context.Background(), nil, cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := c.(*cache)
+
+			req := httptest.NewRequest(test.method, "http://localhost/some/path", nil)
+			get := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+
+			m.set(m.requestKey(get), &cacheData{
+				StoredAt:  time.Now(),
+				ExpiresAt: time.Now().Add(time.Minute),
+				Status:    http.StatusOK,
+				Headers:   map[string][]string{"Content-Length": {"100"}},
+				Body:      []byte("some body"),
+				Size:      9,
+			}, time.Minute)
+
+			rw := httptest.NewRecorder()
+			m.ServeHTTP(rw, req)
+
+			if length := rw.Header().Get("Content-Length"); length != "9" {
+				t.Errorf("unexpected content length: want \"9\", got: %q", length)
+			}
+
+			if test.method == http.MethodGet && rw.Body.String() != "some body" {
+				t.Errorf("unexpected body: want \"some body\", got: %q", rw.Body.String())
+			}
+		})
+	}
 }
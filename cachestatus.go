@@ -0,0 +1,93 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheStatus describes how the cache handled a request forwarded to the
+// origin.
+type CacheStatus struct {
+	// Status is the cache state of the request, such as "miss" or "error".
+	Status string
+	// Key is the cache key of the request.
+	Key string
+}
+
+type cacheStatusContextKey struct{}
+
+// CacheStatusFromContext returns the cache status of the request whose
+// context is given, as seen by handlers behind the cache. It reports false
+// for requests the cache did not handle, such as bypassed ones.
+func CacheStatusFromContext(ctx context.Context) (CacheStatus, bool) {
+	cs, ok := ctx.Value(cacheStatusContextKey{}).(CacheStatus)
+
+	return cs, ok
+}
+
+// withCacheStatus returns the request with the cache status in its context.
+func withCacheStatus(r *http.Request, status, key string) *http.Request {
+	ctx := context.WithValue(r.Context(), cacheStatusContextKey{}, CacheStatus{Status: status, Key: key})
+
+	return r.WithContext(ctx)
+}
+
+// cacheStatus returns the value of the Cache-Status header for the cache state
+// and the entry served, if any. Unless the standard form is configured, this
+// is the bare state.
+func (m *cache) cacheStatus(cs string, data *cacheData, key string) string {
+	if !m.cfg.StandardCacheStatus {
+		return cs
+	}
+
+	params := []string{sfToken(m.name)}
+
+	switch cs {
+	case cacheHitStatus:
+		params = append(params, "hit")
+	case cacheStaleStatus:
+		params = append(params, "hit", "fwd=stale")
+	case cacheStaleErrorStatus:
+		params = append(params, "hit", `detail="stale-if-error"`)
+	case cacheErrorStatus:
+		params = append(params, "fwd=miss", `detail="cache-error"`)
+	default:
+		params = append(params, "fwd=uri-miss")
+	}
+
+	if data != nil {
+		params = append(params, "ttl="+strconv.Itoa(int(time.Until(data.ExpiresAt).Seconds())))
+	}
+
+	if strings.EqualFold(m.cfg.LogLevel, "debug") && key != "" {
+		params = append(params, "key="+sfString(key))
+	}
+
+	return strings.Join(params, "; ")
+}
+
+// sfToken returns the name as a structured field token, replacing the
+// characters tokens cannot hold.
+func sfToken(name string) string {
+	var b strings.Builder
+
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '*':
+		case i > 0 && (c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'+-.^_`|~:/", c)):
+		default:
+			c = '_'
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// sfString returns s as a structured field string.
+func sfString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
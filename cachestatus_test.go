@@ -0,0 +1,133 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCache_CacheStatus(t *testing.T) {
+	data := &cacheData{ExpiresAt: time.Now().Add(42500 * time.Millisecond)}
+
+	tests := []struct {
+		name     string
+		cfg      *Config
+		cs       string
+		data     *cacheData
+		cacheKey string
+		want     string
+	}{
+		{
+			name: "should keep legacy form",
+			cfg:  &Config{},
+			cs:   cacheHitStatus,
+			data: data,
+			want: "hit",
+		},
+		{
+			name: "should describe hit",
+			cfg:  &Config{StandardCacheStatus: true},
+			cs:   cacheHitStatus,
+			data: data,
+			want: "my-cache; hit; ttl=42",
+		},
+		{
+			name: "should describe miss",
+			cfg:  &Config{StandardCacheStatus: true},
+			cs:   cacheMissStatus,
+			want: "my-cache; fwd=uri-miss",
+		},
+		{
+			name: "should describe stale",
+			cfg:  &Config{StandardCacheStatus: true},
+			cs:   cacheStaleStatus,
+			data: &cacheData{ExpiresAt: time.Now().Add(-10500 * time.Millisecond)},
+			want: "my-cache; hit; fwd=stale; ttl=-10",
+		},
+		{
+			name:     "should include key when debugging",
+			cfg:      &Config{StandardCacheStatus: true, LogLevel: "debug"},
+			cs:       cacheMissStatus,
+			cacheKey: `GETlocalhost/"quoted"`,
+			want:     `my-cache; fwd=uri-miss; key="GETlocalhost/\"quoted\""`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &cache{name: "my-cache", cfg: test.cfg}
+
+			if got := m.cacheStatus(test.cs, test.data, test.cacheKey); got != test.want {
+				t.Errorf("unexpected cache status: want %q, got: %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestSfToken(t *testing.T) {
+	if got := sfToken("1st cache@file"); got != "_st_cache_file" {
+		t.Errorf("unexpected token: want %q, got: %q", "_st_cache_file", got)
+	}
+}
+
+func TestCache_ServeHTTPStandardCacheStatus(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true, StandardCacheStatus: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"cache; fwd=uri-miss", "cache; hit; ttl=9"} {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+		if got := rw.Header().Get("Cache-Status"); got != want {
+			t.Errorf("unexpected cache status: want %q, got: %q", want, got)
+		}
+	}
+}
+
+func TestCache_ServeHTTPCacheStatusFromContext(t *testing.T) {
+	var (
+		got CacheStatus
+		ok  bool
+	)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		got, ok = CacheStatusFromContext(req.Context())
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", BypassHeaders: []string{"X-Preview"}}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	want := CacheStatus{Status: cacheMissStatus, Key: "GETlocalhost/some/path"}
+	if !ok || got != want {
+		t.Errorf("unexpected cache status: want %+v, got: %+v (%t)", want, got, ok)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/other/path", nil)
+	req.Header.Set("X-Preview", "1")
+
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	if ok {
+		t.Errorf("unexpected cache status for bypassed request: %+v", got)
+	}
+}
@@ -0,0 +1,61 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// cacheDataVersion is the first byte of encoded entries. Entries written
+// before the binary format was introduced are plain JSON objects, whose first
+// byte is always '{'.
+const cacheDataVersion byte = 1
+
+// marshalCacheData encodes the entry as a version byte, the length of the
+// JSON metadata, the metadata itself and finally the raw body, which avoids
+// base64 encoding the body.
+func marshalCacheData(data *cacheData) ([]byte, error) {
+	meta := *data
+	meta.Body = nil
+
+	mb, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 5, 5+len(mb)+len(data.Body))
+	b[0] = cacheDataVersion
+	binary.LittleEndian.PutUint32(b[1:5], uint32(len(mb)))
+	b = append(b, mb...)
+	b = append(b, data.Body...)
+
+	return b, nil
+}
+
+func unmarshalCacheData(b []byte) (*cacheData, error) {
+	var data cacheData
+
+	if len(b) > 0 && b[0] == '{' {
+		if err := json.Unmarshal(b, &data); err != nil {
+			return nil, err
+		}
+		return &data, nil
+	}
+
+	if len(b) < 5 || b[0] != cacheDataVersion {
+		return nil, errors.New("unknown cache item format")
+	}
+
+	n := int(binary.LittleEndian.Uint32(b[1:5]))
+	if len(b) < 5+n {
+		return nil, fmt.Errorf("truncated cache item: want %d metadata bytes, got %d", n, len(b)-5)
+	}
+
+	if err := json.Unmarshal(b[5:5+n], &data); err != nil {
+		return nil, err
+	}
+	data.Body = b[5+n:]
+
+	return &data, nil
+}
@@ -0,0 +1,65 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCacheDataCodec(t *testing.T) {
+	data := &cacheData{
+		ExpiresAt: time.Now().Add(time.Minute).Round(0),
+		Status:    200,
+		Headers:   map[string][]string{"Content-Type": {"application/json"}},
+		Body:      []byte(`{"some":"json body"}`),
+	}
+
+	b, err := marshalCacheData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasSuffix(b, data.Body) {
+		t.Error("expected body to be stored raw")
+	}
+
+	got, err := unmarshalCacheData(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !got.ExpiresAt.Equal(data.ExpiresAt) || got.Status != data.Status || !bytes.Equal(got.Body, data.Body) {
+		t.Errorf("unexpected cache data: want %+v, got %+v", data, got)
+	}
+
+	if ct := got.Headers["Content-Type"]; len(ct) != 1 || ct[0] != "application/json" {
+		t.Errorf("unexpected headers: %v", got.Headers)
+	}
+}
+
+func TestCacheDataCodec_Legacy(t *testing.T) {
+	data := &cacheData{Status: 200, Body: []byte("legacy body")}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := unmarshalCacheData(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Status != data.Status || !bytes.Equal(got.Body, data.Body) {
+		t.Errorf("unexpected cache data: want %+v, got %+v", data, got)
+	}
+}
+
+func TestCacheDataCodec_Invalid(t *testing.T) {
+	for _, b := range [][]byte{nil, {0xff}, {cacheDataVersion, 10, 0, 0, 0, '{'}} {
+		if _, err := unmarshalCacheData(b); err == nil {
+			t.Errorf("expected error decoding %v", b)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = zr.Close()
+	}()
+
+	return ioutil.ReadAll(zr)
+}
+
+// gzipReadCloser decompresses a stream, closing the underlying stream with
+// the decompressor.
+type gzipReadCloser struct {
+	*gzip.Reader
+	src io.Closer
+}
+
+func (r *gzipReadCloser) Close() error {
+	_ = r.Reader.Close()
+	return r.src.Close()
+}
+
+// compress returns a copy of the entry with its body gzip compressed for
+// storage.
+func (d *cacheData) compress() (*cacheData, error) {
+	body, err := gzipBytes(d.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	compressed := *d
+	compressed.Body = body
+	compressed.Compressed = true
+
+	return &compressed, nil
+}
+
+// decompress restores the body of an entry compressed for storage, either in
+// memory or by wrapping its body stream.
+func (d *cacheData) decompress() error {
+	if d.body != nil {
+		zr, err := gzip.NewReader(d.body)
+		if err != nil {
+			return err
+		}
+
+		d.body = &gzipReadCloser{Reader: zr, src: d.body}
+	} else {
+		body, err := gunzipBytes(d.Body)
+		if err != nil {
+			return err
+		}
+
+		d.Body = body
+	}
+
+	d.Compressed = false
+
+	return nil
+}
+
+// decode decompresses a body the origin encoded with gzip, for clients which
+// do not accept it, and updates the headers to describe the decoded body. Its
+// size is no longer known for streamed bodies, and the ETag is weakened as the
+// bytes served differ from those it was given for.
+func (d *cacheData) decode() error {
+	if d.body != nil || len(d.Body) > 0 {
+		if err := d.decompress(); err != nil {
+			return err
+		}
+	}
+
+	h := http.Header(d.Headers).Clone()
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+
+	d.Headers = h
+	d.Size = 0
+	if d.body == nil {
+		d.Size = len(d.Body)
+	}
+
+	return nil
+}
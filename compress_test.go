@@ -0,0 +1,93 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache_ServeHTTPCompressStorage(t *testing.T) {
+	body := strings.Repeat("some very compressible body ", 512)
+
+	tests := []struct {
+		name    string
+		backend string
+	}{
+		{name: "should compress streamed bodies", backend: backendFile},
+		{name: "should compress inline bodies", backend: backendMemory},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write([]byte(body))
+			}
+
+			cfg := &Config{
+				Enabled:         true,
+				Backend:         test.backend,
+				Path:            createTempDir(t),
+				MaxExpiry:       "10",
+				Cleanup:         "20",
+				AddStatusHeader: true,
+				CompressStorage: true,
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+			c.ServeHTTP(httptest.NewRecorder(), req)
+
+			b, err := c.(*cache).cache.Get(cacheKey(req, defaultCacheKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := unmarshalCacheData(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !stored.Compressed {
+				t.Error("expected stored body to be compressed")
+			}
+
+			rw := httptest.NewRecorder()
+
+			c.ServeHTTP(rw, req)
+
+			if state := rw.Header().Get("Cache-Status"); state != "hit" {
+				t.Errorf("unexpected cache state: want \"hit\", got: %q", state)
+			}
+
+			if rw.Body.String() != body {
+				t.Errorf("unexpected body: %q", rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestCache_GetUncompressedEntry(t *testing.T) {
+	m := &cache{cache: newMemoryCache(0, 0, nil), cfg: &Config{}}
+
+	m.set(testCacheKey, &cacheData{Status: http.StatusOK, Body: []byte("legacy body")}, time.Minute)
+
+	m.cfg.CompressStorage = true
+
+	data, err := m.get(testCacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data.Body) != "legacy body" {
+		t.Errorf("unexpected body: %q", data.Body)
+	}
+}
@@ -0,0 +1,80 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// originStrippedHeaders are the request headers not forwarded to the origin on
+// a miss, as they let it answer with a response that cannot be replayed to
+// other clients, such as a bodiless 304 or a 206 holding part of the body.
+var originStrippedHeaders = []string{"If-None-Match", "If-Modified-Since", "Range", "If-Range"}
+
+// originRequest returns a copy of the request to forward to the origin on a
+// miss, without the originStrippedHeaders and with the POST body read to be
+// cached, if any, restored.
+func originRequest(r *http.Request) *http.Request {
+	req := r.Clone(r.Context())
+	for _, name := range originStrippedHeaders {
+		req.Header.Del(name)
+	}
+
+	return withPostBody(req)
+}
+
+// notModified reports whether the conditional headers of the request match the
+// stored response headers, in which case a 304 can be sent instead of the
+// body. If-None-Match takes precedence over If-Modified-Since.
+func notModified(r *http.Request, h http.Header) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatch(inm, h.Get("ETag"))
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return !lm.Truncate(time.Second).After(ims)
+}
+
+// etagMatch reports whether any of the comma separated entity tags matches the
+// given ETag using the weak comparison function required for If-None-Match.
+func etagMatch(tags, etag string) bool {
+	if etag == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addETag sets a strong ETag, the SHA-256 digest of the body, on the headers
+// of a response to store without one, when enabled, so that hits can answer
+// If-None-Match. HEAD responses have no body to digest.
+func (m *cache) addETag(r *http.Request, h http.Header, body []byte) {
+	if !m.cfg.GenerateETags || r.Method == http.MethodHead || h.Get("ETag") != "" {
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	h.Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+}
@@ -0,0 +1,245 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		reqHdrs map[string]string
+		resHdrs map[string]string
+		want    bool
+	}{
+		{
+			name:    "should match strong etag",
+			reqHdrs: map[string]string{"If-None-Match": `"abc"`},
+			resHdrs: map[string]string{"ETag": `"abc"`},
+			want:    true,
+		},
+		{
+			name:    "should match weak etag against strong etag",
+			reqHdrs: map[string]string{"If-None-Match": `W/"abc"`},
+			resHdrs: map[string]string{"ETag": `"abc"`},
+			want:    true,
+		},
+		{
+			name:    "should match etag in list",
+			reqHdrs: map[string]string{"If-None-Match": `"foo", W/"abc"`},
+			resHdrs: map[string]string{"ETag": `W/"abc"`},
+			want:    true,
+		},
+		{
+			name:    "should not match different etag",
+			reqHdrs: map[string]string{"If-None-Match": `"foo"`},
+			resHdrs: map[string]string{"ETag": `"abc"`},
+			want:    false,
+		},
+		{
+			name:    "should prefer etag over modification date",
+			reqHdrs: map[string]string{"If-None-Match": `"foo"`, "If-Modified-Since": "Wed, 21 Oct 2015 07:28:00 GMT"},
+			resHdrs: map[string]string{"ETag": `"abc"`, "Last-Modified": "Wed, 21 Oct 2015 07:28:00 GMT"},
+			want:    false,
+		},
+		{
+			name:    "should match unmodified resource",
+			reqHdrs: map[string]string{"If-Modified-Since": "Wed, 21 Oct 2015 07:28:00 GMT"},
+			resHdrs: map[string]string{"Last-Modified": "Tue, 20 Oct 2015 07:28:00 GMT"},
+			want:    true,
+		},
+		{
+			name:    "should not match modified resource",
+			reqHdrs: map[string]string{"If-Modified-Since": "Wed, 21 Oct 2015 07:28:00 GMT"},
+			resHdrs: map[string]string{"Last-Modified": "Thu, 22 Oct 2015 07:28:00 GMT"},
+			want:    false,
+		},
+		{
+			name:    "should ignore unsafe methods",
+			method:  http.MethodPost,
+			reqHdrs: map[string]string{"If-None-Match": `"abc"`},
+			resHdrs: map[string]string{"ETag": `"abc"`},
+			want:    false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			req := httptest.NewRequest(method, "http://localhost/some/path", nil)
+			for key, val := range test.reqHdrs {
+				req.Header.Set(key, val)
+			}
+
+			h := http.Header{}
+			for key, val := range test.resHdrs {
+				h.Set(key, val)
+			}
+
+			if got := notModified(req, h); got != test.want {
+				t.Errorf("unexpected result: want %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPNotModified(t *testing.T) {
+	dir := createTempDir(t)
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("ETag", `"abc"`)
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("body"))
+	}
+
+	cfg := &Config{Enabled: true, Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	req.Header.Set("If-None-Match", `W/"abc"`)
+
+	rw := httptest.NewRecorder()
+
+	c.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusNotModified {
+		t.Errorf("unexpected status: want %d, got %d", http.StatusNotModified, rw.Code)
+	}
+
+	if rw.Body.Len() != 0 {
+		t.Errorf("unexpected body: %q", rw.Body.String())
+	}
+}
+
+func TestCache_ServeHTTPConditionalMiss(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == `"abc"` || req.Header.Get("If-Modified-Since") != "" {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		rw.Header().Set("ETag", `"abc"`)
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("body"))
+	}
+
+	cfg := &Config{
+		Enabled:                true,
+		Backend:                backendMemory,
+		MaxExpiry:              "10",
+		Cleanup:                "20",
+		SkipCacheControlHeader: true,
+		DefaultTTL:             "10",
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	req.Header.Set("If-None-Match", `"abc"`)
+	req.Header.Set("If-Modified-Since", time.Now().UTC().Format(http.TimeFormat))
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("unexpected status of conditional miss: want %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	if rw.Code != http.StatusOK || rw.Body.String() != "body" {
+		t.Errorf("unexpected response: want %d %q, got: %d %q", http.StatusOK, "body", rw.Code, rw.Body.String())
+	}
+
+	if _, ok := c.(*cache).cacheable(req, http.Header{}, http.StatusNotModified, nil); ok {
+		t.Error("expected a 304 not to be cacheable")
+	}
+}
+
+func TestCache_ServeHTTPGenerateETags(t *testing.T) {
+	tests := []struct {
+		name     string
+		generate bool
+		etag     string
+		wantETag string
+	}{
+		{
+			name:     "should not generate etag by default",
+			wantETag: "",
+		},
+		{
+			name:     "should generate etag from body",
+			generate: true,
+			wantETag: `"230d8358dc8e8890b4c58deeb62912ee2f20357ae92a5cc861b98e68fe31acb5"`,
+		},
+		{
+			name:     "should keep etag of the origin",
+			generate: true,
+			etag:     `W/"abc"`,
+			wantETag: `W/"abc"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				if test.etag != "" {
+					rw.Header().Set("ETag", test.etag)
+				}
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write([]byte("body"))
+			}
+
+			cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", GenerateETags: test.generate}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+			if etag := rw.Header().Get("ETag"); etag != test.wantETag {
+				t.Fatalf("unexpected etag: want %q, got: %q", test.wantETag, etag)
+			}
+
+			if test.wantETag == "" {
+				return
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+			req.Header.Set("If-None-Match", test.wantETag)
+
+			rw = httptest.NewRecorder()
+			c.ServeHTTP(rw, req)
+
+			if rw.Code != http.StatusNotModified {
+				t.Errorf("unexpected status: want %d, got %d", http.StatusNotModified, rw.Code)
+			}
+		})
+	}
+}
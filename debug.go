@@ -0,0 +1,52 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The debug headers explain the decision of the cache for a response. They
+// expose the cache key, so they are meant for troubleshooting only.
+const (
+	debugKeyHeader    = "X-Cache-Key"
+	debugTTLHeader    = "X-Cache-TTL"
+	debugReasonHeader = "X-Cache-Reason"
+)
+
+// debug adds the debug headers to the response headers, when enabled. An
+// empty key or a non-positive TTL is left out.
+func (m *cache) debug(h http.Header, key, reason string, ttl time.Duration) {
+	if !m.cfg.DebugHeaders {
+		return
+	}
+
+	if key != "" {
+		h.Set(debugKeyHeader, key)
+	}
+	if ttl > 0 {
+		h.Set(debugTTLHeader, strconv.Itoa(int(ttl.Seconds())))
+	}
+	h.Set(debugReasonHeader, reason)
+}
+
+// debugDecision returns the hook adding the debug headers to a response of the
+// origin, once its status and headers are known, or nil when they are
+// disabled. The decision is made from the headers alone, so a response later
+// found too large or incomplete is still reported as cacheable.
+func (m *cache) debugDecision(r *http.Request, key string) func(h http.Header, status int, surrogate http.Header) {
+	if !m.cfg.DebugHeaders {
+		return nil
+	}
+
+	return func(h http.Header, status int, surrogate http.Header) {
+		stored := m.storedHeaders(h)
+
+		ttl, ok, reason := m.decide(r, stored, status, surrogate)
+		if !ok {
+			ttl = 0
+		}
+
+		m.debug(h, key, reason, ttl)
+	}
+}
@@ -0,0 +1,104 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_ServeHTTPDebugHeaders(t *testing.T) {
+	tests := []struct {
+		name         string
+		debug        bool
+		method       string
+		cacheControl string
+		requests     int
+		wantKey      bool
+		wantTTL      string
+		wantReason   string
+	}{
+		{
+			name:       "should not add headers when disabled",
+			method:     http.MethodGet,
+			requests:   1,
+			wantReason: "",
+		},
+		{
+			name:       "should explain pattern match",
+			debug:      true,
+			method:     http.MethodGet,
+			requests:   1,
+			wantKey:    true,
+			wantTTL:    "5",
+			wantReason: "pattern-match:/api/.*",
+		},
+		{
+			name:       "should explain hit",
+			debug:      true,
+			method:     http.MethodGet,
+			requests:   2,
+			wantKey:    true,
+			wantTTL:    "4",
+			wantReason: "hit",
+		},
+		{
+			name:         "should explain no-store",
+			debug:        true,
+			method:       http.MethodGet,
+			cacheControl: "no-store",
+			requests:     1,
+			wantKey:      true,
+			wantReason:   "no-store",
+		},
+		{
+			name:       "should explain method not allowed",
+			debug:      true,
+			method:     http.MethodPost,
+			requests:   1,
+			wantReason: "method-not-allowed",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				if test.cacheControl != "" {
+					rw.Header().Set("Cache-Control", test.cacheControl)
+				}
+				_, _ = rw.Write([]byte("body"))
+			}
+
+			cfg := &Config{
+				Enabled:                true,
+				Backend:                backendMemory,
+				MaxExpiry:              "10",
+				Cleanup:                "20",
+				SkipCacheControlHeader: true,
+				DebugHeaders:           test.debug,
+				URIs:                   []Uri{{Pattern: "/api/.*", TTL: "5"}},
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rw *httptest.ResponseRecorder
+			for i := 0; i < test.requests; i++ {
+				rw = httptest.NewRecorder()
+				c.ServeHTTP(rw, httptest.NewRequest(test.method, "http://localhost/api/items", nil))
+			}
+
+			if got := rw.Header().Get(debugKeyHeader) != ""; got != test.wantKey {
+				t.Errorf("unexpected key header: want %v, got: %v", test.wantKey, got)
+			}
+			if got := rw.Header().Get(debugTTLHeader); got != test.wantTTL {
+				t.Errorf("unexpected TTL header: want %q, got: %q", test.wantTTL, got)
+			}
+			if got := rw.Header().Get(debugReasonHeader); got != test.wantReason {
+				t.Errorf("unexpected reason header: want %q, got: %q", test.wantReason, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Seconds is a duration configured either as a bare number of seconds or as
+// a duration string such as "1h30m". It is truncated to whole seconds.
+//
+// Traefik decodes the plugin configuration without calling any unmarshaler,
+// converting numbers to the kind of the field, so the value is kept as a string
+// and parsed when used. New rejects invalid values.
+type Seconds string
+
+// Duration returns s as a time.Duration, or zero if it is invalid.
+func (s Seconds) Duration() time.Duration {
+	d, _ := s.parse()
+	return d
+}
+
+func (s Seconds) parse() (time.Duration, error) {
+	v := strings.TrimSpace(string(s))
+	if v == "" {
+		return 0, nil
+	}
+
+	if n, err := strconv.Atoi(v); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %w", v, err)
+	}
+
+	return d.Truncate(time.Second), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Seconds) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	return s.set(v)
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface of gopkg.in/yaml.v2.
+func (s *Seconds) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	return s.set(v)
+}
+
+func (s *Seconds) set(v interface{}) error {
+	switch v := v.(type) {
+	case int:
+		*s = Seconds(strconv.Itoa(v))
+	case float64:
+		*s = Seconds(strconv.Itoa(int(v)))
+	case string:
+		if _, err := Seconds(v).parse(); err != nil {
+			return err
+		}
+		*s = Seconds(v)
+	default:
+		return fmt.Errorf("invalid duration %v", v)
+	}
+
+	return nil
+}
+
+// validateDurations checks that every duration of the configuration can be
+// parsed.
+func validateDurations(cfg *Config) error {
+	type named struct {
+		name  string
+		value Seconds
+	}
+
+	durations := []named{
+		{"maxExpiry", cfg.MaxExpiry},
+		{"cleanup", cfg.Cleanup},
+		{"defaultTTL", cfg.DefaultTTL},
+		{"negativeTTL", cfg.NegativeTTL},
+		{"defaultStaleIfError", cfg.DefaultStaleIfError},
+		{"defaultStaleWhileRevalidate", cfg.DefaultStaleWhileRevalidate},
+	}
+
+	for _, uri := range cfg.URIs {
+		durations = append(durations, named{fmt.Sprintf("ttl of pattern %q", uri.Pattern), uri.TTL})
+	}
+
+	for _, st := range cfg.StatusTTLs {
+		durations = append(durations, named{fmt.Sprintf("ttl of status %d", st.Status), st.TTL})
+	}
+
+	for _, d := range durations {
+		if _, err := d.value.parse(); err != nil {
+			return fmt.Errorf("invalid %s: %w", d.name, err)
+		}
+	}
+
+	return nil
+}
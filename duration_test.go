@@ -0,0 +1,168 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSeconds_Duration(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   Seconds
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "should parse empty value as zero", value: "", want: 0},
+		{name: "should parse integer as seconds", value: "300", want: 300 * time.Second},
+		{name: "should parse negative integer", value: "-1", want: -time.Second},
+		{name: "should parse duration string", value: "5m", want: 5 * time.Minute},
+		{name: "should truncate duration string", value: "1500ms", want: time.Second},
+		{name: "should error on invalid string", value: "soon", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.value.parse()
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != test.want || test.value.Duration() != test.want {
+				t.Errorf("unexpected duration: want %s, got %s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestSeconds_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "should parse bare integer as seconds", json: `300`, want: 300 * time.Second},
+		{name: "should parse integer string as seconds", json: `"45"`, want: 45 * time.Second},
+		{name: "should parse duration string", json: `"5m"`, want: 300 * time.Second},
+		{name: "should parse compound duration string", json: `"1h30m"`, want: 5400 * time.Second},
+		{name: "should error on invalid string", json: `"soon"`, wantErr: true},
+		{name: "should error on invalid type", json: `true`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got Seconds
+
+			err := json.Unmarshal([]byte(test.json), &got)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got.Duration() != test.want {
+				t.Errorf("unexpected duration: want %s, got %s", test.want, got.Duration())
+			}
+		})
+	}
+}
+
+func TestSeconds_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  time.Duration
+	}{
+		{name: "should parse bare integer as seconds", value: 300, want: 300 * time.Second},
+		{name: "should parse duration string", value: "45s", want: 45 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got Seconds
+
+			err := got.UnmarshalYAML(func(v interface{}) error {
+				*(v.(*interface{})) = test.value
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got.Duration() != test.want {
+				t.Errorf("unexpected duration: want %s, got %s", test.want, got.Duration())
+			}
+		})
+	}
+}
+
+func TestConfig_UnmarshalJSONDurations(t *testing.T) {
+	cfg := CreateConfig()
+
+	err := json.Unmarshal([]byte(`{"maxExpiry":"1h","cleanup":600,"defaultTTL":"30s","uris":[{"pattern":"/","ttl":"2m"}]}`), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.MaxExpiry.Duration() != time.Hour || cfg.Cleanup.Duration() != 10*time.Minute ||
+		cfg.DefaultTTL.Duration() != 30*time.Second || cfg.URIs[0].TTL.Duration() != 2*time.Minute {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+}
+
+func TestNew_Durations(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *Config
+		wantErr bool
+	}{
+		{
+			name: "should accept duration strings decoded as is",
+			cfg: &Config{
+				Backend:             backendMemory,
+				MaxExpiry:           "1h",
+				Cleanup:             "10m",
+				DefaultStaleIfError: "30s",
+				StatusTTLs:          []StatusTTL{{Status: 404, TTL: "1m"}},
+			},
+		},
+		{
+			name:    "should error on invalid duration",
+			cfg:     &Config{Backend: backendMemory, MaxExpiry: "1h", Cleanup: "10m", DefaultTTL: "soon"},
+			wantErr: true,
+		},
+		{
+			name: "should error on invalid status ttl",
+			cfg: &Config{
+				Backend:    backendMemory,
+				MaxExpiry:  "1h",
+				Cleanup:    "10m",
+				StatusTTLs: []StatusTTL{{Status: 404, TTL: "1 minute"}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := New(context.Background(), nil, test.cfg, "simplecache")
+			if test.wantErr != (err != nil) {
+				t.Errorf("unexpected error: want error %t, got: %v", test.wantErr, err)
+			}
+		})
+	}
+}
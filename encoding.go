@@ -0,0 +1,101 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// acceptsEncoding reports whether the Accept-Encoding header of the request
+// allows a response with the given content coding. A request without the
+// header accepts any coding.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	coding = strings.ToLower(strings.TrimSpace(coding))
+	if coding == "" {
+		coding = "identity"
+	}
+
+	values := r.Header.Values("Accept-Encoding")
+	if len(values) == 0 {
+		return true
+	}
+
+	qs := make(map[string]float64)
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, q := parseCoding(part)
+			if name != "" {
+				qs[name] = q
+			}
+		}
+	}
+
+	if q, ok := qs[coding]; ok {
+		return q > 0
+	}
+
+	if q, ok := qs["*"]; ok {
+		return q > 0
+	}
+
+	// Identity is acceptable unless explicitly excluded.
+	return coding == "identity"
+}
+
+// parseCoding parses an Accept-Encoding element such as "gzip;q=0.5".
+func parseCoding(s string) (string, float64) {
+	parts := strings.Split(s, ";")
+	name := strings.ToLower(strings.TrimSpace(parts[0]))
+
+	q := 1.0
+	for _, param := range parts[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+
+		if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+			q = v
+		}
+	}
+
+	return name, q
+}
+
+// encoded reports whether the response has a content coding other than
+// identity, its body being the encoded bytes.
+func encoded(h http.Header) bool {
+	ce := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding")))
+
+	return ce != "" && ce != "identity"
+}
+
+// gzipCoding reports whether the content coding is gzip.
+func gzipCoding(coding string) bool {
+	coding = strings.ToLower(strings.TrimSpace(coding))
+
+	return coding == "gzip" || coding == "x-gzip"
+}
+
+// storedVary returns the request headers selecting the variant of the
+// response. Encoded responses always vary on Accept-Encoding, so that each
+// acceptable encoding is stored separately.
+func storedVary(h http.Header) []string {
+	names := varyHeaders(h)
+
+	if !encoded(h) {
+		return names
+	}
+
+	for _, name := range names {
+		if name == "Accept-Encoding" {
+			return names
+		}
+	}
+
+	names = append(names, "Accept-Encoding")
+	sort.Strings(names)
+
+	return names
+}
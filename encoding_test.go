@@ -0,0 +1,267 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		coding         string
+		want           bool
+	}{
+		{name: "should accept anything without header", coding: "gzip", want: true},
+		{name: "should accept listed coding", acceptEncoding: "gzip, br", coding: "gzip", want: true},
+		{name: "should reject unlisted coding", acceptEncoding: "br", coding: "gzip", want: false},
+		{name: "should reject coding with zero quality", acceptEncoding: "gzip;q=0, br", coding: "gzip", want: false},
+		{name: "should accept coding through wildcard", acceptEncoding: "*", coding: "gzip", want: true},
+		{name: "should prefer explicit coding over wildcard", acceptEncoding: "*, gzip;q=0", coding: "gzip", want: false},
+		{name: "should accept identity by default", acceptEncoding: "gzip", coding: "", want: true},
+		{name: "should reject excluded identity", acceptEncoding: "gzip, identity;q=0", coding: "identity", want: false},
+		{name: "should reject identity excluded through wildcard", acceptEncoding: "gzip, *;q=0", coding: "", want: false},
+		{name: "should reject gzip for identity only client", acceptEncoding: "identity", coding: "gzip", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+			if test.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", test.acceptEncoding)
+			}
+
+			if got := acceptsEncoding(req, test.coding); got != test.want {
+				t.Errorf("unexpected result: want %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPContentEncoding(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+
+		if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+			rw.Header().Set("Content-Encoding", "gzip")
+			rw.WriteHeader(http.StatusOK)
+			_, _ = rw.Write([]byte("gzip body"))
+			return
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("plain body"))
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		acceptEncoding string
+		wantState      string
+		wantBody       string
+	}{
+		{acceptEncoding: "gzip", wantState: "miss", wantBody: "gzip body"},
+		{acceptEncoding: "identity", wantState: "miss", wantBody: "plain body"},
+		{acceptEncoding: "gzip", wantState: "hit", wantBody: "gzip body"},
+		{acceptEncoding: "identity", wantState: "hit", wantBody: "plain body"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+			t.Errorf("unexpected cache state for %q: want %q, got: %q", test.acceptEncoding, test.wantState, state)
+		}
+
+		if body := rw.Body.String(); body != test.wantBody {
+			t.Errorf("unexpected body for %q: want %q, got: %q", test.acceptEncoding, test.wantBody, body)
+		}
+	}
+}
+
+func TestCache_ServeHTTPGzipRoundTrip(t *testing.T) {
+	body := strings.Repeat("some very compressible body ", 512)
+
+	encodedBody, err := gzipBytes([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		backend  string
+		compress bool
+	}{
+		{name: "should round trip inline body", backend: backendMemory},
+		{name: "should round trip streamed body", backend: backendFile},
+		{name: "should not compress encoded inline body", backend: backendMemory, compress: true},
+		{name: "should not compress encoded streamed body", backend: backendFile, compress: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.Header().Set("Content-Encoding", "gzip")
+				rw.Header().Set("Content-Length", strconv.Itoa(len(encodedBody)))
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write(encodedBody)
+			}
+
+			cfg := &Config{
+				Enabled:         true,
+				Backend:         test.backend,
+				Path:            createTempDir(t),
+				MaxExpiry:       "10",
+				Cleanup:         "20",
+				AddStatusHeader: true,
+				CompressStorage: test.compress,
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, wantState := range []string{cacheMissStatus, cacheHitStatus} {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+				req.Header.Set("Accept-Encoding", "gzip")
+
+				rw := httptest.NewRecorder()
+				c.ServeHTTP(rw, req)
+
+				if state := rw.Header().Get("Cache-Status"); state != wantState {
+					t.Errorf("unexpected cache state: want %q, got: %q", wantState, state)
+				}
+
+				if ce := rw.Header().Get("Content-Encoding"); ce != "gzip" {
+					t.Errorf("unexpected Content-Encoding: want %q, got: %q", "gzip", ce)
+				}
+
+				if cl := rw.Header().Get("Content-Length"); cl != strconv.Itoa(len(encodedBody)) {
+					t.Errorf("unexpected Content-Length: want %d, got: %q", len(encodedBody), cl)
+				}
+
+				decoded, err := gunzipBytes(rw.Body.Bytes())
+				if err != nil {
+					t.Fatalf("unexpected error decoding body: %v", err)
+				}
+
+				if string(decoded) != body {
+					t.Errorf("unexpected decoded body of %d bytes", len(decoded))
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+
+			m := c.(*cache)
+
+			b, err := m.cache.Get(m.varyKey(cacheKey(req, defaultCacheKey), []string{"Accept-Encoding"}, req))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := unmarshalCacheData(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stored.Compressed {
+				t.Error("unexpected compression of an encoded body")
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPDecodeGzip(t *testing.T) {
+	body := strings.Repeat("some very compressible body ", 512)
+
+	encodedBody, err := gzipBytes([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		backend    string
+		wantLength string
+	}{
+		{name: "should decode inline body", backend: backendMemory, wantLength: strconv.Itoa(len(body))},
+		{name: "should decode streamed body", backend: backendFile},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.Header().Set("Content-Encoding", "gzip")
+				rw.Header().Set("Content-Length", strconv.Itoa(len(encodedBody)))
+				rw.Header().Set("ETag", `"v1"`)
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write(encodedBody)
+			}
+
+			cfg := &Config{
+				Enabled:         true,
+				Backend:         test.backend,
+				Path:            createTempDir(t),
+				MaxExpiry:       "10",
+				Cleanup:         "20",
+				AddStatusHeader: true,
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			newRequest := func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+				req.Header.Set("Accept-Encoding", "identity")
+				return req
+			}
+
+			// The origin ignores Accept-Encoding, so the variant stored for
+			// identity-only clients holds a gzip body.
+			c.ServeHTTP(httptest.NewRecorder(), newRequest())
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, newRequest())
+
+			if state := rw.Header().Get("Cache-Status"); state != cacheHitStatus {
+				t.Errorf("unexpected cache state: want %q, got: %q", cacheHitStatus, state)
+			}
+
+			if ce := rw.Header().Get("Content-Encoding"); ce != "" {
+				t.Errorf("unexpected Content-Encoding: want %q, got: %q", "", ce)
+			}
+
+			if cl := rw.Header().Get("Content-Length"); cl != test.wantLength {
+				t.Errorf("unexpected Content-Length: want %q, got: %q", test.wantLength, cl)
+			}
+
+			if etag := rw.Header().Get("ETag"); etag != `W/"v1"` {
+				t.Errorf("unexpected ETag: want %q, got: %q", `W/"v1"`, etag)
+			}
+
+			if rw.Body.String() != body {
+				t.Errorf("unexpected body of %d bytes", rw.Body.Len())
+			}
+		})
+	}
+}
@@ -2,27 +2,51 @@
 package traefik_plugin_cache_by_route
 
 import (
+	"container/list"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
-var errCacheMiss = errors.New("cache miss")
+// bodyDir is the directory, next to the entries of a shard, holding the
+// bodies stored apart from their entry.
+const bodyDir = "body"
 
+// tempFilePrefix starts the name of the files being written, which are only
+// renamed to their entry path once complete.
+const tempFilePrefix = ".tmp-"
+
+// fileCache is a backend storing entries as files below path. When maxBytes is
+// positive, the least recently used entries are evicted once the files take
+// more than maxBytes on disk, and likewise once there are more than maxEntries
+// entries when it is positive.
 type fileCache struct {
-	path string
-	pm   *pathMutex
+	path       string
+	maxBytes   int64
+	maxEntries int
+	sweepBatch int
+	pending    []string
+	pm         *pathMutex
+	index      *fileIndex
+	// onEvict, when set, is called with the keys dropped once expired or to
+	// stay within the limits.
+	onEvict func(key string)
+
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
-func newFileCache(path string, vacuum time.Duration) (*fileCache, error) {
+func newFileCache(path string, vacuum time.Duration, maxBytes, maxEntries, sweepBatch int, onEvict func(key string)) (*fileCache, error) {
 	info, err := os.Stat(path)
 	if err != nil {
 		return nil, fmt.Errorf("invalid cache path: %w", err)
@@ -32,65 +56,192 @@ func newFileCache(path string, vacuum time.Duration) (*fileCache, error) {
 		return nil, errors.New("path must be a directory")
 	}
 
+	// Writes failing later would only show as responses never being cached.
+	if err = checkWritable(path); err != nil {
+		return nil, fmt.Errorf("cache path is not writable: %w", err)
+	}
+
 	fc := &fileCache{
-		path: path,
-		pm:   &pathMutex{lock: map[string]*fileLock{}},
+		path:       path,
+		maxBytes:   int64(maxBytes),
+		maxEntries: maxEntries,
+		sweepBatch: sweepBatch,
+		pm:         &pathMutex{lock: map[string]*fileLock{}},
+		index:      newFileIndex(),
+		onEvict:    onEvict,
+		stop:       make(chan struct{}),
+	}
+
+	// Expiry is read from the entry files rather than tracked in memory, so
+	// entries left by a previous process expire all the same. Drop those
+	// which expired while it was down before indexing the others.
+	fc.removeExpired(vacuum)
+
+	if err = fc.load(); err != nil {
+		return nil, fmt.Errorf("error reading cache path: %w", err)
 	}
 
+	fc.evict()
+
 	go fc.vacuum(vacuum)
 
 	return fc, nil
 }
 
+// load indexes the entries already on disk, oldest modified first.
+func (c *fileCache) load() error {
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var files []file
+
+	err := filepath.Walk(c.path, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			// Removed since the walk started, for instance by the vacuum of
+			// another cache sharing the path.
+			return nil
+		case err != nil:
+			return err
+		case info.IsDir(), !isEntryFile(path):
+			return nil
+		}
+
+		size := info.Size()
+		if body, err := os.Stat(siblingBodyPath(path)); err == nil {
+			size += body.Size()
+		}
+
+		files = append(files, file{path: path, size: size, modTime: info.ModTime()})
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	for _, f := range files {
+		c.index.setEntry(f.path, f.size)
+	}
+
+	return nil
+}
+
+// vacuum removes the expired entries every interval until the cache is
+// closed, walking the whole path or, with a positive sweepBatch, checking that
+// many of the indexed entries at a time. Expired entries are also removed when
+// read. Several caches may vacuum the same path, for instance while Traefik
+// replaces the middleware on a configuration reload, so files vanishing
+// during a run are skipped.
 func (c *fileCache) vacuum(interval time.Duration) {
 	timer := time.NewTicker(interval)
 	defer timer.Stop()
 
-	for range timer.C {
-		_ = filepath.Walk(c.path, func(path string, info os.FileInfo, err error) error {
-			switch {
-			case err != nil:
-				return err
-			case info.IsDir():
-				return nil
+	for {
+		select {
+		case <-timer.C:
+			if c.sweepBatch > 0 {
+				c.sweep(c.sweepBatch)
+			} else {
+				c.removeExpired(interval)
 			}
+		case <-c.stop:
+			return
+		}
+	}
+}
 
-			mu := c.pm.MutexAt(filepath.Base(path))
-			mu.Lock()
-			defer mu.Unlock()
-
-			// Get the expiry.
-			var t [8]byte
-			f, err := os.Open(filepath.Clean(path))
-			if err != nil {
-				// Just skip the file in this case.
-				return nil // nolint:nilerr // skip
-			}
-			if n, err := f.Read(t[:]); err != nil && n != 8 {
-				return nil
+func (c *fileCache) removeExpired(interval time.Duration) {
+	_ = filepath.Walk(c.path, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return nil
+		case err != nil:
+			return err
+		case strings.HasPrefix(info.Name(), tempFilePrefix):
+			// Left over by an interrupted write.
+			if time.Since(info.ModTime()) > interval {
+				_ = os.Remove(path)
 			}
-			_ = f.Close()
+			return nil
+		case info.IsDir(), !isEntryFile(path):
+			return nil
+		}
 
-			expires := time.Unix(int64(binary.LittleEndian.Uint64(t[:])), 0)
-			if !expires.Before(time.Now()) {
-				return nil
-			}
+		c.removeIfExpired(path)
+		return nil
+	})
+}
 
-			// Delete the file.
-			_ = os.Remove(path)
-			return nil
-		})
+// sweep checks the expiry of up to n indexed entries, resuming where the
+// previous sweep stopped, so that each run does a bounded amount of work.
+// Only the vacuum goroutine calls it.
+func (c *fileCache) sweep(n int) {
+	if len(c.pending) == 0 {
+		c.pending = c.index.paths()
+	}
+
+	batch := c.pending
+	if len(batch) > n {
+		batch = batch[:n]
+	}
+	c.pending = c.pending[len(batch):]
+
+	for _, p := range batch {
+		c.removeIfExpired(p)
 	}
 }
 
+// removeIfExpired deletes the entry file at p if it has expired.
+func (c *fileCache) removeIfExpired(p string) {
+	mu := c.pm.MutexAt(p)
+	mu.Lock()
+	defer mu.Unlock()
+
+	expires, err := entryFileExpiry(p)
+	if err != nil {
+		// Just skip the file in this case.
+		return
+	}
+
+	if expires.Before(time.Now()) {
+		key := c.entryKey(p)
+		c.remove(p)
+		c.evicted(key)
+	}
+}
+
+// Close stops vacuuming the cache path. It may be called several times.
+func (c *fileCache) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+
+	return nil
+}
+
 func (c *fileCache) Get(key string) ([]byte, error) {
-	mu := c.pm.MutexAt(key)
+	p := keyPath(c.path, key)
+
+	mu := c.pm.MutexAt(p)
 	mu.RLock()
 	defer mu.RUnlock()
 
-	p := keyPath(c.path, key)
+	return c.read(p)
+}
+
+// read returns the value of the entry file at p. The caller must hold the lock
+// of p.
+func (c *fileCache) read(p string) ([]byte, error) {
 	if info, err := os.Stat(p); err != nil || info.IsDir() {
-		return nil, errCacheMiss
+		return nil, ErrCacheMiss
 	}
 
 	b, err := ioutil.ReadFile(filepath.Clean(p))
@@ -98,73 +249,487 @@ func (c *fileCache) Get(key string) ([]byte, error) {
 		return nil, fmt.Errorf("error reading file %q: %w", p, err)
 	}
 
-	expires := time.Unix(int64(binary.LittleEndian.Uint64(b[:8])), 0)
+	expires, key, val, err := parseEntryFile(b)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file %q: %v: %w", p, err, errCorruptEntry)
+	}
+
 	if expires.Before(time.Now()) {
-		_ = os.Remove(p)
-		return nil, errCacheMiss
+		c.remove(p)
+		c.evicted(key)
+		return nil, ErrCacheMiss
 	}
 
-	return b[8:], nil
+	c.index.touch(p)
+
+	return val, nil
 }
 
 func (c *fileCache) Set(key string, val []byte, expiry time.Duration) error {
-	mu := c.pm.MutexAt(key)
+	p := keyPath(c.path, key)
+
+	mu := c.pm.MutexAt(p)
+	mu.Lock()
+	err := c.write(p, key, val, expiry)
+	if err == nil {
+		// A body left by a previous entry does not belong to this one.
+		_ = os.Remove(siblingBodyPath(p))
+		c.index.setBody(p, 0)
+	}
+	mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	c.evict()
+
+	return nil
+}
+
+// write writes the entry file at p. The caller must hold the lock of p.
+func (c *fileCache) write(p, key string, val []byte, expiry time.Duration) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return fmt.Errorf("error creating file path: %w", err)
+	}
+
+	header := entryFileHeader(time.Now().Add(expiry), key)
+	if err := writeFileAtomic(p, header, val); err != nil {
+		return err
+	}
+
+	c.index.setEntry(p, int64(len(header)+len(val)))
+
+	return nil
+}
+
+func (c *fileCache) Delete(key string) error {
+	p := keyPath(c.path, key)
+
+	mu := c.pm.MutexAt(p)
 	mu.Lock()
 	defer mu.Unlock()
 
+	c.index.remove(p)
+	_ = os.Remove(siblingBodyPath(p))
+
+	err := os.Remove(p)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return ErrCacheMiss
+	case err != nil:
+		return fmt.Errorf("error deleting file: %w", err)
+	}
+
+	return nil
+}
+
+// SetWithBody stores the value at key like Set, and the body in its own file
+// so that it can be streamed on hits. Both files are written under the lock of
+// the entry.
+func (c *fileCache) SetWithBody(key string, val, body []byte, expiry time.Duration) error {
 	p := keyPath(c.path, key)
-	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+
+	mu := c.pm.MutexAt(p)
+	mu.Lock()
+	err := c.writeBody(p, body)
+	if err == nil {
+		err = c.write(p, key, val, expiry)
+	}
+	mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	c.evict()
+
+	return nil
+}
+
+func (c *fileCache) writeBody(p string, body []byte) error {
+	bp := siblingBodyPath(p)
+	if err := os.MkdirAll(filepath.Dir(bp), 0700); err != nil {
 		return fmt.Errorf("error creating file path: %w", err)
 	}
 
-	f, err := os.OpenFile(filepath.Clean(p), os.O_RDWR|os.O_CREATE, 0600)
+	if err := writeFileAtomic(bp, body); err != nil {
+		return err
+	}
+
+	c.index.setBody(p, int64(len(body)))
+
+	return nil
+}
+
+// GetWithBody returns the value stored at key like Get, and opens its body if
+// it was stored by SetWithBody. Both files are opened under the lock of the
+// entry, and files being replaced atomically, the body read is that of the
+// same write as the value.
+func (c *fileCache) GetWithBody(key string) ([]byte, io.ReadCloser, error) {
+	p := keyPath(c.path, key)
+
+	mu := c.pm.MutexAt(p)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	val, err := c.read(p)
 	if err != nil {
-		return fmt.Errorf("error creating file: %w", err)
+		return nil, nil, err
 	}
 
-	defer func() {
-		_ = f.Close()
-	}()
+	f, err := os.Open(siblingBodyPath(p))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return val, nil, nil
+	case err != nil:
+		return nil, nil, fmt.Errorf("error opening file: %w", err)
+	}
+
+	return val, f, nil
+}
 
-	timestamp := uint64(time.Now().Add(expiry).Unix())
+// Keys returns the keys of the entries on disk starting with prefix, reading
+// them from the entry files.
+func (c *fileCache) Keys(prefix string) ([]string, error) {
+	var keys []string
+
+	err := filepath.Walk(c.path, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			// Removed since the walk started, for instance by the vacuum of
+			// another cache sharing the path.
+			return nil
+		case err != nil:
+			return err
+		case info.IsDir(), !isEntryFile(path):
+			return nil
+		}
+
+		mu := c.pm.MutexAt(path)
+		mu.RLock()
+		defer mu.RUnlock()
+
+		b, err := ioutil.ReadFile(filepath.Clean(path))
+		if err != nil {
+			// The entry was removed since the walk started.
+			return nil // nolint:nilerr // skip
+		}
+
+		if _, key, _, err := parseEntryFile(b); err == nil && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// entryFileHeader returns the start of an entry file: its expiry in seconds and
+// the length of its key, both little-endian, followed by the key.
+func entryFileHeader(expires time.Time, key string) []byte {
+	b := make([]byte, 12, 12+len(key))
+	binary.LittleEndian.PutUint64(b[:8], uint64(expires.Unix()))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(len(key)))
+
+	return append(b, key...)
+}
+
+// entryFileExpiry reads the expiry persisted at the start of the entry file
+// at p.
+func entryFileExpiry(p string) (time.Time, error) {
+	f, err := os.Open(filepath.Clean(p))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer func() { _ = f.Close() }()
 
 	var t [8]byte
+	if _, err = io.ReadFull(f, t[:]); err != nil {
+		return time.Time{}, err
+	}
 
-	binary.LittleEndian.PutUint64(t[:], timestamp)
+	return time.Unix(int64(binary.LittleEndian.Uint64(t[:])), 0), nil
+}
 
-	if _, err = f.Write(t[:]); err != nil {
-		return fmt.Errorf("error writing file: %w", err)
+// parseEntryFile splits the content of an entry file.
+func parseEntryFile(b []byte) (time.Time, string, []byte, error) {
+	if len(b) < 12 {
+		return time.Time{}, "", nil, errors.New("truncated entry")
 	}
 
-	if _, err = f.Write(val); err != nil {
+	expires := time.Unix(int64(binary.LittleEndian.Uint64(b[:8])), 0)
+
+	n := int(binary.LittleEndian.Uint32(b[8:12]))
+	if len(b) < 12+n {
+		return time.Time{}, "", nil, errors.New("truncated entry")
+	}
+
+	return expires, string(b[12 : 12+n]), b[12+n:], nil
+}
+
+// checkWritable creates and removes a temporary file in the directory.
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, tempFilePrefix+"check")
+	if err != nil {
+		return err
+	}
+
+	_ = f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// writeFileAtomic writes the chunks to a temporary file next to p before
+// renaming it to p, so that readers never observe a partially written file.
+func writeFileAtomic(p string, chunks ...[]byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(p), tempFilePrefix+filepath.Base(p))
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+
+	tmp := f.Name()
+
+	for _, chunk := range chunks {
+		if _, err = f.Write(chunk); err != nil {
+			break
+		}
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp)
 		return fmt.Errorf("error writing file: %w", err)
 	}
 
 	return nil
 }
 
-func keyHash(key string) [4]byte {
-	h := crc32.Checksum([]byte(key), crc32.IEEETable)
+// remove deletes the entry file at p and its body. The caller must hold the
+// lock for p.
+func (c *fileCache) remove(p string) {
+	c.index.remove(p)
+	_ = os.Remove(p)
+	_ = os.Remove(siblingBodyPath(p))
+}
+
+// Len returns the number of entries held, including expired ones not yet
+// vacuumed.
+func (c *fileCache) Len() int {
+	return c.index.len()
+}
+
+// evict removes the least recently used entries until the cache fits in
+// maxBytes. Entries written again since being picked are left in place.
+func (c *fileCache) evict() {
+	if c.maxBytes <= 0 && c.maxEntries <= 0 {
+		return
+	}
+
+	for {
+		p, ok := c.index.victim(c.maxBytes, c.maxEntries)
+		if !ok {
+			return
+		}
+
+		mu := c.pm.MutexAt(p)
+		mu.Lock()
+
+		if !c.index.contains(p) {
+			key := c.entryKey(p)
+			_ = os.Remove(p)
+			_ = os.Remove(siblingBodyPath(p))
+			c.evicted(key)
+		}
+
+		mu.Unlock()
+	}
+}
+
+// entryKey returns the key of the entry file at p when evictions are
+// reported, read from its header. The caller must hold the lock of p.
+func (c *fileCache) entryKey(p string) string {
+	if c.onEvict == nil {
+		return ""
+	}
+
+	f, err := os.Open(filepath.Clean(p))
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = f.Close() }()
+
+	var hdr [12]byte
+	if _, err = io.ReadFull(f, hdr[:]); err != nil {
+		return ""
+	}
 
-	var b [4]byte
+	// The length of a corrupt file cannot be trusted.
+	var key strings.Builder
+	n := int64(binary.LittleEndian.Uint32(hdr[8:12]))
+	if m, err := io.CopyN(&key, f, n); err != nil || m != n {
+		return ""
+	}
 
-	binary.LittleEndian.PutUint32(b[:], h)
+	return key.String()
+}
 
-	return b
+// evicted reports the key dropped by the backend, when asked to and known.
+func (c *fileCache) evicted(key string) {
+	if c.onEvict != nil && key != "" {
+		c.onEvict(key)
+	}
 }
 
+// keyPath returns the path of the entry file for key. Files are named after
+// the hash of their key and spread over two levels of directories, keeping
+// directories small whatever the keys look like.
 func keyPath(path, key string) string {
-	h := keyHash(key)
-	key = strings.NewReplacer("/", "-", ":", "_").Replace(key)
-
-	return filepath.Join(
-		path,
-		hex.EncodeToString(h[0:1]),
-		hex.EncodeToString(h[1:2]),
-		hex.EncodeToString(h[2:3]),
-		hex.EncodeToString(h[3:4]),
-		key,
-	)
+	h := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(h[:])
+
+	return filepath.Join(path, name[0:2], name[2:4], name)
+}
+
+// isEntryFile reports whether the file at p holds an entry, rather than a body
+// or a file being written.
+func isEntryFile(p string) bool {
+	return filepath.Base(filepath.Dir(p)) != bodyDir && !strings.HasPrefix(filepath.Base(p), tempFilePrefix)
+}
+
+func siblingBodyPath(p string) string {
+	return filepath.Join(filepath.Dir(p), bodyDir, filepath.Base(p))
+}
+
+type fileIndexEntry struct {
+	path  string
+	entry int64
+	body  int64
+}
+
+// fileIndex tracks the size on disk of the entries of a fileCache, in least
+// recently used order.
+type fileIndex struct {
+	mu    sync.Mutex
+	bytes int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newFileIndex() *fileIndex {
+	return &fileIndex{
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (x *fileIndex) setEntry(path string, size int64) {
+	x.update(path, func(e *fileIndexEntry) { e.entry = size })
+}
+
+func (x *fileIndex) setBody(path string, size int64) {
+	x.update(path, func(e *fileIndexEntry) { e.body = size })
+}
+
+func (x *fileIndex) update(path string, fn func(*fileIndexEntry)) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	el, ok := x.items[path]
+	if !ok {
+		el = x.ll.PushFront(&fileIndexEntry{path: path})
+		x.items[path] = el
+	}
+
+	e := el.Value.(*fileIndexEntry)
+	x.bytes -= e.entry + e.body
+	fn(e)
+	x.bytes += e.entry + e.body
+
+	x.ll.MoveToFront(el)
+}
+
+func (x *fileIndex) touch(path string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if el, ok := x.items[path]; ok {
+		x.ll.MoveToFront(el)
+	}
+}
+
+// paths returns the paths of the indexed entries.
+func (x *fileIndex) paths() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	paths := make([]string, 0, len(x.items))
+	for p := range x.items {
+		paths = append(paths, p)
+	}
+
+	return paths
+}
+
+func (x *fileIndex) len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return x.ll.Len()
+}
+
+func (x *fileIndex) contains(path string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	_, ok := x.items[path]
+
+	return ok
+}
+
+func (x *fileIndex) remove(path string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if el, ok := x.items[path]; ok {
+		x.removeElement(el)
+	}
+}
+
+// victim removes and returns the least recently used entry while the indexed
+// entries take more than maxBytes or are more than maxEntries, each limit
+// applying when positive. The most recently used entry is never picked.
+func (x *fileIndex) victim(maxBytes int64, maxEntries int) (string, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	overBytes := maxBytes > 0 && x.bytes > maxBytes
+	overEntries := maxEntries > 0 && x.ll.Len() > maxEntries
+
+	if !overBytes && !overEntries || x.ll.Len() <= 1 {
+		return "", false
+	}
+
+	return x.removeElement(x.ll.Back()), true
+}
+
+func (x *fileIndex) removeElement(el *list.Element) string {
+	e := x.ll.Remove(el).(*fileIndexEntry)
+	delete(x.items, e.path)
+	x.bytes -= e.entry + e.body
+
+	return e.path
 }
 
 type pathMutex struct {
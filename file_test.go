@@ -3,7 +3,15 @@ package traefik_plugin_cache_by_route
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -15,7 +23,7 @@ const testCacheKey = "GETlocalhost:8080/test/path"
 func TestFileCache(t *testing.T) {
 	dir := createTempDir(t)
 
-	fc, err := newFileCache(dir, time.Second)
+	fc, err := newFileCache(dir, time.Second, 0, 0, 0, nil)
 	if err != nil {
 		t.Errorf("unexpected newFileCache error: %v", err)
 	}
@@ -42,6 +50,600 @@ func TestFileCache(t *testing.T) {
 	}
 }
 
+func TestFileCache_Unwritable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+
+	dir := createTempDir(t)
+
+	if err := os.Chmod(dir, 0o500); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chmod(dir, 0o700) })
+
+	if _, err := newFileCache(dir, time.Second, 0, 0, 0, nil); err == nil {
+		t.Error("unexpected newFileCache success with an unwritable path")
+	}
+}
+
+func TestFileCache_Overwrite(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Second, 0, 0, 0, nil)
+	if err != nil {
+		t.Errorf("unexpected newFileCache error: %v", err)
+	}
+
+	_ = fc.Set(testCacheKey, []byte("some longer cache content"), time.Second)
+	_ = fc.Set(testCacheKey, []byte("short"), time.Second)
+
+	got, err := fc.Get(testCacheKey)
+	if err != nil {
+		t.Errorf("unexpected cache get error: %v", err)
+	}
+
+	if string(got) != "short" {
+		t.Errorf("unexpected cache content: want short, got %s", got)
+	}
+}
+
+func TestFileCache_Keys(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Minute, 0, 0, 0, nil)
+	if err != nil {
+		t.Errorf("unexpected newFileCache error: %v", err)
+	}
+
+	for _, key := range []string{"GETlocalhost/blog/a", "GETlocalhost/blog/b", "GETlocalhost/about"} {
+		if err = fc.Set(key, []byte("content"), time.Minute); err != nil {
+			t.Errorf("unexpected cache set error: %v", err)
+		}
+	}
+
+	keys, err := fc.Keys("GETlocalhost/blog/")
+	if err != nil {
+		t.Fatalf("unexpected keys error: %v", err)
+	}
+
+	sort.Strings(keys)
+
+	if want := []string{"GETlocalhost/blog/a", "GETlocalhost/blog/b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("unexpected keys: want %v, got %v", want, keys)
+	}
+}
+
+func TestFileCache_InterruptedWrite(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Second, 0, 0, 0, nil)
+	if err != nil {
+		t.Errorf("unexpected newFileCache error: %v", err)
+	}
+
+	if err = fc.Set(testCacheKey, []byte("old content"), time.Minute); err != nil {
+		t.Errorf("unexpected cache set error: %v", err)
+	}
+
+	// Simulate a write interrupted before the file was renamed into place.
+	p := keyPath(dir, testCacheKey)
+	partial := filepath.Join(filepath.Dir(p), tempFilePrefix+filepath.Base(p)+"123")
+
+	if err = ioutil.WriteFile(partial, []byte("new con"), 0600); err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+
+	got, err := fc.Get(testCacheKey)
+	if err != nil || string(got) != "old content" {
+		t.Errorf("unexpected cache content: want old content, got %s (%v)", got, err)
+	}
+
+	if err = fc.Set(testCacheKey, []byte("new content"), time.Minute); err != nil {
+		t.Errorf("unexpected cache set error: %v", err)
+	}
+
+	got, err = fc.Get(testCacheKey)
+	if err != nil || string(got) != "new content" {
+		t.Errorf("unexpected cache content: want new content, got %s (%v)", got, err)
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+
+	if _, err = os.Stat(partial); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected interrupted write to be cleaned up, got %v", err)
+	}
+}
+
+func TestFileCache_Delete(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Second, 0, 0, 0, nil)
+	if err != nil {
+		t.Errorf("unexpected newFileCache error: %v", err)
+	}
+
+	if err = fc.Delete(testCacheKey); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("unexpected delete error: want %v, got %v", ErrCacheMiss, err)
+	}
+
+	if err = fc.Set(testCacheKey, []byte("some content"), time.Second); err != nil {
+		t.Errorf("unexpected cache set error: %v", err)
+	}
+
+	if err = fc.Delete(testCacheKey); err != nil {
+		t.Errorf("unexpected delete error: %v", err)
+	}
+
+	if _, err = fc.Get(testCacheKey); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("unexpected cache get error: want %v, got %v", ErrCacheMiss, err)
+	}
+}
+
+func TestFileCache_Body(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Second, 0, 0, 0, nil)
+	if err != nil {
+		t.Errorf("unexpected newFileCache error: %v", err)
+	}
+
+	if _, _, err = fc.GetWithBody(testCacheKey); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("unexpected get error: want %v, got %v", ErrCacheMiss, err)
+	}
+
+	body := []byte("some random body content that should be exact")
+
+	if err = fc.SetWithBody(testCacheKey, []byte("metadata"), body, time.Second); err != nil {
+		t.Errorf("unexpected cache set error: %v", err)
+	}
+
+	val, rc, err := fc.GetWithBody(testCacheKey)
+	if err != nil || rc == nil {
+		t.Fatalf("unexpected get error: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(rc)
+	_ = rc.Close()
+
+	if err != nil || !bytes.Equal(got, body) || string(val) != "metadata" {
+		t.Errorf("unexpected entry: want metadata and %s, got %s and %s (%v)", body, val, got, err)
+	}
+
+	if err = fc.Set(testCacheKey, []byte("inline"), time.Second); err != nil {
+		t.Errorf("unexpected cache set error: %v", err)
+	}
+
+	if _, rc, err = fc.GetWithBody(testCacheKey); err != nil || rc != nil {
+		t.Errorf("expected body to be replaced by inline entry, got %v (%v)", rc, err)
+	}
+
+	if err = fc.SetWithBody(testCacheKey, []byte("metadata"), body, time.Second); err != nil {
+		t.Errorf("unexpected cache set error: %v", err)
+	}
+
+	if err = fc.Delete(testCacheKey); err != nil {
+		t.Errorf("unexpected delete error: %v", err)
+	}
+
+	if _, err = os.Stat(siblingBodyPath(keyPath(dir, testCacheKey))); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected body to be deleted with its entry, got %v", err)
+	}
+}
+
+func TestFileCache_BodyConcurrentOverwrite(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Minute, 0, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+	defer func() { _ = fc.Close() }()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 200; i++ {
+			v := []byte(strconv.Itoa(i))
+			_ = fc.SetWithBody(testCacheKey, v, v, time.Minute)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		val, rc, err := fc.GetWithBody(testCacheKey)
+		if err != nil {
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(rc)
+		_ = rc.Close()
+
+		if !bytes.Equal(val, body) {
+			t.Fatalf("unexpected body of another write: want %s, got %s", val, body)
+		}
+	}
+}
+
+func TestFileCache_MaxBytes(t *testing.T) {
+	dir := createTempDir(t)
+
+	// Each entry takes 12 bytes of header, 1 byte of key and 12 bytes of
+	// content.
+	fc, err := newFileCache(dir, time.Minute, 50, 0, 0, nil)
+	if err != nil {
+		t.Errorf("unexpected newFileCache error: %v", err)
+	}
+
+	_ = fc.Set("a", []byte("content of a"), time.Minute)
+	_ = fc.Set("b", []byte("content of b"), time.Minute)
+
+	if _, err = fc.Get("a"); err != nil {
+		t.Errorf("unexpected cache get error: %v", err)
+	}
+
+	_ = fc.Set("c", []byte("content of c"), time.Minute)
+
+	if _, err = fc.Get("b"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected least recently used entry to be evicted, got %v", err)
+	}
+
+	for _, key := range []string{"a", "c"} {
+		if _, err = fc.Get(key); err != nil {
+			t.Errorf("unexpected cache get error for %q: %v", key, err)
+		}
+	}
+
+	if err = fc.Delete("a"); err != nil {
+		t.Errorf("unexpected delete error: %v", err)
+	}
+
+	_ = fc.Set("d", []byte("content of d"), time.Minute)
+
+	for _, key := range []string{"c", "d"} {
+		if _, err = fc.Get(key); err != nil {
+			t.Errorf("unexpected cache get error for %q: %v", key, err)
+		}
+	}
+
+	reopened, err := newFileCache(dir, time.Minute, 30, 0, 0, nil)
+	if err != nil {
+		t.Errorf("unexpected newFileCache error: %v", err)
+	}
+
+	if reopened.index.bytes != 25 {
+		t.Errorf("unexpected size on disk after reopening: want 25, got %d", reopened.index.bytes)
+	}
+}
+
+func TestFileCache_MaxEntries(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Minute, 0, 2, 0, nil)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	_ = fc.Set("a", []byte("content of a"), time.Minute)
+	_ = fc.Set("b", []byte("content of b"), time.Minute)
+
+	if _, err = fc.Get("a"); err != nil {
+		t.Errorf("unexpected cache get error: %v", err)
+	}
+
+	_ = fc.Set("c", []byte("content of c"), time.Minute)
+
+	if _, err = fc.Get("b"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected least recently used entry to be evicted, got %v", err)
+	}
+
+	if _, err = os.Stat(keyPath(dir, "b")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected evicted entry file to be removed, got %v", err)
+	}
+
+	if n := fc.Len(); n != 2 {
+		t.Errorf("unexpected number of entries: want 2, got %d", n)
+	}
+
+	reopened, err := newFileCache(dir, time.Minute, 0, 1, 0, nil)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	if n := reopened.Len(); n != 1 {
+		t.Errorf("unexpected number of entries after reopening: want 1, got %d", n)
+	}
+}
+
+func TestFileCache_OnEvict(t *testing.T) {
+	dir := createTempDir(t)
+
+	var evicted []string
+
+	fc, err := newFileCache(dir, time.Hour, 0, 2, 0, func(key string) { evicted = append(evicted, key) })
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+	defer func() { _ = fc.Close() }()
+
+	_ = fc.Set("a", []byte("content of a"), time.Minute)
+	_ = fc.Set("b", []byte("content of b"), -time.Second)
+	_ = fc.Set("c", []byte("content of c"), time.Minute)
+
+	fc.sweep(10)
+
+	if want := []string{"a", "b"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("unexpected evicted keys: want %q, got %q", want, evicted)
+	}
+
+	if err = fc.Delete("c"); err != nil {
+		t.Errorf("unexpected cache delete error: %v", err)
+	}
+
+	if len(evicted) != 2 {
+		t.Errorf("unexpected eviction reported for a deleted entry: %q", evicted)
+	}
+}
+
+func TestFileCache_Vacuum(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, 100*time.Millisecond, 0, 0, 0, nil)
+	if err != nil {
+		t.Errorf("unexpected newFileCache error: %v", err)
+	}
+
+	if err = fc.Set(testCacheKey, []byte("some content"), time.Second); err != nil {
+		t.Errorf("unexpected cache set error: %v", err)
+	}
+
+	p := keyPath(dir, testCacheKey)
+	if _, err = os.Stat(p); err != nil {
+		t.Fatalf("expected entry file at %s: %v", p, err)
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+
+	if _, err = os.Stat(p); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected expired entry file to be removed, got %v", err)
+	}
+}
+
+func TestFileCache_Sweep(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Hour, 0, 0, 2, nil)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+	defer func() { _ = fc.Close() }()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err = fc.Set(key, []byte("content of "+key), time.Second); err != nil {
+			t.Errorf("unexpected cache set error: %v", err)
+		}
+	}
+
+	if err = fc.Set("d", []byte("content of d"), time.Hour); err != nil {
+		t.Errorf("unexpected cache set error: %v", err)
+	}
+
+	time.Sleep(2 * time.Second)
+
+	// Each sweep checks half of the entries.
+	fc.sweep(2)
+
+	if n := fc.Len(); n < 2 {
+		t.Errorf("unexpected number of entries after one sweep: want at least 2, got %d", n)
+	}
+
+	fc.sweep(2)
+
+	if n := fc.Len(); n != 1 {
+		t.Errorf("unexpected number of entries: want 1, got %d", n)
+	}
+
+	if _, err = fc.Get("d"); err != nil {
+		t.Errorf("unexpected cache get error: %v", err)
+	}
+}
+
+func TestFileCache_ExpiresAcrossRestart(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Hour, 0, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	if err = fc.Set(testCacheKey, []byte("some content"), time.Second); err != nil {
+		t.Errorf("unexpected cache set error: %v", err)
+	}
+
+	if err = fc.Close(); err != nil {
+		t.Errorf("unexpected close error: %v", err)
+	}
+
+	time.Sleep(2 * time.Second)
+
+	fc, err = newFileCache(dir, time.Hour, 0, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+	defer func() { _ = fc.Close() }()
+
+	if _, err = os.Stat(keyPath(dir, testCacheKey)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected entry expired before the restart to be removed, got %v", err)
+	}
+
+	if n := fc.Len(); n != 0 {
+		t.Errorf("unexpected number of entries: want 0, got %d", n)
+	}
+}
+
+func TestFileCache_Close(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, 100*time.Millisecond, 0, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+
+	if err = fc.Set(testCacheKey, []byte("some content"), time.Second); err != nil {
+		t.Errorf("unexpected cache set error: %v", err)
+	}
+
+	if err = fc.Close(); err != nil {
+		t.Errorf("unexpected close error: %v", err)
+	}
+
+	if err = fc.Close(); err != nil {
+		t.Errorf("unexpected error closing twice: %v", err)
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+
+	if _, err = os.Stat(keyPath(dir, testCacheKey)); err != nil {
+		t.Errorf("expected entry file to be left once closed, got %v", err)
+	}
+}
+
+func TestFileCache_ConcurrentVacuum(t *testing.T) {
+	dir := createTempDir(t)
+
+	caches := make([]*fileCache, 2)
+	for i := range caches {
+		fc, err := newFileCache(dir, time.Hour, 0, 0, 0, nil)
+		if err != nil {
+			t.Fatalf("unexpected newFileCache error: %v", err)
+		}
+		defer func() { _ = fc.Close() }()
+
+		caches[i] = fc
+	}
+
+	for i := 0; i < 50; i++ {
+		if err := caches[0].Set(fmt.Sprintf("key-%d", i), []byte("some content"), -time.Second); err != nil {
+			t.Fatalf("unexpected cache set error: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, fc := range caches {
+		wg.Add(1)
+
+		go func(fc *fileCache) {
+			defer wg.Done()
+
+			fc.removeExpired(time.Hour)
+		}(fc)
+	}
+	wg.Wait()
+
+	keys, err := caches[1].Keys("")
+	if err != nil {
+		t.Fatalf("unexpected keys error: %v", err)
+	}
+
+	if len(keys) != 0 {
+		t.Errorf("expected expired entries to be removed, got %d left", len(keys))
+	}
+}
+
+func TestFileCache_KeysConcurrentRemoval(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Hour, 0, 0, 0, nil)
+	if err != nil {
+		t.Fatalf("unexpected newFileCache error: %v", err)
+	}
+	defer func() { _ = fc.Close() }()
+
+	for i := 0; i < 200; i++ {
+		if err = fc.Set(fmt.Sprintf("key-%d", i), []byte("some content"), time.Minute); err != nil {
+			t.Fatalf("unexpected cache set error: %v", err)
+		}
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 200; i++ {
+			_ = fc.Delete(fmt.Sprintf("key-%d", i))
+		}
+	}()
+
+	for {
+		if _, err = fc.Keys(""); err != nil {
+			t.Fatalf("unexpected keys error: %v", err)
+		}
+
+		reloaded, err := newFileCache(dir, time.Hour, 0, 0, 0, nil)
+		if err != nil {
+			t.Fatalf("unexpected newFileCache error: %v", err)
+		}
+		_ = reloaded.Close()
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+	}
+}
+
+func TestKeyPath(t *testing.T) {
+	p := keyPath("/cache", testCacheKey)
+
+	rel, err := filepath.Rel("/cache", p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) != 3 || len(parts[0]) != 2 || len(parts[1]) != 2 || parts[2][:4] != parts[0]+parts[1] {
+		t.Errorf("unexpected key path: %s", p)
+	}
+
+	if keyPath("/cache", testCacheKey+"?a=b") == p {
+		t.Error("expected distinct keys to have distinct paths")
+	}
+}
+
+func TestFileCache_UnsafeKey(t *testing.T) {
+	dir := createTempDir(t)
+
+	fc, err := newFileCache(dir, time.Minute, 0, 0, 0, nil)
+	if err != nil {
+		t.Errorf("unexpected newFileCache error: %v", err)
+	}
+
+	key := "GETlocalhost/../../../etc/passwd/" + strings.Repeat("ünicode/", 64)
+
+	if err = fc.Set(key, []byte("content"), time.Minute); err != nil {
+		t.Fatalf("unexpected cache set error: %v", err)
+	}
+
+	rel, err := filepath.Rel(dir, keyPath(dir, key))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		t.Errorf("expected entry to be stored below the cache path, got %s", rel)
+	}
+
+	keys, err := fc.Keys("GETlocalhost/../")
+	if err != nil || len(keys) != 1 || keys[0] != key {
+		t.Errorf("expected original key to be kept with the entry, got %v (%v)", keys, err)
+	}
+}
+
 func TestFileCache_ConcurrentAccess(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -54,7 +656,7 @@ func TestFileCache_ConcurrentAccess(t *testing.T) {
 
 	dir := createTempDir(t)
 
-	fc, err := newFileCache(dir, time.Second)
+	fc, err := newFileCache(dir, time.Second, 0, 0, 0, nil)
 	if err != nil {
 		t.Errorf("unexpected newFileCache error: %v", err)
 	}
@@ -142,7 +744,7 @@ func TestPathMutex(t *testing.T) {
 func BenchmarkFileCache_Get(b *testing.B) {
 	dir := createTempDir(b)
 
-	fc, err := newFileCache(dir, time.Minute)
+	fc, err := newFileCache(dir, time.Minute, 0, 0, 0, nil)
 	if err != nil {
 		b.Errorf("unexpected newFileCache error: %v", err)
 	}
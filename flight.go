@@ -0,0 +1,42 @@
+package traefik_plugin_cache_by_route
+
+import "sync"
+
+// flightGroup coalesces concurrent cache misses on the same key so that only
+// one request, the leader, is forwarded to the origin at a time.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]chan struct{}
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: map[string]chan struct{}{}}
+}
+
+// join registers interest in the key. The first caller becomes the leader
+// and must call leave once done; the others wait for the returned channel to
+// be closed.
+func (g *flightGroup) join(key string) (<-chan struct{}, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if done, ok := g.calls[key]; ok {
+		return done, false
+	}
+
+	done := make(chan struct{})
+	g.calls[key] = done
+
+	return done, true
+}
+
+// leave releases the waiters of the key.
+func (g *flightGroup) leave(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if done, ok := g.calls[key]; ok {
+		close(done)
+		delete(g.calls, key)
+	}
+}
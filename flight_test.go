@@ -0,0 +1,150 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache_ServeHTTPCoalescesMisses(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("body"))
+	}
+
+	cfg := &Config{Enabled: true, Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+			rw := httptest.NewRecorder()
+
+			c.ServeHTTP(rw, req)
+
+			if body := rw.Body.String(); body != "body" {
+				t.Errorf("unexpected body: want \"body\", got: %q", body)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("unexpected origin calls: want 1, got %d", n)
+	}
+}
+
+func TestCache_ServeHTTPCancelledLeader(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+
+	started := make(chan struct{})
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-req.Context().Done()
+			return
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	leaderDone := make(chan struct{})
+
+	go func() {
+		defer close(leaderDone)
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil).WithContext(ctx)
+		c.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	<-started
+
+	followerDone := make(chan struct{})
+
+	go func() {
+		defer close(followerDone)
+
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		c.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	cancel()
+
+	select {
+	case <-followerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("follower deadlocked after leader cancellation")
+	}
+
+	<-leaderDone
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("unexpected origin calls: want 2, got %d", n)
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	g := newFlightGroup()
+
+	done, leader := g.join("key")
+	if !leader {
+		t.Fatal("expected first caller to lead")
+	}
+
+	waiting, leader := g.join("key")
+	if leader {
+		t.Fatal("expected second caller to wait")
+	}
+
+	if waiting != done {
+		t.Fatal("expected waiters to share the leader channel")
+	}
+
+	g.leave("key")
+
+	select {
+	case <-waiting:
+	default:
+		t.Error("expected waiters to be released")
+	}
+
+	if _, leader = g.join("key"); !leader {
+		t.Error("expected a new leader once released")
+	}
+}
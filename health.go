@@ -0,0 +1,114 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// healthKeyPrefix starts the keys written by health probes, within the key
+// prefix.
+const healthKeyPrefix = "health|"
+
+// healthProbeTTL bounds the lifetime of the probe entries left behind when
+// they cannot be deleted.
+const healthProbeTTL = 10 * time.Second
+
+// writeFailureThreshold is the number of consecutive failed writes after which
+// the backend is considered unable to store responses.
+const writeFailureThreshold = 3
+
+// writeFailureCooldown is how long requests are refused, when failing closed,
+// after the last failed write. Requests go through again afterwards, so that a
+// successful write can clear the failure.
+const writeFailureCooldown = 10 * time.Second
+
+// writeHealth tracks the consecutive failures of the writes to the backend.
+type writeHealth struct {
+	lastFailure int64
+	failures    int32
+}
+
+// record counts the outcome of a write, a success clearing the failures.
+func (h *writeHealth) record(err error) {
+	if err == nil {
+		atomic.StoreInt32(&h.failures, 0)
+		return
+	}
+
+	atomic.StoreInt64(&h.lastFailure, time.Now().UnixNano())
+	atomic.AddInt32(&h.failures, 1)
+}
+
+// failing reports whether the last writes all failed, recently.
+func (h *writeHealth) failing() bool {
+	if atomic.LoadInt32(&h.failures) < writeFailureThreshold {
+		return false
+	}
+
+	return time.Since(time.Unix(0, atomic.LoadInt64(&h.lastFailure))) < writeFailureCooldown
+}
+
+// failClosed reports whether cacheable requests are refused, because the
+// backend persistently fails to store responses and failOpen is not set.
+func (m *cache) failClosed() bool {
+	return !m.cfg.FailOpen && m.writes.failing()
+}
+
+// unavailable responds with a 503 to a cacheable request while the backend
+// cannot store responses, so that the outage does not go unnoticed.
+func (m *cache) unavailable(w http.ResponseWriter, r *http.Request, key string) {
+	m.log.Debugf("Refusing %s %s as the cache cannot store responses", r.Method, r.URL)
+	m.metrics.request(cacheErrorStatus)
+
+	if m.cfg.AddStatusHeader {
+		w.Header().Set(m.statusHeader, m.cacheStatus(cacheErrorStatus, nil, key))
+	}
+
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// serveHealth responds with a 200 when the backend is operational, and a 503
+// otherwise, for readiness probes.
+func (m *cache) serveHealth(w http.ResponseWriter) {
+	if err := m.probe(); err != nil {
+		m.log.Warnf("Cache backend is unhealthy: %v", err)
+		http.Error(w, "cache backend unhealthy: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// probe writes, reads back and deletes an entry of its own, so that
+// concurrent probes do not interfere.
+func (m *cache) probe() error {
+	n := atomic.AddInt32(&m.probes, 1)
+	key := m.keyConfig.prefix + healthKeyPrefix + strconv.Itoa(int(n))
+	val := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	if err := m.cache.Set(key, val, healthProbeTTL); err != nil {
+		return fmt.Errorf("error writing: %w", err)
+	}
+
+	got, err := m.cache.Get(key)
+	if err != nil {
+		return fmt.Errorf("error reading: %w", err)
+	}
+
+	if !bytes.Equal(got, val) {
+		return errors.New("read a different value than written")
+	}
+
+	if err = m.cache.Delete(key); err != nil {
+		return fmt.Errorf("error deleting: %w", err)
+	}
+
+	return nil
+}
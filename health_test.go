@@ -0,0 +1,176 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingBackend is a backend whose writes always fail, like a full disk.
+type failingBackend struct {
+	Backend
+}
+
+func (failingBackend) Set(string, []byte, time.Duration) error {
+	return errors.New("no space left on device")
+}
+
+func TestCache_ServeHTTPFailOpen(t *testing.T) {
+	tests := []struct {
+		name       string
+		failOpen   bool
+		wantStatus int
+		wantErrors int
+	}{
+		{
+			name:       "should serve from the origin when failing open",
+			failOpen:   true,
+			wantStatus: http.StatusOK,
+			wantErrors: 4,
+		},
+		{
+			name:       "should refuse requests when failing closed",
+			failOpen:   false,
+			wantStatus: http.StatusServiceUnavailable,
+			wantErrors: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				_, _ = rw.Write([]byte("body"))
+			}
+
+			cfg := &Config{
+				Enabled:     true,
+				Backend:     backendMemory,
+				MaxExpiry:   "10",
+				Cleanup:     "20",
+				FailOpen:    test.failOpen,
+				MetricsPath: "/metrics",
+			}
+
+			h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := h.(*cache)
+			c.cache = failingBackend{Backend: c.cache}
+
+			for i := 0; i < writeFailureThreshold; i++ {
+				rw := httptest.NewRecorder()
+				c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+				if rw.Code != http.StatusOK {
+					t.Fatalf("unexpected status before the threshold: want %d, got %d", http.StatusOK, rw.Code)
+				}
+			}
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+			if rw.Code != test.wantStatus {
+				t.Errorf("unexpected status: want %d, got %d", test.wantStatus, rw.Code)
+			}
+
+			rw = httptest.NewRecorder()
+			c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/metrics", nil))
+
+			if !strings.Contains(rw.Body.String(), fmt.Sprintf("cache_write_errors_total %d\n", test.wantErrors)) {
+				t.Errorf("unexpected metrics: %q", rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestWriteHealth(t *testing.T) {
+	var h writeHealth
+
+	for i := 0; i < writeFailureThreshold; i++ {
+		if h.failing() {
+			t.Fatalf("unexpected failing after %d failures", i)
+		}
+
+		h.record(errors.New("failed"))
+	}
+
+	if !h.failing() {
+		t.Error("unexpected healthy after the threshold")
+	}
+
+	h.lastFailure = time.Now().Add(-writeFailureCooldown).UnixNano()
+
+	if h.failing() {
+		t.Error("unexpected failing after the cooldown")
+	}
+
+	h.record(errors.New("failed"))
+	h.record(nil)
+
+	if h.failing() {
+		t.Error("unexpected failing after a successful write")
+	}
+}
+
+func TestCache_ServeHTTPHealth(t *testing.T) {
+	tests := []struct {
+		name       string
+		failing    bool
+		wantStatus int
+	}{
+		{
+			name:       "should report healthy backend",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "should report unwritable backend",
+			failing:    true,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+			}
+
+			cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", HealthPath: "/healthz"}
+
+			h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := h.(*cache)
+			if test.failing {
+				c.cache = failingBackend{Backend: c.cache}
+			}
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/healthz", nil))
+
+			if rw.Code != test.wantStatus {
+				t.Errorf("unexpected status: want %d, got %d", test.wantStatus, rw.Code)
+			}
+
+			if calls != 0 {
+				t.Errorf("unexpected origin calls: want 0, got %d", calls)
+			}
+
+			if ec, ok := c.cache.(entryCounter); ok && ec.Len() != 0 {
+				t.Errorf("unexpected entries left by the probe: %d", ec.Len())
+			}
+		})
+	}
+}
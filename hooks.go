@@ -0,0 +1,209 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// cacheBypassStatus is the cache status of the requests traced which are
+// neither served from nor stored in the cache.
+const cacheBypassStatus = "bypass"
+
+// CacheEvent describes an entry the cache acted on.
+type CacheEvent struct {
+	// Key is the key of the entry in the backend.
+	Key string
+	// Method and URL are those of the request, when the event comes from one.
+	Method string
+	URL    string
+	// CacheStatus is the status of the request, such as hit or miss.
+	CacheStatus string
+	// Status is the status code of the response.
+	Status int
+	// Size is the size of the body, in bytes.
+	Size int
+	// ExpiresAt is when the entry stops being fresh.
+	ExpiresAt time.Time
+}
+
+// RequestEvent describes how the cache handled a request, for tracing.
+type RequestEvent struct {
+	// Key is the cache key of the request.
+	Key string
+	// CacheStatus is the status of the request, such as hit, stale, miss or
+	// error, or bypass for requests neither served from nor stored in the
+	// cache.
+	CacheStatus string
+	// TTL is how long the response served, or the one stored, stays fresh.
+	TTL time.Duration
+	// Start and Duration are when the cache started handling the request and
+	// for how long it did, origin included.
+	Start    time.Time
+	Duration time.Duration
+	// BackendLatency is the time spent reading from and writing to the
+	// backend.
+	BackendLatency time.Duration
+}
+
+// Hooks are callbacks observing the cache, for integrations such as custom
+// metrics or audit logs. They can only be set when creating the middleware
+// with New, not from the Traefik configuration. Any of them may be nil.
+//
+// They are called synchronously, on the request path or with the backend
+// locked, so they must not block: hand the event off to a goroutine or a
+// buffered channel for anything slow.
+type Hooks struct {
+	// OnHit is called when a response is served from the cache, fresh or
+	// stale.
+	OnHit func(CacheEvent)
+	// OnMiss is called when a request is sent to the origin, once it answered.
+	OnMiss func(CacheEvent)
+	// OnStore is called once a response is stored.
+	OnStore func(CacheEvent)
+	// OnEvict is called when an entry is purged or found corrupt, and when
+	// the memory or file backend drops it once expired or to stay within its
+	// limits. Only the key is set.
+	OnEvict func(CacheEvent)
+	// OnRequest is called once the cache handled a request, with the context
+	// of the request. It suits recording a span, as a child of that of the
+	// request, from the start and duration of the event.
+	OnRequest func(context.Context, RequestEvent)
+}
+
+type requestTraceKey struct{}
+
+// requestTrace gathers what OnRequest reports about a request.
+type requestTrace struct {
+	start   time.Time
+	key     string
+	status  string
+	ttl     time.Duration
+	backend time.Duration
+}
+
+// traceRequest returns the request with a trace in its context when OnRequest
+// is set, along with the function reporting it once the request is handled.
+func (m *cache) traceRequest(r *http.Request, key string) (*http.Request, func()) {
+	if m.cfg.Hooks.OnRequest == nil {
+		return r, func() {}
+	}
+
+	tr := &requestTrace{start: time.Now(), key: key, status: cacheBypassStatus}
+	r = r.WithContext(context.WithValue(r.Context(), requestTraceKey{}, tr))
+
+	return r, func() {
+		m.cfg.Hooks.OnRequest(r.Context(), RequestEvent{
+			Key:            tr.key,
+			CacheStatus:    tr.status,
+			TTL:            tr.ttl,
+			Start:          tr.start,
+			Duration:       time.Since(tr.start),
+			BackendLatency: tr.backend,
+		})
+	}
+}
+
+// trace returns the trace of the request, nil unless OnRequest is set.
+func (m *cache) trace(r *http.Request) *requestTrace {
+	if m.cfg.Hooks.OnRequest == nil {
+		return nil
+	}
+
+	tr, _ := r.Context().Value(requestTraceKey{}).(*requestTrace)
+
+	return tr
+}
+
+// outcome records the status of the request, and the expiry of the response
+// served if any.
+func (tr *requestTrace) outcome(status string, expiresAt time.Time) {
+	if tr == nil {
+		return
+	}
+
+	tr.status = status
+	tr.setTTL(expiresAt)
+}
+
+// setTTL records how long the response served or stored stays fresh.
+func (tr *requestTrace) setTTL(expiresAt time.Time) {
+	if tr == nil {
+		return
+	}
+
+	tr.ttl = 0
+	if ttl := time.Until(expiresAt); ttl > 0 {
+		tr.ttl = ttl
+	}
+}
+
+// backendSince adds the time elapsed since start to the backend latency.
+func (tr *requestTrace) backendSince(start time.Time) {
+	if tr != nil {
+		tr.backend += time.Since(start)
+	}
+}
+
+func (m *cache) hookHit(r *http.Request, data *cacheData, cs string) {
+	if m.cfg.Hooks.OnHit == nil {
+		return
+	}
+
+	m.cfg.Hooks.OnHit(CacheEvent{
+		Key:         m.requestKey(r),
+		Method:      r.Method,
+		URL:         r.URL.String(),
+		CacheStatus: cs,
+		Status:      data.Status,
+		Size:        data.Size,
+		ExpiresAt:   data.ExpiresAt,
+	})
+}
+
+func (m *cache) hookMiss(key string, r *http.Request, cs string, status, size int) {
+	if m.cfg.Hooks.OnMiss == nil {
+		return
+	}
+
+	m.cfg.Hooks.OnMiss(CacheEvent{
+		Key:         key,
+		Method:      r.Method,
+		URL:         r.URL.String(),
+		CacheStatus: cs,
+		Status:      status,
+		Size:        size,
+	})
+}
+
+func (m *cache) hookStore(key string, r *http.Request, data *cacheData) {
+	if m.cfg.Hooks.OnStore == nil {
+		return
+	}
+
+	m.cfg.Hooks.OnStore(CacheEvent{
+		Key:       key,
+		Method:    r.Method,
+		URL:       r.URL.String(),
+		Status:    data.Status,
+		Size:      data.Size,
+		ExpiresAt: data.ExpiresAt,
+	})
+}
+
+func (m *cache) hookEvict(key string) {
+	if m.cfg.Hooks.OnEvict != nil {
+		m.cfg.Hooks.OnEvict(CacheEvent{Key: key})
+	}
+}
+
+// evictHook adapts OnEvict to the backends reporting the entries they drop.
+func evictHook(hooks Hooks) func(string) {
+	if hooks.OnEvict == nil {
+		return nil
+	}
+
+	return func(key string) {
+		hooks.OnEvict(CacheEvent{Key: key})
+	}
+}
@@ -0,0 +1,223 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCache_ServeHTTPHooks(t *testing.T) {
+	tests := []struct {
+		name       string
+		backend    string
+		maxEntries int
+		requests   []*http.Request
+		wantEvents []string
+	}{
+		{
+			name: "should report miss, store and hit",
+			requests: []*http.Request{
+				httptest.NewRequest(http.MethodGet, "http://localhost/a", nil),
+				httptest.NewRequest(http.MethodGet, "http://localhost/a", nil),
+			},
+			wantEvents: []string{"miss:miss:200", "store:200", "hit:hit:200"},
+		},
+		{
+			name: "should report invalidated entries",
+			requests: []*http.Request{
+				httptest.NewRequest(http.MethodGet, "http://localhost/a", nil),
+				httptest.NewRequest(http.MethodPut, "http://localhost/a", nil),
+			},
+			wantEvents: []string{"miss:miss:200", "store:200", "evict"},
+		},
+		{
+			name:       "should report entries dropped by the backend",
+			maxEntries: 1,
+			requests: []*http.Request{
+				httptest.NewRequest(http.MethodGet, "http://localhost/a", nil),
+				httptest.NewRequest(http.MethodGet, "http://localhost/b", nil),
+			},
+			wantEvents: []string{"miss:miss:200", "store:200", "miss:miss:200", "evict", "store:200"},
+		},
+		{
+			name:       "should report entries dropped by the file backend",
+			backend:    backendFile,
+			maxEntries: 1,
+			requests: []*http.Request{
+				httptest.NewRequest(http.MethodGet, "http://localhost/a", nil),
+				httptest.NewRequest(http.MethodGet, "http://localhost/b", nil),
+			},
+			wantEvents: []string{"miss:miss:200", "store:200", "miss:miss:200", "evict", "store:200"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=5")
+				_, _ = rw.Write([]byte("body"))
+			}
+
+			var (
+				mu     sync.Mutex
+				events []string
+			)
+			record := func(event string) func(CacheEvent) {
+				return func(e CacheEvent) {
+					mu.Lock()
+					defer mu.Unlock()
+
+					if e.Key == "" {
+						t.Errorf("unexpected empty key for %s event", event)
+					}
+					got := event
+					if e.CacheStatus != "" {
+						got += ":" + e.CacheStatus
+					}
+					if e.Status != 0 {
+						got += ":" + strconv.Itoa(e.Status)
+					}
+					events = append(events, got)
+				}
+			}
+
+			backend := test.backend
+			if backend == "" {
+				backend = backendMemory
+			}
+
+			cfg := &Config{
+				Enabled:           true,
+				Backend:           backend,
+				Path:              createTempDir(t),
+				MaxExpiry:         "10",
+				Cleanup:           "20",
+				MaxEntries:        test.maxEntries,
+				InvalidateOnWrite: true,
+				Hooks: Hooks{
+					OnHit:   record("hit"),
+					OnMiss:  record("miss"),
+					OnStore: record("store"),
+					OnEvict: record("evict"),
+				},
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, req := range test.requests {
+				c.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			if !reflect.DeepEqual(events, test.wantEvents) {
+				t.Errorf("unexpected events: want %q, got %q", test.wantEvents, events)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPNoHooks(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=5")
+		_, _ = rw.Write([]byte("body"))
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", MaxEntries: 1, InvalidateOnWrite: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "http://localhost/a", nil),
+		httptest.NewRequest(http.MethodGet, "http://localhost/a", nil),
+		httptest.NewRequest(http.MethodGet, "http://localhost/b", nil),
+		httptest.NewRequest(http.MethodPut, "http://localhost/b", nil),
+	} {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusOK {
+			t.Errorf("unexpected status: want %d, got: %d", http.StatusOK, rw.Code)
+		}
+	}
+}
+
+func TestCache_ServeHTTPOnRequest(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=5")
+		_, _ = rw.Write([]byte("body"))
+	}
+
+	type spanKey struct{}
+
+	var events []RequestEvent
+
+	cfg := &Config{
+		Enabled:   true,
+		Backend:   backendMemory,
+		MaxExpiry: "10",
+		Cleanup:   "20",
+		Hooks: Hooks{
+			OnRequest: func(ctx context.Context, e RequestEvent) {
+				if ctx.Value(spanKey{}) != "parent" {
+					t.Error("unexpected context without the span of the request")
+				}
+				events = append(events, e)
+			},
+		},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cc := range []string{"", "", "no-store"} {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/a", nil)
+		req = req.WithContext(context.WithValue(req.Context(), spanKey{}, "parent"))
+		if cc != "" {
+			req.Header.Set("Cache-Control", cc)
+		}
+
+		c.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	wantStatuses := []string{cacheMissStatus, cacheHitStatus, cacheBypassStatus}
+	if len(events) != len(wantStatuses) {
+		t.Fatalf("unexpected events: want %d, got %d", len(wantStatuses), len(events))
+	}
+
+	for i, e := range events {
+		if e.CacheStatus != wantStatuses[i] {
+			t.Errorf("unexpected cache status of event %d: want %q, got: %q", i, wantStatuses[i], e.CacheStatus)
+		}
+
+		if e.Key != "GETlocalhost/a" {
+			t.Errorf("unexpected key of event %d: want %q, got: %q", i, "GETlocalhost/a", e.Key)
+		}
+
+		if e.Start.IsZero() || e.Duration < e.BackendLatency {
+			t.Errorf("unexpected timing of event %d: %+v", i, e)
+		}
+	}
+
+	// The miss stores the response and the hit serves it.
+	for i, e := range events[:2] {
+		if e.TTL <= 4*time.Second || e.TTL > 5*time.Second {
+			t.Errorf("unexpected TTL of event %d: %v", i, e.TTL)
+		}
+
+		if e.BackendLatency <= 0 {
+			t.Errorf("unexpected backend latency of event %d: %v", i, e.BackendLatency)
+		}
+	}
+}
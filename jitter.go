@@ -0,0 +1,34 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// lockedRand is a source of random numbers safe for concurrent use.
+type lockedRand struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rnd: rand.New(rand.NewSource(seed))} // nolint:gosec // not security sensitive
+}
+
+func (r *lockedRand) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.rnd.Float64()
+}
+
+// jitter randomly shortens the expiry by up to the configured fraction, so
+// that entries stored together do not all expire at the same instant.
+func (m *cache) jitter(expiry time.Duration) time.Duration {
+	if m.cfg.TTLJitter <= 0 {
+		return expiry
+	}
+
+	return expiry - time.Duration(float64(expiry)*m.cfg.TTLJitter*m.random())
+}
@@ -0,0 +1,54 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache_Jitter(t *testing.T) {
+	tests := []struct {
+		name   string
+		jitter float64
+		random float64
+		want   time.Duration
+	}{
+		{
+			name: "should keep expiry without jitter",
+			want: 100 * time.Second,
+		},
+		{
+			name:   "should shorten expiry within jitter band",
+			jitter: 0.2,
+			random: 0.5,
+			want:   90 * time.Second,
+		},
+		{
+			name:   "should keep expiry for lowest random value",
+			jitter: 0.2,
+			want:   100 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &cache{
+				cfg:    &Config{TTLJitter: test.jitter},
+				random: func() float64 { return test.random },
+			}
+
+			if got := m.jitter(100 * time.Second); got != test.want {
+				t.Errorf("unexpected expiry: want %v, got: %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestLockedRand(t *testing.T) {
+	a, b := newLockedRand(42), newLockedRand(42)
+
+	for i := 0; i < 10; i++ {
+		if x, y := a.Float64(), b.Float64(); x != y {
+			t.Fatalf("expected seeded sources to agree, got %v and %v", x, y)
+		}
+	}
+}
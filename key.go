@@ -0,0 +1,218 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// CacheKey selects the parts of the request making up its cache key.
+type CacheKey struct {
+	Method  bool     `json:"method" yaml:"method" toml:"method"`
+	Scheme  bool     `json:"scheme" yaml:"scheme" toml:"scheme"`
+	Host    bool     `json:"host" yaml:"host" toml:"host"`
+	Path    bool     `json:"path" yaml:"path" toml:"path"`
+	Query   bool     `json:"query" yaml:"query" toml:"query"`
+	Headers []string `json:"headers" yaml:"headers" toml:"headers"`
+
+	// prefix starts every key, set from the keyPrefix option.
+	prefix string
+	// bustHeader ends the key of requests carrying it with its value, set
+	// from the cacheKeyHeader option.
+	bustHeader string
+	// trustedProxies are the networks whose forwarded headers describe the
+	// client-facing origin, set from the trustedProxies option.
+	trustedProxies []*net.IPNet
+	// lowercasePath and trimTrailingSlash normalize the path, set from the
+	// options of the same name.
+	lowercasePath     bool
+	trimTrailingSlash bool
+	// ignoreParams are the query parameters left out of the key, set from
+	// the ignoreQueryParams option or that of the matching route.
+	ignoreParams map[string]struct{}
+}
+
+// defaultCacheKey keys requests by method, host, path and query.
+var defaultCacheKey = CacheKey{Method: true, Host: true, Path: true, Query: true}
+
+// keyConfig returns the cache key configuration, defaulting when no part is
+// selected.
+func keyConfig(cfg *Config) (CacheKey, error) {
+	k := cfg.CacheKey
+	if !k.Method && !k.Scheme && !k.Host && !k.Path && !k.Query && len(k.Headers) == 0 {
+		k = defaultCacheKey
+	}
+
+	if cfg.IgnoreQueryString {
+		k.Query = false
+	}
+
+	headers := make([]string, 0, len(k.Headers))
+	for _, name := range k.Headers {
+		headers = append(headers, http.CanonicalHeaderKey(name))
+	}
+	k.Headers = headers
+	k.prefix = cfg.KeyPrefix
+	k.bustHeader = http.CanonicalHeaderKey(cfg.CacheKeyHeader)
+	k.lowercasePath = cfg.LowercasePathKey
+	k.trimTrailingSlash = cfg.TrimTrailingSlash
+	k.ignoreParams = paramSet(cfg.IgnoreQueryParams)
+
+	trusted, err := parseIPNets(cfg.TrustedProxies, "trusted proxies")
+	if err != nil {
+		return CacheKey{}, err
+	}
+	k.trustedProxies = trusted
+
+	return k, nil
+}
+
+// cacheKey returns the key of the request, made of the selected parts.
+func cacheKey(r *http.Request, k CacheKey) string {
+	key := keyOrigin(r, k)
+
+	if k.Path {
+		key += k.path(r.URL.Path)
+	}
+
+	if k.Query && r.URL.RawQuery != "" {
+		key += k.query(r)
+	}
+
+	for _, name := range k.Headers {
+		key += "|" + name + "=" + strings.Join(r.Header.Values(name), ",")
+	}
+
+	if k.bustHeader != "" {
+		if v := r.Header.Get(k.bustHeader); v != "" {
+			key += "|" + k.bustHeader + "=" + v
+		}
+	}
+
+	return key
+}
+
+// query returns the query string of the key, without the ignored parameters.
+// Encode sorts by parameter name so that equivalent queries share a key.
+func (k CacheKey) query(r *http.Request) string {
+	q := r.URL.Query()
+	for name := range k.ignoreParams {
+		q.Del(name)
+	}
+
+	if len(q) == 0 {
+		return ""
+	}
+
+	return "?" + q.Encode()
+}
+
+// paramSet returns the set of the named query parameters, nil when empty.
+func paramSet(names []string) map[string]struct{} {
+	if len(names) == 0 {
+		return nil
+	}
+
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[name] = struct{}{}
+	}
+
+	return set
+}
+
+// keyFor returns the key configuration for the request, with the ignored
+// query parameters of its route if it sets any.
+func (m *cache) keyFor(r *http.Request) CacheKey {
+	k := m.keyConfig
+	if len(m.routes) == 0 {
+		return k
+	}
+
+	if rt := m.route(r); rt != nil && rt.ignoreParams != nil {
+		k.ignoreParams = rt.ignoreParams
+	}
+
+	return k
+}
+
+// path returns the path normalized for the key, lowercased or without its
+// trailing slash when enabled. The root path is kept as it is.
+func (k CacheKey) path(p string) string {
+	if k.lowercasePath {
+		p = strings.ToLower(p)
+	}
+
+	if k.trimTrailingSlash && len(p) > 1 {
+		p = strings.TrimRight(p, "/")
+		if p == "" {
+			p = "/"
+		}
+	}
+
+	return p
+}
+
+// keyOrigin returns the start of the key of the request, preceding its path.
+func keyOrigin(r *http.Request, k CacheKey) string {
+	key := k.prefix
+
+	if k.Method {
+		key += r.Method
+	}
+
+	if k.Scheme {
+		key += k.scheme(r) + "://"
+	}
+
+	if k.Host {
+		key += k.host(r)
+	}
+
+	return key
+}
+
+// trusts reports whether the request comes from one of the trusted proxies.
+func (k CacheKey) trusts(r *http.Request) bool {
+	return len(k.trustedProxies) > 0 && remoteAddrIn(r, k.trustedProxies)
+}
+
+// host returns the host the client requested, forwarded by a trusted proxy.
+func (k CacheKey) host(r *http.Request) string {
+	if k.trusts(r) {
+		if fh := lastForwarded(r.Header, "X-Forwarded-Host"); fh != "" {
+			return fh
+		}
+	}
+
+	return r.Host
+}
+
+// scheme returns the scheme the client used for the request. Without trusted
+// proxies, X-Forwarded-Proto is used as set by Traefik, otherwise only when
+// forwarded by one of them.
+func (k CacheKey) scheme(r *http.Request) string {
+	if len(k.trustedProxies) == 0 || k.trusts(r) {
+		if proto := lastForwarded(r.Header, "X-Forwarded-Proto"); proto != "" {
+			return proto
+		}
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// lastForwarded returns the last value of a forwarded header, set by the
+// proxy closest to Traefik. The values before it come from further away, up
+// to the client, which may have sent any.
+func lastForwarded(h http.Header, name string) string {
+	v := strings.Join(h.Values(name), ",")
+	if i := strings.LastIndexByte(v, ','); i >= 0 {
+		v = v[i+1:]
+	}
+
+	return strings.TrimSpace(v)
+}
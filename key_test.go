@@ -0,0 +1,247 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCacheKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		header http.Header
+		cfg    *Config
+		want   string
+	}{
+		{
+			name: "should use path without query",
+			url:  "http://localhost/some/path",
+			cfg:  &Config{},
+			want: "GETlocalhost/some/path",
+		},
+		{
+			name: "should include sorted query",
+			url:  "http://localhost/some/path?b=2&a=1",
+			cfg:  &Config{},
+			want: "GETlocalhost/some/path?a=1&b=2",
+		},
+		{
+			name: "should ignore query",
+			url:  "http://localhost/some/path?b=2&a=1",
+			cfg:  &Config{IgnoreQueryString: true},
+			want: "GETlocalhost/some/path",
+		},
+		{
+			name: "should ignore query params",
+			url:  "http://localhost/some/path?utm_source=x&b=2&fbclid=y",
+			cfg:  &Config{IgnoreQueryParams: []string{"utm_source", "fbclid"}},
+			want: "GETlocalhost/some/path?b=2",
+		},
+		{
+			name: "should drop query of ignored params only",
+			url:  "http://localhost/some/path?utm_source=x",
+			cfg:  &Config{IgnoreQueryParams: []string{"utm_source"}},
+			want: "GETlocalhost/some/path",
+		},
+		{
+			name: "should ignore host",
+			url:  "http://localhost/some/path",
+			cfg:  &Config{CacheKey: CacheKey{Method: true, Path: true}},
+			want: "GET/some/path",
+		},
+		{
+			name:   "should include scheme",
+			url:    "http://localhost/some/path",
+			header: http.Header{"X-Forwarded-Proto": {"https"}},
+			cfg:    &Config{CacheKey: CacheKey{Scheme: true, Host: true, Path: true}},
+			want:   "https://localhost/some/path",
+		},
+		{
+			name:   "should include headers",
+			url:    "http://localhost/some/path",
+			header: http.Header{"X-Tenant": {"acme"}},
+			cfg:    &Config{CacheKey: CacheKey{Method: true, Host: true, Path: true, Headers: []string{"x-tenant", "X-Region"}}},
+			want:   "GETlocalhost/some/path|X-Tenant=acme|X-Region=",
+		},
+		{
+			name: "should prepend prefix",
+			url:  "http://localhost/some/path",
+			cfg:  &Config{KeyPrefix: "app1|"},
+			want: "app1|GETlocalhost/some/path",
+		},
+		{
+			name:   "should append cache key header",
+			url:    "http://localhost/some/path",
+			header: http.Header{"X-Cache-Bust": {"run-42"}},
+			cfg:    &Config{CacheKeyHeader: "x-cache-bust"},
+			want:   "GETlocalhost/some/path|X-Cache-Bust=run-42",
+		},
+		{
+			name: "should ignore missing cache key header",
+			url:  "http://localhost/some/path",
+			cfg:  &Config{CacheKeyHeader: "X-Cache-Bust"},
+			want: "GETlocalhost/some/path",
+		},
+		{
+			name: "should keep path case and trailing slash",
+			url:  "http://localhost/Products/",
+			cfg:  &Config{},
+			want: "GETlocalhost/Products/",
+		},
+		{
+			name: "should lowercase path",
+			url:  "http://localhost/Products/?Q=1",
+			cfg:  &Config{LowercasePathKey: true},
+			want: "GETlocalhost/products/?Q=1",
+		},
+		{
+			name: "should trim trailing slash",
+			url:  "http://localhost/Products//",
+			cfg:  &Config{TrimTrailingSlash: true},
+			want: "GETlocalhost/Products",
+		},
+		{
+			name: "should keep root path",
+			url:  "http://localhost/",
+			cfg:  &Config{TrimTrailingSlash: true},
+			want: "GETlocalhost/",
+		},
+		{
+			name: "should lowercase path and trim trailing slash",
+			url:  "http://localhost/Products/",
+			cfg:  &Config{LowercasePathKey: true, TrimTrailingSlash: true},
+			want: "GETlocalhost/products",
+		},
+		{
+			name:   "should use forwarded headers from trusted proxies",
+			url:    "http://localhost/some/path",
+			header: http.Header{"X-Forwarded-Host": {"shop.example.com"}, "X-Forwarded-Proto": {"https"}},
+			cfg:    &Config{CacheKey: CacheKey{Scheme: true, Host: true, Path: true}, TrustedProxies: []string{"192.0.2.0/24"}},
+			want:   "https://shop.example.com/some/path",
+		},
+		{
+			name:   "should ignore forwarded host spoofed by the client",
+			url:    "http://localhost/some/path",
+			header: http.Header{"X-Forwarded-Host": {"victim.example.com, shop.example.com"}, "X-Forwarded-Proto": {"http, https"}},
+			cfg:    &Config{CacheKey: CacheKey{Scheme: true, Host: true, Path: true}, TrustedProxies: []string{"192.0.2.0/24"}},
+			want:   "https://shop.example.com/some/path",
+		},
+		{
+			name:   "should ignore forwarded host spoofed in another header line",
+			url:    "http://localhost/some/path",
+			header: http.Header{"X-Forwarded-Host": {"victim.example.com", "shop.example.com"}},
+			cfg:    &Config{CacheKey: CacheKey{Host: true, Path: true}, TrustedProxies: []string{"192.0.2.0/24"}},
+			want:   "shop.example.com/some/path",
+		},
+		{
+			name:   "should ignore forwarded headers from other clients",
+			url:    "http://localhost/some/path",
+			header: http.Header{"X-Forwarded-Host": {"shop.example.com"}, "X-Forwarded-Proto": {"https"}},
+			cfg:    &Config{CacheKey: CacheKey{Scheme: true, Host: true, Path: true}, TrustedProxies: []string{"10.0.0.1"}},
+			want:   "http://localhost/some/path",
+		},
+		{
+			name:   "should ignore forwarded host without trusted proxies",
+			url:    "http://localhost/some/path",
+			header: http.Header{"X-Forwarded-Host": {"shop.example.com"}},
+			cfg:    &Config{},
+			want:   "GETlocalhost/some/path",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			for k, v := range test.header {
+				req.Header[k] = v
+			}
+
+			kc, err := keyConfig(test.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := cacheKey(req, kc); got != test.want {
+				t.Errorf("unexpected cache key: want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPIgnoreQueryParams(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       *Config
+		url       string
+		wantState string
+	}{
+		{
+			name:      "should hit without ignored param",
+			cfg:       &Config{IgnoreQueryParams: []string{"utm_source"}},
+			url:       "http://localhost/page?utm_source=x",
+			wantState: cacheHitStatus,
+		},
+		{
+			name:      "should miss with other params",
+			cfg:       &Config{IgnoreQueryParams: []string{"utm_source"}},
+			url:       "http://localhost/page?id=1",
+			wantState: cacheMissStatus,
+		},
+		{
+			name:      "should miss without ignored params",
+			cfg:       &Config{},
+			url:       "http://localhost/page?utm_source=x",
+			wantState: cacheMissStatus,
+		},
+		{
+			name: "should use params of route",
+			cfg: &Config{
+				IgnoreQueryParams: []string{"utm_source"},
+				URIs:              []Uri{{Pattern: "/page", IgnoreQueryParams: []string{"gclid"}}},
+			},
+			url:       "http://localhost/page?gclid=x",
+			wantState: cacheHitStatus,
+		},
+		{
+			name: "should replace global params with those of route",
+			cfg: &Config{
+				IgnoreQueryParams: []string{"utm_source"},
+				URIs:              []Uri{{Pattern: "/page", IgnoreQueryParams: []string{"gclid"}}},
+			},
+			url:       "http://localhost/page?utm_source=x",
+			wantState: cacheMissStatus,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=5")
+				_, _ = rw.Write([]byte("body"))
+			}
+
+			cfg := test.cfg
+			cfg.Enabled = true
+			cfg.Backend = backendMemory
+			cfg.MaxExpiry = "10"
+			cfg.Cleanup = "20"
+			cfg.AddStatusHeader = true
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/page", nil))
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, test.url, nil))
+
+			if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+				t.Errorf("unexpected cache state: want %q, got: %q", test.wantState, state)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives the messages of the middleware.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+	levelOff
+)
+
+var logLevels = map[string]int{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+	"off":   levelOff,
+}
+
+// stdLogger is a Logger writing the messages at or above its level to the
+// standard logger, prefixed with the name of the middleware.
+type stdLogger struct {
+	level  int
+	prefix string
+}
+
+// newLogger returns the logger of the named middleware for the configured
+// level, defaulting to info.
+func newLogger(level, name string) (*stdLogger, error) {
+	if level == "" {
+		level = "info"
+	}
+
+	l, ok := logLevels[strings.ToLower(level)]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+
+	return &stdLogger{level: l, prefix: "[" + name + "] "}, nil
+}
+
+// configLogger returns the Logger of the config when set, for callers using
+// the package as a library, or else the logger of the named middleware for
+// the configured level. The level is left to loggers of the config.
+func configLogger(cfg *Config, name string) (Logger, error) {
+	l, err := newLogger(cfg.LogLevel, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Logger != nil {
+		return cfg.Logger, nil
+	}
+
+	return l, nil
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) {
+	l.logf(levelDebug, "DEBUG", format, args...)
+}
+
+func (l *stdLogger) Infof(format string, args ...interface{}) {
+	l.logf(levelInfo, "INFO", format, args...)
+}
+
+func (l *stdLogger) Warnf(format string, args ...interface{}) {
+	l.logf(levelWarn, "WARN", format, args...)
+}
+
+func (l *stdLogger) Errorf(format string, args ...interface{}) {
+	l.logf(levelError, "ERROR", format, args...)
+}
+
+func (l *stdLogger) logf(level int, label, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+
+	log.Printf(l.prefix+label+" "+format, args...)
+}
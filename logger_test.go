@@ -0,0 +1,102 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	tests := []struct {
+		level string
+		want  []string
+	}{
+		{level: "debug", want: []string{"DEBUG d", "INFO i", "WARN w", "ERROR e"}},
+		{level: "", want: []string{"INFO i", "WARN w", "ERROR e"}},
+		{level: "WARN", want: []string{"WARN w", "ERROR e"}},
+		{level: "off"},
+	}
+
+	var buf bytes.Buffer
+
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, test := range tests {
+		t.Run(test.level, func(t *testing.T) {
+			buf.Reset()
+
+			l, err := newLogger(test.level, "cache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			l.Debugf("d")
+			l.Infof("i")
+			l.Warnf("w")
+			l.Errorf("e")
+
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				if i := strings.Index(line, "[cache] "); i >= 0 {
+					got = append(got, line[i+len("[cache] "):])
+				}
+			}
+
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("unexpected log lines: want %v, got: %v", test.want, got)
+			}
+		})
+	}
+
+	if _, err := newLogger("verbose", "cache"); err == nil {
+		t.Error("expected error on unknown log level")
+	}
+}
+
+// recordingLogger records the messages it receives.
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "DEBUG "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.lines = append(l.lines, "INFO "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "WARN "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.lines = append(l.lines, "ERROR "+fmt.Sprintf(format, args...))
+}
+
+func TestNew_Logger(t *testing.T) {
+	logger := &recordingLogger{}
+
+	cfg := &Config{
+		Enabled:                true,
+		Backend:                backendMemory,
+		MaxExpiry:              "10",
+		Cleanup:                "20",
+		SkipCacheControlHeader: true,
+		Logger:                 logger,
+	}
+
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "cache"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logger.lines) != 1 || !strings.HasPrefix(logger.lines[0], "WARN Nothing will be cached") {
+		t.Errorf("unexpected log lines: %q", logger.lines)
+	}
+}
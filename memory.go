@@ -0,0 +1,148 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backendMemory = "memory"
+
+type memoryEntry struct {
+	key       string
+	val       []byte
+	expiresAt time.Time
+}
+
+// memoryCache is an in-memory backend evicting the least recently used
+// entries once its entry or byte limits are exceeded. A zero limit is
+// unbounded.
+type memoryCache struct {
+	maxEntries int
+	maxBytes   int
+	// onEvict, when set, is called with the keys dropped once expired or to
+	// stay within the limits.
+	onEvict func(key string)
+
+	mu    sync.Mutex
+	bytes int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newMemoryCache(maxEntries, maxBytes int, onEvict func(key string)) *memoryCache {
+	return &memoryCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		onEvict:    onEvict,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+func (c *memoryCache) Get(key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+
+	e := el.Value.(*memoryEntry)
+	if e.expiresAt.Before(time.Now()) {
+		c.remove(el)
+		c.evicted(key)
+		return nil, ErrCacheMiss
+	}
+
+	c.ll.MoveToFront(el)
+
+	return e.val, nil
+}
+
+func (c *memoryCache) Set(key string, val []byte, expiry time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+
+	e := &memoryEntry{key: key, val: val, expiresAt: time.Now().Add(expiry)}
+	c.items[key] = c.ll.PushFront(e)
+	c.bytes += len(val)
+
+	for c.overLimit() {
+		victim := c.ll.Back()
+		c.remove(victim)
+		c.evicted(victim.Value.(*memoryEntry).key)
+	}
+
+	return nil
+}
+
+func (c *memoryCache) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return ErrCacheMiss
+	}
+
+	c.remove(el)
+
+	return nil
+}
+
+func (c *memoryCache) Keys(prefix string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var keys []string
+	for key := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// Close does nothing, the memory backend having no background work.
+func (c *memoryCache) Close() error {
+	return nil
+}
+
+// Len returns the number of entries held, including expired ones not yet
+// evicted.
+func (c *memoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+func (c *memoryCache) overLimit() bool {
+	if c.ll.Len() == 0 {
+		return false
+	}
+
+	return (c.maxEntries > 0 && c.ll.Len() > c.maxEntries) ||
+		(c.maxBytes > 0 && c.bytes > c.maxBytes)
+}
+
+func (c *memoryCache) remove(el *list.Element) {
+	e := c.ll.Remove(el).(*memoryEntry)
+	delete(c.items, e.key)
+	c.bytes -= len(e.val)
+}
+
+// evicted reports the key dropped by the backend, when asked to.
+func (c *memoryCache) evicted(key string) {
+	if c.onEvict != nil {
+		c.onEvict(key)
+	}
+}
@@ -0,0 +1,101 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryCache(t *testing.T) {
+	mc := newMemoryCache(0, 0, nil)
+
+	_, err := mc.Get(testCacheKey)
+	if !errors.Is(err, ErrCacheMiss) {
+		t.Error("unexpected cache content")
+	}
+
+	cacheContent := []byte("some random cache content that should be exact")
+
+	if err = mc.Set(testCacheKey, cacheContent, time.Second); err != nil {
+		t.Errorf("unexpected cache set error: %v", err)
+	}
+
+	got, err := mc.Get(testCacheKey)
+	if err != nil {
+		t.Errorf("unexpected cache get error: %v", err)
+	}
+
+	if !bytes.Equal(got, cacheContent) {
+		t.Errorf("unexpected cache content: want %s, got %s", cacheContent, got)
+	}
+
+	if err = mc.Delete(testCacheKey); err != nil {
+		t.Errorf("unexpected cache delete error: %v", err)
+	}
+
+	if err = mc.Delete(testCacheKey); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("unexpected cache delete error: want %v, got %v", ErrCacheMiss, err)
+	}
+}
+
+func TestMemoryCache_Expiry(t *testing.T) {
+	mc := newMemoryCache(0, 0, nil)
+
+	_ = mc.Set(testCacheKey, []byte("content"), -time.Second)
+
+	if _, err := mc.Get(testCacheKey); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("unexpected cache get error: want %v, got %v", ErrCacheMiss, err)
+	}
+
+	if mc.bytes != 0 {
+		t.Errorf("unexpected byte count: want 0, got %d", mc.bytes)
+	}
+}
+
+func TestMemoryCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		maxBytes   int
+	}{
+		{
+			name:       "should evict on max entries",
+			maxEntries: 2,
+		},
+		{
+			name:     "should evict on max bytes",
+			maxBytes: 8,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mc := newMemoryCache(test.maxEntries, test.maxBytes, nil)
+
+			_ = mc.Set("a", []byte("aaaa"), time.Minute)
+			_ = mc.Set("b", []byte("bbbb"), time.Minute)
+
+			// Touch a so that b becomes the least recently used entry.
+			if _, err := mc.Get("a"); err != nil {
+				t.Fatalf("unexpected cache get error: %v", err)
+			}
+
+			_ = mc.Set("c", []byte("cccc"), time.Minute)
+
+			if _, err := mc.Get("b"); !errors.Is(err, ErrCacheMiss) {
+				t.Error("expected b to be evicted")
+			}
+
+			for _, key := range []string{"a", "c"} {
+				if _, err := mc.Get(key); err != nil {
+					t.Errorf("unexpected eviction of %s: %v", key, err)
+				}
+			}
+
+			if mc.bytes != 8 {
+				t.Errorf("unexpected byte count: want 8, got %d", mc.bytes)
+			}
+		})
+	}
+}
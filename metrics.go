@@ -0,0 +1,133 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// originBuckets are the upper bounds, in seconds, of the origin fetch latency
+// histogram.
+var originBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricStatuses lists the cache statuses reported, in exposition order. It
+// bounds the cardinality of the status label.
+var metricStatuses = []string{cacheHitStatus, cacheMissStatus, cacheStaleStatus, cacheStaleErrorStatus, cacheErrorStatus}
+
+// entryCounter is implemented by backends able to report their entry count.
+type entryCounter interface {
+	Len() int
+}
+
+// metrics collects the cache metrics exposed in the Prometheus text format.
+type metrics struct {
+	mu          sync.Mutex
+	requests    map[string]uint64
+	shadow      map[string]uint64
+	buckets     []uint64
+	originSum   float64
+	originCount uint64
+	writeErrors uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: map[string]uint64{},
+		shadow:   map[string]uint64{},
+		buckets:  make([]uint64, len(originBuckets)),
+	}
+}
+
+// request counts a request served with the given cache status. Empty statuses,
+// used by background requests, are ignored.
+func (m *metrics) request(status string) {
+	if status == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[status]++
+}
+
+// shadowRequest counts a request handled in shadow mode with the cache status
+// it would have had.
+func (m *metrics) shadowRequest(status string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.shadow[status]++
+}
+
+// writeError counts a response the backend failed to store.
+func (m *metrics) writeError() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.writeErrors++
+}
+
+// observeOrigin records the latency of an origin fetch.
+func (m *metrics) observeOrigin(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := d.Seconds()
+	for i, le := range originBuckets {
+		if s <= le {
+			m.buckets[i]++
+		}
+	}
+	m.originSum += s
+	m.originCount++
+}
+
+func (m *metrics) write(w io.Writer, backend Backend) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, _ = fmt.Fprintln(w, "# HELP cache_requests_total Requests handled by the cache, by cache status.")
+	_, _ = fmt.Fprintln(w, "# TYPE cache_requests_total counter")
+	for _, status := range metricStatuses {
+		_, _ = fmt.Fprintf(w, "cache_requests_total{status=%q} %d\n", status, m.requests[status])
+	}
+
+	if len(m.shadow) > 0 {
+		_, _ = fmt.Fprintln(w, "# HELP cache_shadow_requests_total Requests handled in shadow mode, by the cache status they would have had.")
+		_, _ = fmt.Fprintln(w, "# TYPE cache_shadow_requests_total counter")
+		for _, status := range metricStatuses {
+			_, _ = fmt.Fprintf(w, "cache_shadow_requests_total{status=%q} %d\n", status, m.shadow[status])
+		}
+	}
+
+	_, _ = fmt.Fprintln(w, "# HELP cache_write_errors_total Responses the backend failed to store.")
+	_, _ = fmt.Fprintln(w, "# TYPE cache_write_errors_total counter")
+	_, _ = fmt.Fprintf(w, "cache_write_errors_total %d\n", m.writeErrors)
+
+	if ec, ok := backend.(entryCounter); ok {
+		_, _ = fmt.Fprintln(w, "# HELP cache_entries Entries currently stored in the cache.")
+		_, _ = fmt.Fprintln(w, "# TYPE cache_entries gauge")
+		_, _ = fmt.Fprintf(w, "cache_entries %d\n", ec.Len())
+	}
+
+	_, _ = fmt.Fprintln(w, "# HELP cache_origin_duration_seconds Latency of origin fetches on cache misses.")
+	_, _ = fmt.Fprintln(w, "# TYPE cache_origin_duration_seconds histogram")
+	for i, le := range originBuckets {
+		_, _ = fmt.Fprintf(w, "cache_origin_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(le, 'g', -1, 64), m.buckets[i])
+	}
+	_, _ = fmt.Fprintf(w, "cache_origin_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.originCount)
+	_, _ = fmt.Fprintf(w, "cache_origin_duration_seconds_sum %s\n", strconv.FormatFloat(m.originSum, 'g', -1, 64))
+	_, _ = fmt.Fprintf(w, "cache_origin_duration_seconds_count %d\n", m.originCount)
+}
+
+// serveMetrics writes the metrics of the cache.
+func (m *cache) serveMetrics(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	m.metrics.write(w, m.cache)
+}
@@ -0,0 +1,72 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCache_ServeHTTPMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+	}{
+		{
+			name:    "should report memory backend metrics",
+			backend: backendMemory,
+		},
+		{
+			name:    "should report file backend metrics",
+			backend: backendFile,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{
+				Enabled:     true,
+				Backend:     test.backend,
+				Path:        createTempDir(t),
+				MaxExpiry:   "10",
+				Cleanup:     "20",
+				MetricsPath: "/metrics",
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 3; i++ {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+				c.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/metrics", nil)
+			rw := httptest.NewRecorder()
+
+			c.ServeHTTP(rw, req)
+
+			body := rw.Body.String()
+			for _, want := range []string{
+				`cache_requests_total{status="hit"} 2`,
+				`cache_requests_total{status="miss"} 1`,
+				`cache_requests_total{status="error"} 0`,
+				`cache_entries 1`,
+				`cache_origin_duration_seconds_bucket{le="+Inf"} 1`,
+				`cache_origin_duration_seconds_count 1`,
+			} {
+				if !strings.Contains(body, want) {
+					t.Errorf("missing metric %q in:\n%s", want, body)
+				}
+			}
+		})
+	}
+}
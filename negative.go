@@ -0,0 +1,47 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// defaultNegativeStatuses are the statuses negatively cached when none are
+// configured.
+var defaultNegativeStatuses = []int{http.StatusNotFound}
+
+func negativeStatusSet(statuses []int) map[int]struct{} {
+	if len(statuses) == 0 {
+		statuses = defaultNegativeStatuses
+	}
+
+	set := make(map[int]struct{}, len(statuses))
+	for _, status := range statuses {
+		set[status] = struct{}{}
+	}
+
+	return set
+}
+
+// negative reports whether responses with the status are negatively cached.
+func (m *cache) negative(status int) bool {
+	if m.cfg.NegativeTTL.Duration() <= 0 {
+		return false
+	}
+
+	_, ok := m.negatives[status]
+
+	return ok
+}
+
+// negativeExpiry returns how long a negatively cached response is stored for.
+// Responses the origin marks as no-store or private are never stored.
+func (m *cache) negativeExpiry(h http.Header) (time.Duration, bool) {
+	cc, err := cacheobject.ParseResponseCacheControl(h.Get("Cache-Control"))
+	if err != nil || cc.NoStore || cc.PrivatePresent {
+		return 0, false
+	}
+
+	return m.clampExpiry(m.cfg.NegativeTTL.Duration()), true
+}
@@ -0,0 +1,82 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_ServeHTTPNegative(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		cacheControl string
+		statuses     []int
+		wantState    string
+	}{
+		{
+			name:      "should cache 404 by default",
+			status:    http.StatusNotFound,
+			wantState: cacheHitStatus,
+		},
+		{
+			name:      "should not cache 500 by default",
+			status:    http.StatusInternalServerError,
+			wantState: cacheMissStatus,
+		},
+		{
+			name:      "should cache configured status",
+			status:    http.StatusServiceUnavailable,
+			statuses:  []int{http.StatusNotFound, http.StatusServiceUnavailable},
+			wantState: cacheHitStatus,
+		},
+		{
+			name:         "should respect no-store",
+			status:       http.StatusNotFound,
+			cacheControl: "no-store",
+			wantState:    cacheMissStatus,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				if test.cacheControl != "" {
+					rw.Header().Set("Cache-Control", test.cacheControl)
+				}
+				rw.WriteHeader(test.status)
+				_, _ = rw.Write([]byte("not here"))
+			}
+
+			cfg := &Config{
+				Enabled:          true,
+				Backend:          backendMemory,
+				MaxExpiry:        "10",
+				Cleanup:          "20",
+				AddStatusHeader:  true,
+				NegativeTTL:      "5",
+				NegativeStatuses: test.statuses,
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rw *httptest.ResponseRecorder
+			for i := 0; i < 2; i++ {
+				rw = httptest.NewRecorder()
+				c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/missing", nil))
+			}
+
+			if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+				t.Errorf("unexpected cache state: want %q, got: %q", test.wantState, state)
+			}
+
+			if rw.Code != test.status {
+				t.Errorf("unexpected status: want %d, got: %d", test.status, rw.Code)
+			}
+		})
+	}
+}
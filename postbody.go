@@ -0,0 +1,75 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+)
+
+// defaultMaxPostBodyBytes bounds the POST bodies buffered to be hashed.
+const defaultMaxPostBodyBytes = 64 << 10
+
+// postBody is the body of a cached POST request, kept to be replayed to the
+// origin, along with its hash keying the entry.
+type postBody struct {
+	body []byte
+	hash string
+}
+
+type postBodyContextKey struct{}
+
+// postBodyFrom returns the body of the POST request of the context, if it was
+// read to be cached.
+func postBodyFrom(ctx context.Context) (*postBody, bool) {
+	pb, ok := ctx.Value(postBodyContextKey{}).(*postBody)
+
+	return pb, ok
+}
+
+// readPostBody reads the body of a POST request so that identical bodies share
+// an entry, and restores it for the origin. At most maxPostBodyBytes are
+// buffered: it reports false for larger bodies, whose request must not be
+// cached, and which are still sent whole to the origin.
+func (m *cache) readPostBody(r *http.Request) (*http.Request, bool) {
+	if !m.cfg.CachePostBodies || r.Method != http.MethodPost {
+		return r, true
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+
+		limit := int64(m.cfg.MaxPostBodyBytes)
+		body, err = io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil || int64(len(body)) > limit {
+			r.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+			return r, false
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	sum := sha256.Sum256(body)
+	pb := &postBody{body: body, hash: hex.EncodeToString(sum[:])}
+
+	return r.WithContext(context.WithValue(r.Context(), postBodyContextKey{}, pb)), true
+}
+
+// withPostBody returns a copy of the request to the origin whose body, when
+// it was read to be cached, can be read again, as for background refreshes.
+func withPostBody(r *http.Request) *http.Request {
+	if pb, ok := postBodyFrom(r.Context()); ok {
+		r.Body = io.NopCloser(bytes.NewReader(pb.body))
+	}
+
+	return r
+}
+
+// readCloser reads from a reader, closing the original body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
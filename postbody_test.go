@@ -0,0 +1,80 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCache_ServeHTTPPostBodies(t *testing.T) {
+	tests := []struct {
+		name      string
+		bodies    []string
+		wantCalls int
+	}{
+		{
+			name:      "should cache identical bodies",
+			bodies:    []string{`{"query":"a"}`, `{"query":"a"}`},
+			wantCalls: 1,
+		},
+		{
+			name:      "should key by body",
+			bodies:    []string{`{"query":"a"}`, `{"query":"b"}`},
+			wantCalls: 2,
+		},
+		{
+			name:      "should not cache bodies over the limit",
+			bodies:    []string{`{"query":"aaaaaaaaaaaaaaaaaaaa"}`, `{"query":"aaaaaaaaaaaaaaaaaaaa"}`},
+			wantCalls: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+
+				body, err := io.ReadAll(req.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				_, _ = rw.Write(body)
+			}
+
+			cfg := &Config{
+				Enabled:          true,
+				Backend:          backendMemory,
+				MaxExpiry:        "10",
+				Cleanup:          "20",
+				DefaultTTL:       "5",
+				CachePostBodies:  true,
+				MaxPostBodyBytes: 20,
+				URIs:             []Uri{{Pattern: "/graphql", TTL: "5", Methods: []string{http.MethodPost}}},
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, body := range test.bodies {
+				rw := httptest.NewRecorder()
+				c.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "http://localhost/graphql", strings.NewReader(body)))
+
+				if got := rw.Body.String(); got != body {
+					t.Errorf("unexpected body: want %q, got: %q", body, got)
+				}
+			}
+
+			if calls != test.wantCalls {
+				t.Errorf("unexpected origin calls: want %d, got: %d", test.wantCalls, calls)
+			}
+		})
+	}
+}
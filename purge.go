@@ -0,0 +1,386 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	methodPurge = "PURGE"
+
+	purgeSecretHeader = "X-Purge-Secret"
+	purgeRegexHeader  = "X-Purge-Regex"
+
+	softPurgeParam = "soft"
+)
+
+// parsePurgeAllowlist parses the IP addresses and CIDR ranges allowed to purge.
+func parsePurgeAllowlist(entries []string) ([]*net.IPNet, error) {
+	return parseIPNets(entries, "purge allowlist")
+}
+
+// parseIPNets parses a list of IP addresses and CIDR ranges, the name of the
+// list being used in errors.
+func parseIPNets(entries []string, name string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid %s entry %q", name, entry)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %w", name, entry, err)
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// purgeAuthorized reports whether the request may purge the cache. When both
+// an allowlist and a secret are configured, either one grants access; when
+// neither is, every request does.
+func (m *cache) purgeAuthorized(r *http.Request) bool {
+	if len(m.purgeAllowlist) == 0 && m.cfg.PurgeSecret == "" {
+		return true
+	}
+
+	if m.cfg.PurgeSecret != "" {
+		secret := r.Header.Get(purgeSecretHeader)
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(m.cfg.PurgeSecret)) == 1 {
+			return true
+		}
+	}
+
+	return remoteAddrIn(r, m.purgeAllowlist)
+}
+
+// remoteAddrIn reports whether the remote address of the request is in one of
+// the networks.
+func remoteAddrIn(r *http.Request, nets []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// purge evicts the entries cached for the requested URL, under every method
+// that may be cached. The request may instead evict the entries bearing the
+// tags it lists, the entries whose path matches a regular expression, or,
+// when its path ends with a '*', the entries whose path starts with the rest.
+// With a soft parameter, the entries are marked stale rather than evicted.
+func (m *cache) purge(w http.ResponseWriter, r *http.Request) {
+	if !m.purgeAuthorized(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	r, soft := softPurge(r)
+
+	switch {
+	case r.Header.Get(purgeTagsHeader) != "":
+		m.purgeTagged(w, r, soft)
+		return
+	case r.Header.Get(purgeRegexHeader) != "":
+		re, err := regexp.Compile(r.Header.Get(purgeRegexHeader))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m.purgeMatching(w, r, "", re.MatchString, soft)
+		return
+	case strings.HasSuffix(r.URL.Path, "*"):
+		// A prefix may end with a slash, which is only trimmed from whole
+		// paths.
+		prefix := strings.TrimSuffix(r.URL.Path, "*")
+		if m.keyConfig.lowercasePath {
+			prefix = strings.ToLower(prefix)
+		}
+
+		m.purgeMatching(w, r, prefix, func(string) bool { return true }, soft)
+		return
+	}
+
+	found, err := m.deleteURL(r, soft)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !found {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// softPurge reports whether the purge request asks for a soft purge, returning
+// the request without the parameter so that it does not take part in keys.
+func softPurge(r *http.Request) (*http.Request, bool) {
+	query := r.URL.Query()
+	if _, ok := query[softPurgeParam]; !ok {
+		return r, false
+	}
+
+	soft, _ := strconv.ParseBool(query.Get(softPurgeParam))
+	query.Del(softPurgeParam)
+
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = query.Encode()
+
+	return r, soft
+}
+
+// evict deletes the entry at key, along with the variants it records, or for
+// a soft purge marks it stale.
+func (m *cache) evict(key string, soft bool) error {
+	if soft {
+		return m.expire(key)
+	}
+
+	if err := m.deleteVariants(key); err != nil {
+		return err
+	}
+
+	if err := m.cache.Delete(key); err != nil {
+		return err
+	}
+
+	m.hookEvict(key)
+
+	return nil
+}
+
+// deleteVariants deletes the variants of a response varying on request
+// headers, when the entry at key records them. They would otherwise be served
+// again once the entry is stored anew.
+func (m *cache) deleteVariants(key string) error {
+	lister, ok := m.cache.(keyLister)
+	if !ok {
+		return nil
+	}
+
+	// Errors reading the entry surface when deleting it.
+	data, err := m.get(key)
+	if err != nil {
+		return nil
+	}
+	data.closeBody()
+
+	if data.Status != 0 {
+		return nil
+	}
+
+	keys, err := lister.Keys(key + "|")
+	if err != nil {
+		return err
+	}
+
+	for _, variant := range keys {
+		err = m.cache.Delete(variant)
+		switch {
+		case err == nil:
+			m.hookEvict(variant)
+		case !errors.Is(err, ErrCacheMiss):
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expire marks the entry at key stale, so that it keeps being served while
+// revalidated or when the origin fails for as long as its stale windows
+// allow. Entries without any are deleted. The variants of a response varying
+// on request headers are expired in place of the entry recording them.
+func (m *cache) expire(key string) error {
+	data, err := m.get(key)
+	if err != nil {
+		return err
+	}
+	defer data.closeBody()
+
+	if data.Status == 0 {
+		return m.expireVariants(key)
+	}
+
+	stale := data.StaleWhileRevalidate
+	if stale < data.StaleIfError {
+		stale = data.StaleIfError
+	}
+
+	if stale <= 0 {
+		return m.cache.Delete(key)
+	}
+
+	if data.body != nil {
+		if data.Body, err = ioutil.ReadAll(data.body); err != nil {
+			return err
+		}
+		data.Streamed = false
+	}
+
+	data.ExpiresAt = time.Now()
+	m.set(key, data, stale)
+
+	return nil
+}
+
+// expireVariants marks stale the variants recorded by the entry at key. When
+// the backend cannot list them, the entry is deleted instead.
+func (m *cache) expireVariants(key string) error {
+	lister, ok := m.cache.(keyLister)
+	if !ok {
+		return m.cache.Delete(key)
+	}
+
+	keys, err := lister.Keys(key + "|")
+	if err != nil {
+		return err
+	}
+
+	for _, variant := range keys {
+		if err = m.expire(variant); err != nil && !errors.Is(err, ErrCacheMiss) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteURL evicts the entries cached for the URL of the request, under every
+// method that may be cached and any credentials, reporting whether there were
+// any.
+func (m *cache) deleteURL(r *http.Request, soft bool) (bool, error) {
+	var found bool
+
+	for method := range m.methods {
+		req := r.Clone(r.Context())
+		req.Method = method
+
+		key := cacheKey(req, m.keyFor(req))
+
+		keys, err := m.credentialsKeys(key)
+		if err != nil {
+			return found, err
+		}
+
+		for _, key := range append(keys, key) {
+			err = m.evict(key, soft)
+			switch {
+			case err == nil:
+				found = true
+			case !errors.Is(err, ErrCacheMiss):
+				return found, err
+			}
+		}
+	}
+
+	return found, nil
+}
+
+// mutating reports whether requests with the method are meant to change the
+// resource at their URL.
+func mutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+// invalidate evicts the entries cached for the URL of a mutating request, so
+// that reads following a write see its result.
+func (m *cache) invalidate(r *http.Request) {
+	if _, err := m.deleteURL(r, false); err != nil {
+		m.log.Errorf("Error invalidating cache items: %v", err)
+	}
+}
+
+// purgeMatching evicts the entries of the requested host whose path, query
+// and variant start with prefix and satisfy match, responding with the number
+// of entries evicted.
+func (m *cache) purgeMatching(w http.ResponseWriter, r *http.Request, prefix string, match func(string) bool, soft bool) {
+	lister, ok := m.cache.(keyLister)
+	if !ok {
+		http.Error(w, "backend cannot list keys", http.StatusNotImplemented)
+		return
+	}
+
+	var n int
+
+	for method := range m.methods {
+		req := r.Clone(r.Context())
+		req.Method = method
+
+		origin := keyOrigin(req, m.keyConfig)
+
+		keys, err := lister.Keys(origin + prefix)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, key := range keys {
+			path := strings.TrimPrefix(key, origin)
+			if !strings.HasPrefix(path, "/") || !match(path) {
+				continue
+			}
+
+			err = m.evict(key, soft)
+			switch {
+			case err == nil:
+				n++
+			case !errors.Is(err, ErrCacheMiss):
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	if n == 0 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintln(w, n)
+}
@@ -0,0 +1,561 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache_ServeHTTPPurge(t *testing.T) {
+	var calls int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", EnablePurge: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, wantCode := range []int{http.StatusOK, http.StatusNotFound} {
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, httptest.NewRequest(methodPurge, "http://localhost/some/path", nil))
+
+		if rw.Code != wantCode {
+			t.Errorf("unexpected purge status: want %d, got %d", wantCode, rw.Code)
+		}
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	if calls != 2 {
+		t.Errorf("unexpected origin calls: want 2, got %d", calls)
+	}
+}
+
+func TestCache_ServeHTTPPurgeVary(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		cfg    *Config
+	}{
+		{
+			name:   "should purge variants",
+			method: methodPurge,
+			cfg:    &Config{EnablePurge: true},
+		},
+		{
+			name:   "should invalidate variants on write",
+			method: http.MethodPut,
+			cfg:    &Config{InvalidateOnWrite: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			version := "v1"
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.Header().Set("Vary", "Accept-Language")
+				_, _ = rw.Write([]byte(version + "-" + req.Header.Get("Accept-Language")))
+			}
+
+			cfg := test.cfg
+			cfg.Enabled = true
+			cfg.Backend = backendMemory
+			cfg.MaxExpiry = "10"
+			cfg.Cleanup = "20"
+			cfg.AddStatusHeader = true
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			get := func(lang string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+				req.Header.Set("Accept-Language", lang)
+
+				rw := httptest.NewRecorder()
+				c.ServeHTTP(rw, req)
+
+				return rw
+			}
+
+			get("en")
+			get("fr")
+
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(test.method, "http://localhost/some/path", nil))
+			version = "v2"
+
+			// Storing the English variant again records the variants anew.
+			get("en")
+
+			rw := get("fr")
+			if state := rw.Header().Get("Cache-Status"); state != cacheMissStatus {
+				t.Errorf("unexpected cache state: want %q, got: %q", cacheMissStatus, state)
+			}
+
+			if body := rw.Body.String(); body != "v2-fr" {
+				t.Errorf("unexpected body: want %q, got: %q", "v2-fr", body)
+			}
+		})
+	}
+}
+
+func TestCache_PurgeAuthorized(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowlist  []string
+		secret     string
+		remoteAddr string
+		reqSecret  string
+		want       bool
+	}{
+		{
+			name:       "should allow without restrictions",
+			remoteAddr: "192.0.2.1:1234",
+			want:       true,
+		},
+		{
+			name:       "should allow listed IP",
+			allowlist:  []string{"192.0.2.1"},
+			remoteAddr: "192.0.2.1:1234",
+			want:       true,
+		},
+		{
+			name:       "should allow IP in listed range",
+			allowlist:  []string{"10.0.0.0/8"},
+			remoteAddr: "10.1.2.3:1234",
+			want:       true,
+		},
+		{
+			name:       "should deny unlisted IP",
+			allowlist:  []string{"10.0.0.0/8"},
+			remoteAddr: "192.0.2.1:1234",
+			want:       false,
+		},
+		{
+			name:       "should allow matching secret",
+			secret:     "s3cr3t",
+			remoteAddr: "192.0.2.1:1234",
+			reqSecret:  "s3cr3t",
+			want:       true,
+		},
+		{
+			name:       "should deny wrong secret",
+			secret:     "s3cr3t",
+			remoteAddr: "192.0.2.1:1234",
+			reqSecret:  "guess",
+			want:       false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowlist, err := parsePurgeAllowlist(test.allowlist)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := &cache{cfg: &Config{PurgeSecret: test.secret}, purgeAllowlist: allowlist}
+
+			req := httptest.NewRequest(methodPurge, "http://localhost/some/path", nil)
+			req.RemoteAddr = test.remoteAddr
+			if test.reqSecret != "" {
+				req.Header.Set(purgeSecretHeader, test.reqSecret)
+			}
+
+			if got := m.purgeAuthorized(req); got != test.want {
+				t.Errorf("unexpected authorization: want %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestParsePurgeAllowlist(t *testing.T) {
+	if _, err := parsePurgeAllowlist([]string{"not-an-ip"}); err == nil {
+		t.Error("expected error on invalid entry")
+	}
+
+	if _, err := parsePurgeAllowlist([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected error on invalid range")
+	}
+}
+
+func TestCache_ServeHTTPPurgeMatching(t *testing.T) {
+	tests := []struct {
+		name      string
+		url       string
+		regex     string
+		wantCode  int
+		wantCount string
+		wantCalls map[string]int
+	}{
+		{
+			name:      "should purge path prefix",
+			url:       "http://localhost/blog/*",
+			wantCode:  http.StatusOK,
+			wantCount: "2",
+			wantCalls: map[string]int{"/blog/a": 2, "/blog/b": 2, "/about": 1},
+		},
+		{
+			name:      "should purge regular expression",
+			url:       "http://localhost/",
+			regex:     "^/(about|blog/b)$",
+			wantCode:  http.StatusOK,
+			wantCount: "2",
+			wantCalls: map[string]int{"/blog/a": 1, "/blog/b": 2, "/about": 2},
+		},
+		{
+			name:      "should respond not found without match",
+			url:       "http://localhost/news/*",
+			wantCode:  http.StatusNotFound,
+			wantCalls: map[string]int{"/blog/a": 1, "/blog/b": 1, "/about": 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := map[string]int{}
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls[req.URL.Path]++
+
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", EnablePurge: true}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			serveAll := func() {
+				for _, path := range []string{"/blog/a", "/blog/b", "/about"} {
+					c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil))
+				}
+			}
+
+			serveAll()
+
+			req := httptest.NewRequest(methodPurge, test.url, nil)
+			if test.regex != "" {
+				req.Header.Set("X-Purge-Regex", test.regex)
+			}
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, req)
+
+			if rw.Code != test.wantCode {
+				t.Errorf("unexpected purge status: want %d, got %d", test.wantCode, rw.Code)
+			}
+
+			if test.wantCount != "" && strings.TrimSpace(rw.Body.String()) != test.wantCount {
+				t.Errorf("unexpected purge count: want %s, got %q", test.wantCount, rw.Body.String())
+			}
+
+			serveAll()
+
+			if !reflect.DeepEqual(calls, test.wantCalls) {
+				t.Errorf("unexpected origin calls: want %v, got %v", test.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPInvalidateOnWrite(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		invalid   bool
+		wantCalls int
+	}{
+		{
+			name:      "should invalidate on PUT",
+			method:    http.MethodPut,
+			invalid:   true,
+			wantCalls: 2,
+		},
+		{
+			name:      "should invalidate on DELETE",
+			method:    http.MethodDelete,
+			invalid:   true,
+			wantCalls: 2,
+		},
+		{
+			name:      "should not invalidate on OPTIONS",
+			method:    http.MethodOptions,
+			invalid:   true,
+			wantCalls: 1,
+		},
+		{
+			name:      "should not invalidate when disabled",
+			method:    http.MethodPut,
+			wantCalls: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				if req.Method == http.MethodGet {
+					calls++
+				}
+
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", InvalidateOnWrite: test.invalid}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			get := httptest.NewRequest(http.MethodGet, "http://localhost/items/1", nil)
+
+			c.ServeHTTP(httptest.NewRecorder(), get)
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(test.method, "http://localhost/items/1", nil))
+			c.ServeHTTP(httptest.NewRecorder(), get)
+
+			if calls != test.wantCalls {
+				t.Errorf("unexpected origin calls: want %d, got %d", test.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPPurgeCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+	}{
+		{
+			name:   "should purge entries of every credentials",
+			method: methodPurge,
+		},
+		{
+			name:   "should invalidate entries of every credentials on write",
+			method: http.MethodPut,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				if req.Method == http.MethodGet {
+					calls++
+				}
+
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+			}
+
+			cfg := &Config{
+				Enabled:            true,
+				Backend:            backendMemory,
+				MaxExpiry:          "10",
+				Cleanup:            "20",
+				CacheAuthorization: true,
+				EnablePurge:        true,
+				InvalidateOnWrite:  true,
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			get := func(auth string) {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost/items/1", nil)
+				req.Header.Set("Authorization", auth)
+				c.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			get("Bearer alice")
+			get("Bearer bob")
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, httptest.NewRequest(test.method, "http://localhost/items/1", nil))
+
+			if rw.Code != http.StatusOK {
+				t.Errorf("unexpected status: want %d, got %d", http.StatusOK, rw.Code)
+			}
+
+			get("Bearer alice")
+			get("Bearer bob")
+
+			if calls != 4 {
+				t.Errorf("unexpected origin calls: want 4, got %d", calls)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPPurgeKeyPrefix(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", EnablePurge: true, KeyPrefix: "app1|"}
+
+	h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := h.(*cache)
+
+	const foreign = "app2|GETlocalhost/blog/a"
+
+	if err = c.cache.Set(foreign, []byte("{}"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/blog/a", nil))
+
+	if _, err = c.cache.Get("app1|GETlocalhost/blog/a"); err != nil {
+		t.Fatalf("unexpected error getting prefixed entry: %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(methodPurge, "http://localhost/blog/*", nil))
+
+	if got := strings.TrimSpace(rw.Body.String()); got != "1" {
+		t.Errorf("unexpected purge count: want %q, got: %q", "1", got)
+	}
+
+	if _, err = c.cache.Get(foreign); err != nil {
+		t.Errorf("unexpected error getting entry of other prefix: %v", err)
+	}
+}
+
+func TestCache_ServeHTTPSoftPurge(t *testing.T) {
+	tests := []struct {
+		name         string
+		backend      string
+		cacheControl string
+		vary         string
+		wantState    string
+		wantBody     string
+	}{
+		{
+			name:         "should serve stale from memory",
+			backend:      backendMemory,
+			cacheControl: "max-age=20, stale-while-revalidate=30",
+			wantState:    "stale",
+			wantBody:     "v1",
+		},
+		{
+			name:         "should serve stale from file",
+			backend:      backendFile,
+			cacheControl: "max-age=20, stale-while-revalidate=30",
+			wantState:    "stale",
+			wantBody:     "v1",
+		},
+		{
+			name:         "should serve stale variant",
+			backend:      backendMemory,
+			cacheControl: "max-age=20, stale-while-revalidate=30",
+			vary:         "Accept-Language",
+			wantState:    "stale",
+			wantBody:     "v1",
+		},
+		{
+			name:         "should miss without stale window",
+			backend:      backendMemory,
+			cacheControl: "max-age=20",
+			wantState:    "miss",
+			wantBody:     "v2",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int32
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				n := atomic.AddInt32(&calls, 1)
+
+				rw.Header().Set("Cache-Control", test.cacheControl)
+				if test.vary != "" {
+					rw.Header().Set("Vary", test.vary)
+				}
+				rw.WriteHeader(http.StatusOK)
+				_, _ = fmt.Fprintf(rw, "v%d", n)
+			}
+
+			cfg := &Config{Enabled: true, Backend: test.backend, Path: createTempDir(t), MaxExpiry: "60", Cleanup: "120", AddStatusHeader: true, EnablePurge: true}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			serve := func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path?a=1", nil)
+				req.Header.Set("Accept-Language", "en")
+
+				rw := httptest.NewRecorder()
+				c.ServeHTTP(rw, req)
+
+				return rw
+			}
+
+			serve()
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, httptest.NewRequest(methodPurge, "http://localhost/some/path?soft=true&a=1", nil))
+
+			if rw.Code != http.StatusOK {
+				t.Errorf("unexpected purge status: want %d, got %d", http.StatusOK, rw.Code)
+			}
+
+			rw = serve()
+
+			if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+				t.Errorf("unexpected cache state: want %q, got: %q", test.wantState, state)
+			}
+
+			if body := rw.Body.String(); body != test.wantBody {
+				t.Errorf("unexpected body: want %q, got: %q", test.wantBody, body)
+			}
+
+			// Wait for the background revalidation of stale entries.
+			deadline := time.Now().Add(5 * time.Second)
+			for atomic.LoadInt32(&calls) < 2 {
+				if time.Now().After(deadline) {
+					t.Fatal("entry was not revalidated")
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
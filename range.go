@@ -0,0 +1,46 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// servesRange reports whether the request is for a part of the cached response
+// and can be answered from its body.
+func servesRange(r *http.Request, data *cacheData) bool {
+	return r.Method == http.MethodGet && data.Status == http.StatusOK && r.Header.Get("Range") != ""
+}
+
+// serveRange answers a Range request from the cached body, including multiple
+// and unsatisfiable ranges.
+func serveRange(w http.ResponseWriter, r *http.Request, data *cacheData) {
+	content, err := data.content()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// content returns the body of the entry as a seekable reader, reading it in
+// memory when it is streamed from a reader which cannot seek.
+func (d *cacheData) content() (io.ReadSeeker, error) {
+	if d.body == nil {
+		return bytes.NewReader(d.Body), nil
+	}
+
+	if rs, ok := d.body.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+
+	b, err := ioutil.ReadAll(d.body)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(b), nil
+}
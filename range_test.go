@@ -0,0 +1,137 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache_ServeHTTPRange(t *testing.T) {
+	tests := []struct {
+		name             string
+		backend          string
+		rangeHeader      string
+		wantCode         int
+		wantBody         string
+		wantContentRange string
+		wantContentType  string
+	}{
+		{
+			name:             "should serve single range",
+			backend:          backendMemory,
+			rangeHeader:      "bytes=0-3",
+			wantCode:         http.StatusPartialContent,
+			wantBody:         "some",
+			wantContentRange: "bytes 0-3/14",
+		},
+		{
+			name:             "should serve single range from streamed body",
+			backend:          backendFile,
+			rangeHeader:      "bytes=5-8",
+			wantCode:         http.StatusPartialContent,
+			wantBody:         "body",
+			wantContentRange: "bytes 5-8/14",
+		},
+		{
+			name:            "should serve multiple ranges",
+			backend:         backendMemory,
+			rangeHeader:     "bytes=0-3,10-13",
+			wantCode:        http.StatusPartialContent,
+			wantContentType: "multipart/byteranges",
+		},
+		{
+			name:             "should reject unsatisfiable range",
+			backend:          backendMemory,
+			rangeHeader:      "bytes=100-200",
+			wantCode:         http.StatusRequestedRangeNotSatisfiable,
+			wantContentRange: "bytes */14",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.Header().Set("Content-Type", "text/plain")
+				rw.WriteHeader(http.StatusOK)
+				_, _ = rw.Write([]byte("some body text"))
+			}
+
+			cfg := &Config{Enabled: true, Backend: test.backend, Path: createTempDir(t), MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+			req.Header.Set("Range", test.rangeHeader)
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, req)
+
+			if state := rw.Header().Get("Cache-Status"); state != cacheHitStatus {
+				t.Errorf("unexpected cache state: want %q, got: %q", cacheHitStatus, state)
+			}
+
+			if rw.Code != test.wantCode {
+				t.Errorf("unexpected status: want %d, got: %d", test.wantCode, rw.Code)
+			}
+
+			if test.wantBody != "" && rw.Body.String() != test.wantBody {
+				t.Errorf("unexpected body: want %q, got: %q", test.wantBody, rw.Body.String())
+			}
+
+			if got := rw.Header().Get("Content-Range"); got != test.wantContentRange {
+				t.Errorf("unexpected content range: want %q, got: %q", test.wantContentRange, got)
+			}
+
+			if got := rw.Header().Get("Content-Type"); test.wantContentType != "" && !strings.HasPrefix(got, test.wantContentType) {
+				t.Errorf("unexpected content type: want %q, got: %q", test.wantContentType, got)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPRangeMiss(t *testing.T) {
+	var calls int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		http.ServeContent(rw, req, "", time.Time{}, strings.NewReader("0123456789"))
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	req.Header.Set("Range", "bytes=0-1")
+
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	if rw.Code != http.StatusOK || rw.Body.String() != "0123456789" {
+		t.Errorf("unexpected response: want %d %q, got: %d %q", http.StatusOK, "0123456789", rw.Code, rw.Body.String())
+	}
+
+	if calls != 1 {
+		t.Errorf("unexpected origin calls: want 1, got %d", calls)
+	}
+
+	if _, ok := c.(*cache).cacheable(req, http.Header{}, http.StatusPartialContent, nil); ok {
+		t.Error("expected a 206 not to be cacheable")
+	}
+}
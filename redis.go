@@ -0,0 +1,324 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backendRedis = "redis"
+
+	redisTimeout = time.Second
+
+	// redisPoolSize is the number of idle connections kept for reuse.
+	redisPoolSize = 8
+
+	// redisMinBackoff and redisMaxBackoff bound the delay during which Redis
+	// is not dialed again after failing to connect to it.
+	redisMinBackoff = time.Second
+	redisMaxBackoff = 30 * time.Second
+)
+
+// errRedisUnavailable is returned without dialing while backing off after
+// failing to connect to Redis.
+var errRedisUnavailable = errors.New("redis unavailable")
+
+// redisCache is a backend storing entries in Redis so that they can be shared
+// across Traefik replicas. It speaks just enough of RESP for its own needs.
+//
+// Commands run concurrently on a small pool of connections. Once Redis cannot
+// be reached, it is not dialed again for an increasing backoff, so that
+// requests quickly fall back to the origin instead of each waiting for a dial
+// to time out.
+type redisCache struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+	log      Logger
+
+	idle chan *redisConn
+
+	mu        sync.Mutex
+	backoff   time.Duration
+	downUntil time.Time
+}
+
+// redisConn is a connection to Redis along with its buffered reader.
+type redisConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func newRedisCache(addr, password string, db int, prefix string, logger Logger) (*redisCache, error) {
+	if addr == "" {
+		return nil, errors.New("redisAddr must be set for the redis backend")
+	}
+
+	return &redisCache{
+		addr:     addr,
+		password: password,
+		db:       db,
+		prefix:   prefix,
+		log:      logger,
+		idle:     make(chan *redisConn, redisPoolSize),
+	}, nil
+}
+
+func (c *redisCache) Get(key string) ([]byte, error) {
+	reply, err := c.do("GET", c.prefix+key)
+	if err != nil {
+		// An unreachable Redis should not fail the request. Failures to
+		// connect are logged once when backing off.
+		if !errors.Is(err, errRedisUnavailable) {
+			c.log.Errorf("Error getting cache item from redis: %v", err)
+		}
+		return nil, ErrCacheMiss
+	}
+
+	b, ok := reply.([]byte)
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+
+	return b, nil
+}
+
+func (c *redisCache) Set(key string, val []byte, expiry time.Duration) error {
+	seconds := int64(expiry / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	_, err := c.do("SET", c.prefix+key, string(val), "EX", strconv.FormatInt(seconds, 10))
+
+	return err
+}
+
+func (c *redisCache) Delete(key string) error {
+	reply, err := c.do("DEL", c.prefix+key)
+	if err != nil {
+		return err
+	}
+
+	if n, ok := reply.(int64); !ok || n == 0 {
+		return ErrCacheMiss
+	}
+
+	return nil
+}
+
+// Keys scans the keys starting with prefix.
+func (c *redisCache) Keys(prefix string) ([]string, error) {
+	pattern := redisGlobEscaper.Replace(c.prefix+prefix) + "*"
+
+	var keys []string
+
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+
+		vals, ok := reply.([]interface{})
+		if !ok || len(vals) != 2 {
+			return nil, errors.New("unexpected scan reply")
+		}
+
+		next, _ := vals[0].([]byte)
+		batch, _ := vals[1].([]interface{})
+
+		for _, val := range batch {
+			if key, ok := val.([]byte); ok {
+				keys = append(keys, strings.TrimPrefix(string(key), c.prefix))
+			}
+		}
+
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// Close drops the idle connections to Redis.
+func (c *redisCache) Close() error {
+	for {
+		select {
+		case conn := <-c.idle:
+			_ = conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// redisGlobEscaper escapes the characters special to the patterns of SCAN.
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// do sends a command on an idle connection, or a new one if there is none, and
+// reads its reply. The connection is returned to the pool unless the command
+// failed, so that the next command starts from a clean state.
+func (c *redisCache) do(args ...string) (interface{}, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.roundTrip(args...)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	select {
+	case c.idle <- conn:
+	default:
+		_ = conn.Close()
+	}
+
+	return reply, nil
+}
+
+// conn returns an idle connection, or dials a new one unless backing off.
+func (c *redisCache) conn() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	c.mu.Lock()
+	down := time.Now().Before(c.downUntil)
+	c.mu.Unlock()
+
+	if down {
+		return nil, errRedisUnavailable
+	}
+
+	conn, err := c.dial()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil {
+		c.backoff *= 2
+		if c.backoff < redisMinBackoff {
+			c.backoff = redisMinBackoff
+		}
+		if c.backoff > redisMaxBackoff {
+			c.backoff = redisMaxBackoff
+		}
+		c.downUntil = time.Now().Add(c.backoff)
+
+		c.log.Errorf("Error connecting to redis, retrying in %s: %v", c.backoff, err)
+
+		return nil, err
+	}
+
+	c.backoff = 0
+
+	return conn, nil
+}
+
+func (c *redisCache) dial() (*redisConn, error) {
+	nc, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to redis: %w", err)
+	}
+
+	conn := &redisConn{Conn: nc, rd: bufio.NewReader(nc)}
+
+	if c.password != "" {
+		if _, err = conn.roundTrip("AUTH", c.password); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("error initializing redis connection: %w", err)
+		}
+	}
+
+	if c.db != 0 {
+		if _, err = conn.roundTrip("SELECT", strconv.Itoa(c.db)); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("error initializing redis connection: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (c *redisConn) roundTrip(args ...string) (interface{}, error) {
+	if err := c.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := io.WriteString(c, b.String()); err != nil {
+		return nil, fmt.Errorf("error writing redis command: %w", err)
+	}
+
+	return readRedisReply(c.rd)
+}
+
+// readRedisReply reads a single RESP reply. Bulk strings are returned as
+// []byte, integers as int64 and arrays as []interface{}.
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("error reading redis reply: %w", err)
+	}
+
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis error: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(rd, b); err != nil {
+			return nil, fmt.Errorf("error reading redis reply: %w", err)
+		}
+
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+
+		vals := make([]interface{}, n)
+		for i := range vals {
+			if vals[i], err = readRedisReply(rd); err != nil {
+				return nil, err
+			}
+		}
+
+		return vals, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply: %q", line)
+	}
+}
@@ -0,0 +1,276 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedisCache(t *testing.T) {
+	srv := newFakeRedis(t)
+
+	rc, err := newRedisCache(srv.addr, "secret", 2, "tenant:", &stdLogger{level: levelOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = rc.Get(testCacheKey); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("unexpected cache get error: want %v, got %v", ErrCacheMiss, err)
+	}
+
+	cacheContent := []byte("some random cache content\r\nthat should be exact")
+
+	if err = rc.Set(testCacheKey, cacheContent, time.Minute); err != nil {
+		t.Errorf("unexpected cache set error: %v", err)
+	}
+
+	got, err := rc.Get(testCacheKey)
+	if err != nil {
+		t.Errorf("unexpected cache get error: %v", err)
+	}
+
+	if !bytes.Equal(got, cacheContent) {
+		t.Errorf("unexpected cache content: want %s, got %s", cacheContent, got)
+	}
+
+	if _, ok := srv.get("tenant:" + testCacheKey); !ok {
+		t.Error("expected key to be stored with prefix")
+	}
+
+	if err = rc.Delete(testCacheKey); err != nil {
+		t.Errorf("unexpected cache delete error: %v", err)
+	}
+
+	if err = rc.Delete(testCacheKey); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("unexpected cache delete error: want %v, got %v", ErrCacheMiss, err)
+	}
+
+	if got := srv.commands(); got[0] != "AUTH" || got[1] != "SELECT" {
+		t.Errorf("unexpected connection setup: %v", got)
+	}
+}
+
+func TestRedisCache_Keys(t *testing.T) {
+	srv := newFakeRedis(t)
+
+	rc, err := newRedisCache(srv.addr, "", 0, "tenant:", &stdLogger{level: levelOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"GETlocalhost/blog/a", "GETlocalhost/blog/b", "GETlocalhost/about"} {
+		if err = rc.Set(key, []byte("content"), time.Minute); err != nil {
+			t.Errorf("unexpected cache set error: %v", err)
+		}
+	}
+
+	keys, err := rc.Keys("GETlocalhost/blog/")
+	if err != nil {
+		t.Fatalf("unexpected keys error: %v", err)
+	}
+
+	sort.Strings(keys)
+
+	if want := []string{"GETlocalhost/blog/a", "GETlocalhost/blog/b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("unexpected keys: want %v, got %v", want, keys)
+	}
+}
+
+func TestRedisCache_Unreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	rc, err := newRedisCache(addr, "", 0, "", &stdLogger{level: levelOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = rc.Get(testCacheKey); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("unexpected cache get error: want %v, got %v", ErrCacheMiss, err)
+	}
+
+	if err = rc.Set(testCacheKey, []byte("content"), time.Minute); !errors.Is(err, errRedisUnavailable) {
+		t.Errorf("expected redis not to be dialed while backing off, got %v", err)
+	}
+
+	srv := newFakeRedis(t)
+	rc.addr = srv.addr
+
+	rc.mu.Lock()
+	rc.downUntil = time.Now()
+	rc.mu.Unlock()
+
+	if err = rc.Set(testCacheKey, []byte("content"), time.Minute); err != nil {
+		t.Errorf("unexpected cache set error once reachable: %v", err)
+	}
+
+	if rc.backoff != 0 {
+		t.Errorf("unexpected backoff once reachable: %s", rc.backoff)
+	}
+}
+
+func TestRedisCache_Concurrent(t *testing.T) {
+	srv := newFakeRedis(t)
+
+	rc, err := newRedisCache(srv.addr, "", 0, "", &stdLogger{level: levelOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			key := fmt.Sprintf("key-%d", i)
+			if err := rc.Set(key, []byte(key), time.Minute); err != nil {
+				t.Errorf("unexpected cache set error: %v", err)
+				return
+			}
+
+			if got, err := rc.Get(key); err != nil || string(got) != key {
+				t.Errorf("unexpected cache content: want %s, got %s (%v)", key, got, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := len(rc.idle); n == 0 || n > redisPoolSize {
+		t.Errorf("unexpected idle connections: want between 1 and %d, got %d", redisPoolSize, n)
+	}
+}
+
+// fakeRedis is a minimal in-memory server understanding the commands used by
+// redisCache.
+type fakeRedis struct {
+	addr string
+
+	mu   sync.Mutex
+	data map[string]string
+	cmds []string
+}
+
+func newFakeRedis(tb testing.TB) *fakeRedis {
+	tb.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() {
+		_ = ln.Close()
+	})
+
+	srv := &fakeRedis{addr: ln.Addr().String(), data: map[string]string{}}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go srv.serve(conn)
+		}
+	}()
+
+	return srv
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	rd := bufio.NewReader(conn)
+
+	for {
+		reply, err := readRedisReply(rd)
+		if err != nil {
+			return
+		}
+
+		vals, _ := reply.([]interface{})
+
+		args := make([]string, len(vals))
+		for i, val := range vals {
+			b, _ := val.([]byte)
+			args[i] = string(b)
+		}
+
+		_, _ = conn.Write([]byte(s.handle(args)))
+	}
+}
+
+func (s *fakeRedis) handle(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cmds = append(s.cmds, strings.ToUpper(args[0]))
+
+	switch strings.ToUpper(args[0]) {
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		s.data[args[1]] = args[2]
+		return "+OK\r\n"
+	case "GET":
+		val, ok := s.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(val), val)
+	case "SCAN":
+		// Return every match in one batch, ignoring the cursor and count.
+		prefix := strings.NewReplacer(`\`, "").Replace(strings.TrimSuffix(args[3], "*"))
+
+		var keys []string
+		for key := range s.data {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, fmt.Sprintf("$%d\r\n%s\r\n", len(key), key))
+			}
+		}
+		return fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n%s", len(keys), strings.Join(keys, ""))
+	case "DEL":
+		if _, ok := s.data[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		delete(s.data, args[1])
+		return ":1\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func (s *fakeRedis) get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	val, ok := s.data[key]
+
+	return val, ok
+}
+
+func (s *fakeRedis) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.cmds...)
+}
@@ -0,0 +1,52 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"errors"
+	"net/http"
+)
+
+// shadow handles a request in shadow mode. The cache is looked up and the
+// status the request would have had is recorded, but the response always
+// comes from the origin. It is stored as usual when shadow writes are
+// enabled, so that later requests may find it.
+func (m *cache) shadow(w http.ResponseWriter, r *http.Request) {
+	if requestDirectives(r).NoStore || m.bypass(r) {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	key := m.requestKey(r)
+
+	cs := m.shadowStatus(key, r)
+	m.metrics.shadowRequest(cs)
+	m.log.Debugf("Shadowing %s %s: would be %s", r.Method, r.URL, cs)
+
+	if !m.cfg.ShadowWrites {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	m.fetch(w, r, key, "", nil)
+}
+
+// shadowStatus returns the cache status the request would have had.
+func (m *cache) shadowStatus(key string, r *http.Request) string {
+	data, err := m.lookup(key, r)
+	if errors.Is(err, ErrCacheMiss) && r.Method == http.MethodHead {
+		data, err = m.lookupGet(r)
+	}
+	defer data.closeBody()
+
+	switch {
+	case errors.Is(err, ErrCacheMiss):
+		return cacheMissStatus
+	case err != nil:
+		return cacheErrorStatus
+	case data.fresh():
+		return cacheHitStatus
+	case data.revalidatable():
+		return cacheStaleStatus
+	}
+
+	return cacheMissStatus
+}
@@ -0,0 +1,90 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCache_ServeHTTPShadowMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		writes      bool
+		wantMetrics []string
+	}{
+		{
+			name:   "should record would-be hits with writes",
+			writes: true,
+			wantMetrics: []string{
+				`cache_shadow_requests_total{status="hit"} 2`,
+				`cache_shadow_requests_total{status="miss"} 1`,
+				`cache_requests_total{status="hit"} 0`,
+				`cache_entries 1`,
+			},
+		},
+		{
+			name: "should record misses without writes",
+			wantMetrics: []string{
+				`cache_shadow_requests_total{status="hit"} 0`,
+				`cache_shadow_requests_total{status="miss"} 3`,
+				`cache_entries 0`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				calls++
+
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.WriteHeader(http.StatusOK)
+				_, _ = fmt.Fprintf(rw, "v%d", calls)
+			}
+
+			cfg := &Config{
+				Enabled:         true,
+				Backend:         backendMemory,
+				MaxExpiry:       "10",
+				Cleanup:         "20",
+				AddStatusHeader: true,
+				MetricsPath:     "/metrics",
+				ShadowMode:      true,
+				ShadowWrites:    test.writes,
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 1; i <= 3; i++ {
+				rw := httptest.NewRecorder()
+				c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+				if want := fmt.Sprintf("v%d", i); rw.Body.String() != want {
+					t.Errorf("unexpected body: want %q, got: %q", want, rw.Body.String())
+				}
+
+				if state := rw.Header().Get("Cache-Status"); state != "" {
+					t.Errorf("unexpected cache state: %q", state)
+				}
+			}
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/metrics", nil))
+
+			body := rw.Body.String()
+			for _, want := range test.wantMetrics {
+				if !strings.Contains(body, want) {
+					t.Errorf("missing metric %q in:\n%s", want, body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maxSnapshotBytes bounds the size of an imported snapshot.
+	maxSnapshotBytes = 4 << 30
+	// maxSnapshotRecordBytes bounds the size of a record, checked before its
+	// buffer is allocated.
+	maxSnapshotRecordBytes = 64 << 20
+)
+
+var errSnapshotRecordTooLarge = errors.New("snapshot record too large")
+
+// snapshotStats reports the outcome of importing a snapshot.
+type snapshotStats struct {
+	Imported int `json:"imported"`
+	Expired  int `json:"expired"`
+}
+
+// serveSnapshot exports the cached entries as a single stream on GET, and
+// imports such a stream on PUT, so that a new instance can be seeded from a
+// running one rather than starting cold.
+func (m *cache) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		m.exportSnapshot(w)
+	case http.MethodPut:
+		m.importSnapshot(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// exportSnapshot writes a record for each entry, bodies included. Tag indexes
+// are left out, as they are rebuilt from the entries on import.
+func (m *cache) exportSnapshot(w http.ResponseWriter) {
+	lister, ok := m.cache.(keyLister)
+	if !ok {
+		http.Error(w, "backend cannot list keys", http.StatusNotImplemented)
+		return
+	}
+
+	keys, err := lister.Keys(m.keyConfig.prefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+
+	for _, key := range keys {
+		if strings.HasPrefix(key, m.tagKey("")) {
+			continue
+		}
+
+		if err = m.exportEntry(w, key); err != nil {
+			m.log.Errorf("Error exporting cache item %q: %v", key, err)
+			return
+		}
+	}
+}
+
+// exportEntry writes the record of the entry at key, unless it is gone, cannot
+// be read anymore or is too large to be imported.
+func (m *cache) exportEntry(w io.Writer, key string) error {
+	data, err := m.get(key)
+	if err != nil {
+		return nil
+	}
+	defer data.closeBody()
+
+	if data.body != nil {
+		if data.Body, err = io.ReadAll(data.body); err != nil {
+			return nil
+		}
+		data.Streamed = false
+	}
+
+	b, err := marshalCacheData(data)
+	if err != nil {
+		return err
+	}
+
+	if len(key)+len(b) > maxSnapshotRecordBytes {
+		m.log.Warnf("Not exporting cache item %q: %v", key, errSnapshotRecordTooLarge)
+		return nil
+	}
+
+	return writeSnapshotRecord(w, key, b)
+}
+
+// importSnapshot stores the entries of the records read from the request
+// body, dropping those whose lifetime, stale windows included, is over.
+func (m *cache) importSnapshot(w http.ResponseWriter, r *http.Request) {
+	var stats snapshotStats
+
+	br := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxSnapshotBytes))
+	for {
+		key, val, err := readSnapshotRecord(br)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), snapshotErrorStatus(err))
+			return
+		}
+
+		imported, err := m.importEntry(key, val)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if imported {
+			stats.Imported++
+		} else {
+			stats.Expired++
+		}
+	}
+
+	m.log.Infof("Imported %d cache items through the admin endpoint, dropping %d expired ones", stats.Imported, stats.Expired)
+
+	writeJSON(w, stats)
+}
+
+// importEntry stores the entry of a record until the end of its lifetime, as
+// set by its ExpiresAt and stale windows, reporting false when it is over.
+func (m *cache) importEntry(key string, val []byte) (bool, error) {
+	data, err := unmarshalCacheData(val)
+	if err != nil {
+		return false, err
+	}
+
+	stale := data.StaleWhileRevalidate
+	if stale < data.StaleIfError {
+		stale = data.StaleIfError
+	}
+
+	ttl := time.Until(data.ExpiresAt) + stale
+	if ttl <= 0 {
+		return false, nil
+	}
+
+	m.set(key, data, ttl)
+	m.tag(key, parseTags(http.Header(data.Headers).Values(cacheTagsHeader)), ttl)
+
+	return true, nil
+}
+
+// writeSnapshotRecord writes the lengths of the key and value, then the key
+// and value themselves.
+func writeSnapshotRecord(w io.Writer, key string, val []byte) error {
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(key)))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(len(val)))
+
+	for _, b := range [][]byte{hdr[:], []byte(key), val} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readSnapshotRecord reads a record written by writeSnapshotRecord. It returns
+// io.EOF at the end of the stream, io.ErrUnexpectedEOF for a truncated record
+// and errSnapshotRecordTooLarge for one over maxSnapshotRecordBytes.
+func readSnapshotRecord(r io.Reader) (string, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", nil, err
+	}
+
+	kl := int(binary.LittleEndian.Uint32(hdr[0:4]))
+	vl := int(binary.LittleEndian.Uint32(hdr[4:8]))
+	if kl+vl > maxSnapshotRecordBytes {
+		return "", nil, errSnapshotRecordTooLarge
+	}
+
+	b := make([]byte, kl+vl)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", nil, err
+	}
+
+	return string(b[:kl]), b[kl:], nil
+}
+
+// snapshotErrorStatus returns the status of the response to a snapshot which
+// cannot be imported.
+func snapshotErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	if errors.Is(err, errSnapshotRecordTooLarge) || errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadRequest
+}
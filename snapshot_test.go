@@ -0,0 +1,123 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCache_ServeHTTPAdminSnapshot(t *testing.T) {
+	var calls int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("body of " + req.URL.Path))
+	}
+
+	newCache := func() *cache {
+		cfg := &Config{
+			Enabled:         true,
+			Backend:         backendMemory,
+			MaxExpiry:       "60",
+			Cleanup:         "20",
+			AddStatusHeader: true,
+			AdminPath:       "/_cache",
+			PurgeSecret:     "secret",
+		}
+
+		h, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return h.(*cache)
+	}
+
+	admin := func(c *cache, method string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost/_cache/snapshot", body)
+		req.Header.Set("X-Purge-Secret", "secret")
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	src := newCache()
+
+	for _, path := range []string{"/fresh", "/expired"} {
+		src.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil))
+	}
+
+	expired, err := src.get("GETlocalhost/expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	src.set("GETlocalhost/expired", expired, time.Minute)
+
+	rw := admin(src, http.MethodGet, nil)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("unexpected export status: want %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	dst := newCache()
+
+	rw = admin(dst, http.MethodPut, bytes.NewReader(rw.Body.Bytes()))
+
+	var stats snapshotStats
+	if err = json.Unmarshal(rw.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("unexpected import response %q: %v", rw.Body.String(), err)
+	}
+
+	if stats != (snapshotStats{Imported: 1, Expired: 1}) {
+		t.Errorf("unexpected import stats: %+v", stats)
+	}
+
+	want, err := src.get("GETlocalhost/fresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := dst.get("GETlocalhost/fresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !got.ExpiresAt.Equal(want.ExpiresAt) {
+		t.Errorf("unexpected expiry: want %v, got: %v", want.ExpiresAt, got.ExpiresAt)
+	}
+
+	calls = 0
+
+	rw = httptest.NewRecorder()
+	dst.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/fresh", nil))
+
+	if state := rw.Header().Get(cacheHeader); state != cacheHitStatus {
+		t.Errorf("unexpected cache state: want %q, got: %q", cacheHitStatus, state)
+	}
+
+	if body := rw.Body.String(); body != "body of /fresh" {
+		t.Errorf("unexpected body: want %q, got: %q", "body of /fresh", body)
+	}
+
+	if calls != 0 {
+		t.Errorf("unexpected origin calls: want 0, got %d", calls)
+	}
+
+	if rw = admin(dst, http.MethodPut, bytes.NewReader([]byte{1, 0, 0, 0})); rw.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status for truncated snapshot: want %d, got %d", http.StatusBadRequest, rw.Code)
+	}
+
+	if rw = admin(dst, http.MethodPut, bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})); rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected status for oversized record: want %d, got %d", http.StatusRequestEntityTooLarge, rw.Code)
+	}
+}
@@ -0,0 +1,159 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// staleWindows returns how long past its expiry the response may be served
+// while it is refreshed in the background, and when the origin fails. They
+// are taken from the stale-while-revalidate and stale-if-error directives,
+// falling back to the configured defaults.
+func (m *cache) staleWindows(h http.Header) (time.Duration, time.Duration) {
+	swr := m.cfg.DefaultStaleWhileRevalidate.Duration()
+	sie := m.cfg.DefaultStaleIfError.Duration()
+
+	cc, err := cacheobject.ParseResponseCacheControl(h.Get("Cache-Control"))
+	if err != nil {
+		return swr, sie
+	}
+
+	if cc.StaleWhileRevalidate >= 0 {
+		swr = time.Duration(cc.StaleWhileRevalidate) * time.Second
+	}
+
+	if cc.StaleIfError >= 0 {
+		sie = time.Duration(cc.StaleIfError) * time.Second
+	}
+
+	return swr, sie
+}
+
+// mustRevalidate reports whether the response must not be served stale once
+// expired, as required by must-revalidate, or proxy-revalidate for shared
+// caches, whatever the stale windows.
+func mustRevalidate(h http.Header) bool {
+	cc, err := cacheobject.ParseResponseCacheControl(h.Get("Cache-Control"))
+
+	return err == nil && (cc.MustRevalidate || cc.ProxyRevalidate)
+}
+
+// revalidate refreshes the key from the origin in the background. Only one
+// refresh per key runs at a time.
+func (m *cache) revalidate(key string, r *http.Request) {
+	if _, leader := m.refreshes.join(key); !leader {
+		return
+	}
+
+	req := r.Clone(context.Background())
+
+	started := m.work.run(func(ctx context.Context) {
+		defer m.refreshes.leave(key)
+
+		m.fetch(&discardWriter{header: http.Header{}}, req.WithContext(ctx), key, "", nil)
+	})
+	if !started {
+		// Too many refreshes are running, or the cache is closed: the entry
+		// is only served stale a little longer.
+		m.log.Debugf("Not refreshing %q in the background", key)
+		m.refreshes.leave(key)
+	}
+}
+
+// discardWriter is the response writer of background requests, whose
+// responses are only stored.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (d *discardWriter) WriteHeader(status int) {
+	d.status = status
+}
+
+// errorBuffer holds back the response of the origin while a stale entry may
+// still be served in its place should it fail. Once the handler flushes, the
+// response is streamed instead: what was written so far is sent to the
+// client, and everything written after it.
+type errorBuffer struct {
+	client    http.ResponseWriter
+	header    http.Header
+	status    int
+	body      []byte
+	streaming bool
+}
+
+func newErrorBuffer(client http.ResponseWriter) *errorBuffer {
+	return &errorBuffer{client: client, header: client.Header().Clone()}
+}
+
+func (b *errorBuffer) Header() http.Header {
+	if b.streaming {
+		return b.client.Header()
+	}
+
+	return b.header
+}
+
+func (b *errorBuffer) Write(p []byte) (int, error) {
+	if b.streaming {
+		return b.client.Write(p)
+	}
+
+	b.body = append(b.body, p...)
+
+	return len(p), nil
+}
+
+func (b *errorBuffer) WriteHeader(status int) {
+	switch {
+	case b.streaming:
+		b.client.WriteHeader(status)
+	case status >= 200 && b.status == 0:
+		b.status = status
+	}
+}
+
+// Written reports whether the response is streamed, its headers written.
+func (b *errorBuffer) Written() bool {
+	return b.streaming
+}
+
+func (b *errorBuffer) Flush() {
+	b.commit()
+
+	if f, ok := b.client.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// commit sends the response held back to the client, after which writes go
+// straight through.
+func (b *errorBuffer) commit() {
+	if b.streaming {
+		return
+	}
+	b.streaming = true
+
+	for key, vals := range b.header {
+		b.client.Header()[key] = vals
+	}
+
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	b.client.WriteHeader(b.status)
+	_, _ = b.client.Write(b.body)
+	b.body = nil
+}
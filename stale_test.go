@@ -0,0 +1,374 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCache_ServeHTTPStaleWhileRevalidate(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+
+	release := make(chan struct{})
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if n > 1 {
+			<-release
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=10")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(rw, "v%d", n)
+	}
+
+	cfg := &Config{Enabled: true, Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+		rw := httptest.NewRecorder()
+
+		c.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	serve()
+
+	time.Sleep(1100 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		rw := serve()
+
+		if state := rw.Header().Get("Cache-Status"); state != "stale" {
+			t.Errorf("unexpected cache state: want \"stale\", got: %q", state)
+		}
+
+		if body := rw.Body.String(); body != "v1" {
+			t.Errorf("unexpected body: want \"v1\", got: %q", body)
+		}
+	}
+
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rw := serve()
+		if rw.Header().Get("Cache-Status") == "hit" {
+			if body := rw.Body.String(); body != "v2" {
+				t.Errorf("unexpected body: want \"v2\", got: %q", body)
+			}
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("entry was not revalidated in the background")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("unexpected origin calls: want 2, got %d", n)
+	}
+}
+
+func TestCache_StaleWindows(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		wantSWR      time.Duration
+		wantSIE      time.Duration
+	}{
+		{
+			name:         "should use directives",
+			cacheControl: "max-age=10, stale-while-revalidate=30, stale-if-error=60",
+			wantSWR:      30 * time.Second,
+			wantSIE:      60 * time.Second,
+		},
+		{
+			name:         "should fall back to defaults",
+			cacheControl: "max-age=10",
+			wantSWR:      5 * time.Second,
+			wantSIE:      15 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := &cache{cfg: &Config{DefaultStaleWhileRevalidate: "5", DefaultStaleIfError: "15"}}
+
+			h := http.Header{}
+			h.Set("Cache-Control", test.cacheControl)
+
+			swr, sie := m.staleWindows(h)
+			if swr != test.wantSWR {
+				t.Errorf("unexpected stale-while-revalidate: want %s, got %s", test.wantSWR, swr)
+			}
+
+			if sie != test.wantSIE {
+				t.Errorf("unexpected stale-if-error: want %s, got %s", test.wantSIE, sie)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPStaleIfError(t *testing.T) {
+	dir := createTempDir(t)
+
+	var calls int32
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		rw.Header().Set("Cache-Control", "max-age=1, stale-if-error=10")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("body"))
+	}
+
+	cfg := &Config{Enabled: true, Path: dir, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	rw := httptest.NewRecorder()
+
+	c.ServeHTTP(rw, req)
+
+	if state := rw.Header().Get("Cache-Status"); state != "stale; error" {
+		t.Errorf("unexpected cache state: want \"stale; error\", got: %q", state)
+	}
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("unexpected status: want %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	if body := rw.Body.String(); body != "body" {
+		t.Errorf("unexpected body: want \"body\", got: %q", body)
+	}
+}
+
+func TestCache_ServeHTTPStaleIfErrorFlush(t *testing.T) {
+	var calls int32
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=1, stale-if-error=10")
+		if atomic.AddInt32(&calls, 1) == 1 {
+			_, _ = rw.Write([]byte("body"))
+			return
+		}
+
+		_, _ = rw.Write([]byte("hello "))
+		rw.(http.Flusher).Flush()
+		_, _ = rw.Write([]byte("world"))
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20"}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+	c.ServeHTTP(httptest.NewRecorder(), req)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("unexpected status: want %d, got %d", http.StatusOK, rw.Code)
+	}
+
+	if body := rw.Body.String(); body != "hello world" {
+		t.Errorf("unexpected body: want %q, got: %q", "hello world", body)
+	}
+
+	if !rw.Flushed {
+		t.Error("unexpected response not flushed to the client")
+	}
+}
+
+func TestCache_ServeHTTPStaleMaxAge(t *testing.T) {
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "public, max-age=1, stale-while-revalidate=10")
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	time.Sleep(2100 * time.Millisecond)
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	if state := rw.Header().Get("Cache-Status"); state != cacheStaleStatus {
+		t.Errorf("unexpected cache state: want %q, got: %q", cacheStaleStatus, state)
+	}
+
+	if got := rw.Header().Values("Cache-Control"); len(got) != 1 || got[0] != "max-age=0" {
+		t.Errorf("unexpected Cache-Control: want %q, got: %q", []string{"max-age=0"}, got)
+	}
+}
+
+func TestCache_ServeHTTPMustRevalidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		originStatus int
+		wantState    string
+		wantStatus   int
+	}{
+		{
+			name:         "should not serve stale while revalidating",
+			cacheControl: "max-age=1, must-revalidate, stale-while-revalidate=10",
+			originStatus: http.StatusOK,
+			wantState:    "miss",
+			wantStatus:   http.StatusOK,
+		},
+		{
+			name:         "should not serve stale on error",
+			cacheControl: "max-age=1, must-revalidate, stale-if-error=10",
+			originStatus: http.StatusBadGateway,
+			wantState:    "miss",
+			wantStatus:   http.StatusBadGateway,
+		},
+		{
+			name:         "should not serve stale on error with proxy-revalidate",
+			cacheControl: "max-age=1, proxy-revalidate, stale-if-error=10",
+			originStatus: http.StatusBadGateway,
+			wantState:    "miss",
+			wantStatus:   http.StatusBadGateway,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int32
+
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				status := http.StatusOK
+				if atomic.AddInt32(&calls, 1) > 1 {
+					status = test.originStatus
+				}
+
+				rw.Header().Set("Cache-Control", test.cacheControl)
+				rw.WriteHeader(status)
+				_, _ = rw.Write([]byte("body"))
+			}
+
+			cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil)
+			c.ServeHTTP(httptest.NewRecorder(), req)
+
+			time.Sleep(1100 * time.Millisecond)
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, req)
+
+			if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+				t.Errorf("unexpected cache state: want %q, got: %q", test.wantState, state)
+			}
+
+			if rw.Code != test.wantStatus {
+				t.Errorf("unexpected status: want %d, got %d", test.wantStatus, rw.Code)
+			}
+
+			if n := atomic.LoadInt32(&calls); n != 2 {
+				t.Errorf("unexpected origin calls: want 2, got %d", n)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPDefaultStaleWhileRevalidate(t *testing.T) {
+	var calls int32
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+
+		rw.Header().Set("Cache-Control", "max-age=1")
+		rw.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(rw, "v%d", n)
+	}
+
+	cfg := &Config{
+		Enabled:                     true,
+		Backend:                     backendMemory,
+		MaxExpiry:                   "10",
+		Cleanup:                     "20",
+		AddStatusHeader:             true,
+		DefaultStaleWhileRevalidate: "10",
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+		return rw
+	}
+
+	serve()
+
+	time.Sleep(1100 * time.Millisecond)
+
+	rw := serve()
+
+	if state := rw.Header().Get("Cache-Status"); state != "stale" {
+		t.Errorf("unexpected cache state: want \"stale\", got: %q", state)
+	}
+
+	if body := rw.Body.String(); body != "v1" {
+		t.Errorf("unexpected body: want \"v1\", got: %q", body)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&calls) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("entry was not refreshed in the background")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
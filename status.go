@@ -0,0 +1,64 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// defaultCacheableStatusCodes are the statuses RFC 9110 defines as cacheable
+// by default, but for 206 whose partial bodies are never stored.
+var defaultCacheableStatusCodes = []int{
+	http.StatusOK,
+	http.StatusNonAuthoritativeInfo,
+	http.StatusNoContent,
+	http.StatusMultipleChoices,
+	http.StatusMovedPermanently,
+	http.StatusPermanentRedirect,
+	http.StatusNotFound,
+	http.StatusMethodNotAllowed,
+	http.StatusGone,
+	http.StatusRequestURITooLong,
+	http.StatusNotImplemented,
+}
+
+// parseCacheableStatusCodes indexes the statuses allowed to be cached. An
+// empty list allows every status.
+func parseCacheableStatusCodes(statuses []int) (map[int]struct{}, error) {
+	if len(statuses) == 0 {
+		return nil, nil
+	}
+
+	set := make(map[int]struct{}, len(statuses))
+	for _, status := range statuses {
+		if status < 100 || status > 599 {
+			return nil, fmt.Errorf("invalid status code %d in cacheableStatusCodes", status)
+		}
+
+		set[status] = struct{}{}
+	}
+
+	return set, nil
+}
+
+// statusAllowed reports whether responses with the status may be cached. The
+// statuses of the matching route, when set, take precedence over the global
+// ones. Statuses explicitly configured as negatively cached or with a TTL of
+// their own are allowed whatever the allowlist says.
+func (m *cache) statusAllowed(r *http.Request, status int) bool {
+	statuses := m.cacheableStatuses
+	if rt := m.route(r); rt != nil && rt.statuses != nil {
+		statuses = rt.statuses
+	}
+
+	if statuses == nil || m.negative(status) {
+		return true
+	}
+
+	if _, ok := statuses[status]; ok {
+		return true
+	}
+
+	_, ok := m.statusTTLs[status]
+
+	return ok
+}
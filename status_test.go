@@ -0,0 +1,108 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_ServeHTTPCacheableStatusCodes(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		statuses    []int
+		uris        []Uri
+		negativeTTL Seconds
+		wantState   string
+	}{
+		{
+			name:      "should cache every status without allowlist",
+			status:    http.StatusFound,
+			wantState: cacheHitStatus,
+		},
+		{
+			name:      "should cache allowed status",
+			status:    http.StatusOK,
+			statuses:  defaultCacheableStatusCodes,
+			wantState: cacheHitStatus,
+		},
+		{
+			name:      "should not cache status missing from allowlist",
+			status:    http.StatusFound,
+			statuses:  defaultCacheableStatusCodes,
+			wantState: cacheMissStatus,
+		},
+		{
+			name:      "should not cache status missing from route allowlist",
+			status:    http.StatusFound,
+			uris:      []Uri{{Pattern: "/some/.*", CacheableStatusCodes: []int{http.StatusOK}}},
+			wantState: cacheMissStatus,
+		},
+		{
+			name:      "should cache status of route allowlist",
+			status:    http.StatusFound,
+			statuses:  []int{http.StatusOK},
+			uris:      []Uri{{Pattern: "/some/.*", CacheableStatusCodes: []int{http.StatusFound}}},
+			wantState: cacheHitStatus,
+		},
+		{
+			name:        "should cache negatively cached status",
+			status:      http.StatusNotFound,
+			statuses:    []int{http.StatusOK},
+			negativeTTL: "5",
+			wantState:   cacheHitStatus,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.Header().Set("Location", "/elsewhere")
+				rw.WriteHeader(test.status)
+			}
+
+			cfg := &Config{
+				Enabled:              true,
+				Backend:              backendMemory,
+				MaxExpiry:            "10",
+				Cleanup:              "20",
+				AddStatusHeader:      true,
+				NegativeTTL:          test.negativeTTL,
+				CacheableStatusCodes: test.statuses,
+				URIs:                 test.uris,
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rw *httptest.ResponseRecorder
+			for i := 0; i < 2; i++ {
+				rw = httptest.NewRecorder()
+				c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+			}
+
+			if state := rw.Header().Get("Cache-Status"); state != test.wantState {
+				t.Errorf("unexpected cache state: want %q, got: %q", test.wantState, state)
+			}
+
+			if rw.Code != test.status {
+				t.Errorf("unexpected status: want %d, got: %d", test.status, rw.Code)
+			}
+		})
+	}
+}
+
+func TestParseCacheableStatusCodes(t *testing.T) {
+	if _, err := parseCacheableStatusCodes([]int{200, 600}); err == nil {
+		t.Error("expected error for invalid status code")
+	}
+
+	set, err := parseCacheableStatusCodes(nil)
+	if err != nil || set != nil {
+		t.Errorf("unexpected result for empty list: %v, %v", set, err)
+	}
+}
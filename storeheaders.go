@@ -0,0 +1,45 @@
+package traefik_plugin_cache_by_route
+
+import "net/http"
+
+// defaultStoreHeaderDenylist are the response headers left out of entries by
+// default: Date is set again on every response, and cookies usually belong to
+// a single user.
+var defaultStoreHeaderDenylist = []string{"Date", "Set-Cookie"}
+
+// headerSet returns the set of the canonical header names, or nil when there
+// are none.
+func headerSet(names []string) map[string]struct{} {
+	if len(names) == 0 {
+		return nil
+	}
+
+	set := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		set[http.CanonicalHeaderKey(name)] = struct{}{}
+	}
+
+	return set
+}
+
+// storableHeaders returns the response headers to store: only those of the
+// allowlist when set, without those of the denylist.
+func (m *cache) storableHeaders(h http.Header) http.Header {
+	if m.storeAllow == nil && m.storeDeny == nil {
+		return h
+	}
+
+	stored := make(http.Header, len(h))
+	for name, vals := range h {
+		if _, ok := m.storeAllow[name]; m.storeAllow != nil && !ok {
+			continue
+		}
+		if _, ok := m.storeDeny[name]; ok {
+			continue
+		}
+
+		stored[name] = vals
+	}
+
+	return stored
+}
@@ -0,0 +1,100 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_ServeHTTPStoreHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowlist   []string
+		denylist    []string
+		wantHeaders []string
+		wantMissing []string
+	}{
+		{
+			name:        "should store all headers by default",
+			wantHeaders: []string{"Content-Type", "X-Debug-Id", "X-Request-Id"},
+		},
+		{
+			name:        "should not store denied headers",
+			denylist:    []string{"x-debug-id", "X-Request-Id"},
+			wantHeaders: []string{"Content-Type"},
+			wantMissing: []string{"X-Debug-Id", "X-Request-Id"},
+		},
+		{
+			name:        "should only store allowed headers",
+			allowlist:   []string{"Content-Type", "X-Request-Id"},
+			wantHeaders: []string{"Content-Type", "X-Request-Id"},
+			wantMissing: []string{"X-Debug-Id"},
+		},
+		{
+			name:        "should not store denied headers of the allowlist",
+			allowlist:   []string{"Content-Type", "X-Request-Id"},
+			denylist:    []string{"X-Request-Id"},
+			wantHeaders: []string{"Content-Type"},
+			wantMissing: []string{"X-Debug-Id", "X-Request-Id"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Cache-Control", "max-age=20")
+				rw.Header().Set("Content-Type", "text/plain")
+				rw.Header().Set("X-Debug-Id", "debug")
+				rw.Header().Set("X-Request-Id", "request")
+				_, _ = rw.Write([]byte("body"))
+			}
+
+			cfg := &Config{
+				Enabled:              true,
+				Backend:              backendMemory,
+				MaxExpiry:            "10",
+				Cleanup:              "20",
+				AddStatusHeader:      true,
+				StoreHeaderAllowlist: test.allowlist,
+				StoreHeaderDenylist:  test.denylist,
+			}
+
+			c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+			rw := httptest.NewRecorder()
+			c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+			if state := rw.Header().Get(cacheHeader); state != cacheHitStatus {
+				t.Fatalf("unexpected cache state: want %q, got: %q", cacheHitStatus, state)
+			}
+
+			for _, name := range test.wantHeaders {
+				if rw.Header().Get(name) == "" {
+					t.Errorf("unexpected missing header %q", name)
+				}
+			}
+
+			for _, name := range test.wantMissing {
+				if got := rw.Header().Get(name); got != "" {
+					t.Errorf("unexpected header %q: want \"\", got: %q", name, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateConfig_StoreHeaderDenylist(t *testing.T) {
+	set := headerSet(CreateConfig().StoreHeaderDenylist)
+
+	for _, name := range []string{"Date", "Set-Cookie"} {
+		if _, ok := set[name]; !ok {
+			t.Errorf("unexpected default denylist: missing %q", name)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pquerna/cachecontrol/cacheobject"
+)
+
+// Headers the origin sets to tell the cache how long to store a response.
+// They are meant for the cache only and are never sent to clients.
+const (
+	cacheTTLHeader         = "X-Cache-TTL"
+	surrogateControlHeader = "Surrogate-Control"
+)
+
+var surrogateHeaders = []string{cacheTTLHeader, surrogateControlHeader}
+
+// takeSurrogateHeaders removes the surrogate headers from h, returning them.
+func takeSurrogateHeaders(h http.Header) http.Header {
+	var taken http.Header
+
+	for _, name := range surrogateHeaders {
+		if vals := h.Values(name); len(vals) > 0 {
+			if taken == nil {
+				taken = http.Header{}
+			}
+			taken[http.CanonicalHeaderKey(name)] = vals
+			h.Del(name)
+		}
+	}
+
+	return taken
+}
+
+// surrogateTTL returns the TTL set by the origin through the X-Cache-TTL
+// header, in seconds, or the max-age of the Surrogate-Control header. A
+// no-store Surrogate-Control gives a zero TTL.
+func surrogateTTL(h http.Header) (time.Duration, bool) {
+	if v := strings.TrimSpace(h.Get(cacheTTLHeader)); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+
+	v := h.Get(surrogateControlHeader)
+	if v == "" {
+		return 0, false
+	}
+
+	cc, err := cacheobject.ParseResponseCacheControl(v)
+	switch {
+	case err != nil:
+		return 0, false
+	case cc.NoStore:
+		return 0, true
+	case cc.MaxAge >= 0:
+		return time.Duration(cc.MaxAge) * time.Second, true
+	}
+
+	return 0, false
+}
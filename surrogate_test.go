@@ -0,0 +1,91 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSurrogateTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		wantTTL time.Duration
+		wantOK  bool
+	}{
+		{
+			name:   "should ignore missing headers",
+			header: http.Header{},
+		},
+		{
+			name:    "should use X-Cache-TTL",
+			header:  http.Header{"X-Cache-Ttl": {"120"}},
+			wantTTL: 2 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			name:    "should prefer X-Cache-TTL over Surrogate-Control",
+			header:  http.Header{"X-Cache-Ttl": {"120"}, "Surrogate-Control": {"max-age=60"}},
+			wantTTL: 2 * time.Minute,
+			wantOK:  true,
+		},
+		{
+			name:    "should fall back to Surrogate-Control on invalid X-Cache-TTL",
+			header:  http.Header{"X-Cache-Ttl": {"soon"}, "Surrogate-Control": {"max-age=60"}},
+			wantTTL: time.Minute,
+			wantOK:  true,
+		},
+		{
+			name:   "should not store on no-store Surrogate-Control",
+			header: http.Header{"Surrogate-Control": {"no-store"}},
+			wantOK: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ttl, ok := surrogateTTL(test.header)
+			if ttl != test.wantTTL || ok != test.wantOK {
+				t.Errorf("unexpected ttl: want %v (%t), got: %v (%t)", test.wantTTL, test.wantOK, ttl, ok)
+			}
+		})
+	}
+}
+
+func TestCache_ServeHTTPSurrogateTTL(t *testing.T) {
+	var calls int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.Header().Set("X-Cache-TTL", "5")
+		_, _ = rw.Write([]byte("body"))
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", AddStatusHeader: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, wantState := range []string{cacheMissStatus, cacheHitStatus} {
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+		if state := rw.Header().Get("Cache-Status"); state != wantState {
+			t.Errorf("unexpected cache state: want %q, got: %q", wantState, state)
+		}
+
+		if v := rw.Header().Get("X-Cache-TTL"); v != "" {
+			t.Errorf("unexpected X-Cache-TTL header sent to client: %q", v)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("unexpected origin calls: want 1, got %d", calls)
+	}
+}
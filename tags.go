@@ -0,0 +1,152 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cacheTagsHeader lists the tags of a response, set by the origin.
+	cacheTagsHeader = "Cache-Tags"
+	// purgeTagsHeader lists the tags whose entries a purge request evicts.
+	purgeTagsHeader = "X-Purge-Tags"
+
+	tagKeyPrefix = "tag|"
+)
+
+// tagIndex records, for each tag, the keys of the entries bearing it along
+// with their expiry. The index of a tag is itself stored in the backend.
+type tagIndex struct {
+	mu sync.Mutex
+}
+
+// parseTags returns the tags listed in the header values.
+func parseTags(vals []string) []string {
+	var tags []string
+
+	for _, v := range vals {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	return tags
+}
+
+// tagKey returns the key of the index of the tag, within the key prefix.
+func (m *cache) tagKey(tag string) string {
+	return m.keyConfig.prefix + tagKeyPrefix + tag
+}
+
+// tag records that the entry stored at key for ttl bears the tags.
+func (m *cache) tag(key string, tags []string, ttl time.Duration) {
+	if len(tags) == 0 {
+		return
+	}
+
+	m.tags.mu.Lock()
+	defer m.tags.mu.Unlock()
+
+	now := time.Now()
+
+	for _, tag := range tags {
+		keys := m.taggedKeys(tag)
+		keys[key] = now.Add(ttl)
+
+		// Drop the keys which expired, and keep the index for as long as the
+		// entries it lists.
+		var expiresAt time.Time
+		for k, exp := range keys {
+			switch {
+			case exp.Before(now):
+				delete(keys, k)
+			case exp.After(expiresAt):
+				expiresAt = exp
+			}
+		}
+
+		b, err := json.Marshal(keys)
+		if err != nil {
+			m.log.Errorf("Error serializing tag index: %v", err)
+			continue
+		}
+
+		if err = m.cache.Set(m.tagKey(tag), b, expiresAt.Sub(now)); err != nil {
+			m.log.Errorf("Error setting tag index: %v", err)
+		}
+	}
+}
+
+// taggedKeys returns the keys of the entries bearing the tag, which may have
+// been evicted since.
+func (m *cache) taggedKeys(tag string) map[string]time.Time {
+	keys := map[string]time.Time{}
+
+	b, err := m.cache.Get(m.tagKey(tag))
+	if err != nil {
+		return keys
+	}
+
+	if err = json.Unmarshal(b, &keys); err != nil {
+		return map[string]time.Time{}
+	}
+
+	return keys
+}
+
+// purgeTags evicts the entries bearing any of the tags, returning how many
+// were found. A soft purge marks them stale instead, keeping the tag index
+// for the entries to be purged again.
+func (m *cache) purgeTags(tags []string, soft bool) (int, error) {
+	m.tags.mu.Lock()
+	defer m.tags.mu.Unlock()
+
+	var n int
+
+	for _, tag := range tags {
+		for key := range m.taggedKeys(tag) {
+			err := m.evict(key, soft)
+			switch {
+			case err == nil:
+				n++
+			case !errors.Is(err, ErrCacheMiss):
+				return n, err
+			}
+		}
+
+		if soft {
+			continue
+		}
+
+		if err := m.cache.Delete(m.tagKey(tag)); err != nil && !errors.Is(err, ErrCacheMiss) {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// purgeTagged handles a purge request for the tags it lists, responding with
+// the number of entries evicted.
+func (m *cache) purgeTagged(w http.ResponseWriter, r *http.Request, soft bool) {
+	n, err := m.purgeTags(parseTags(r.Header.Values(purgeTagsHeader)), soft)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if n == 0 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintln(w, n)
+}
@@ -0,0 +1,76 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	got := parseTags([]string{"product-42, category-7", "", " home ,"})
+	want := []string{"product-42", "category-7", "home"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected tags: want %v, got: %v", want, got)
+	}
+}
+
+func TestCache_ServeHTTPPurgeTags(t *testing.T) {
+	calls := map[string]int{}
+
+	tags := map[string]string{
+		"/products/42":  "product-42, category-7",
+		"/categories/7": "category-7",
+		"/products/43":  "product-43",
+	}
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls[req.URL.Path]++
+
+		rw.Header().Set("Cache-Control", "max-age=20")
+		rw.Header().Set("Cache-Tags", tags[req.URL.Path])
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	cfg := &Config{Enabled: true, Backend: backendMemory, MaxExpiry: "10", Cleanup: "20", EnablePurge: true}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path := range tags {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil))
+	}
+
+	purge := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(methodPurge, "http://localhost/", nil)
+		req.Header.Set("X-Purge-Tags", "category-7")
+
+		rw := httptest.NewRecorder()
+		c.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	rw := purge()
+	if rw.Code != http.StatusOK || strings.TrimSpace(rw.Body.String()) != "2" {
+		t.Errorf("unexpected purge response: want 200 and 2 entries, got %d and %q", rw.Code, rw.Body.String())
+	}
+
+	if rw = purge(); rw.Code != http.StatusNotFound {
+		t.Errorf("unexpected purge status: want %d, got %d", http.StatusNotFound, rw.Code)
+	}
+
+	for path := range tags {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil))
+	}
+
+	want := map[string]int{"/products/42": 2, "/categories/7": 2, "/products/43": 1}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("unexpected origin calls: want %v, got %v", want, calls)
+	}
+}
@@ -0,0 +1,74 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"net/http"
+	"time"
+)
+
+// warmInterval is the minimum delay between two warming requests, so that
+// warming does not overload the service.
+const warmInterval = 100 * time.Millisecond
+
+// warmResult reports the outcome of warming a URL.
+type warmResult struct {
+	URL    string `json:"url"`
+	Status int    `json:"status,omitempty"`
+	Cached bool   `json:"cached"`
+	Error  string `json:"error,omitempty"`
+}
+
+// serveWarm requests each of the configured warm URLs through the middleware,
+// like a client would, and responds with the outcome for each of them.
+func (m *cache) serveWarm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ticker := time.NewTicker(warmInterval)
+	defer ticker.Stop()
+
+	results := make([]warmResult, 0, len(m.cfg.WarmURLs))
+	for i, rawURL := range m.cfg.WarmURLs {
+		if i > 0 {
+			select {
+			case <-ticker.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		results = append(results, m.warm(r, rawURL))
+	}
+
+	writeJSON(w, results)
+}
+
+// warm requests the URL, relative to the host of the admin request unless it
+// is absolute, and reports whether a fresh response is cached for it.
+func (m *cache) warm(r *http.Request, rawURL string) warmResult {
+	res := warmResult{URL: rawURL}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, rawURL, nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	if req.Host == "" {
+		req.Host = r.Host
+	}
+
+	rw := &discardWriter{header: http.Header{}, status: http.StatusOK}
+	m.ServeHTTP(rw, req)
+
+	res.Status = rw.status
+
+	data, err := m.lookup(m.requestKey(req), req)
+	if err == nil {
+		res.Cached = data.fresh()
+		data.closeBody()
+	}
+
+	return res
+}
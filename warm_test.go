@@ -0,0 +1,93 @@
+package traefik_plugin_cache_by_route
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCache_ServeHTTPWarm(t *testing.T) {
+	var calls int
+
+	next := func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+
+		switch req.URL.Path {
+		case "/private":
+			rw.Header().Set("Cache-Control", "no-store")
+		case "/missing":
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		default:
+			rw.Header().Set("Cache-Control", "max-age=20")
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("some body"))
+	}
+
+	cfg := &Config{
+		Enabled:     true,
+		Backend:     backendMemory,
+		MaxExpiry:   "10",
+		Cleanup:     "20",
+		AdminPath:   "/_cache",
+		PurgeSecret: "secret",
+		WarmURLs:    []string{"/some/path", "http://other.host/some/path", "/private", "/missing", "%"},
+	}
+
+	c, err := New(context.Background(), http.HandlerFunc(next), cfg, "simplecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost/_cache/warm", nil)
+	req.Header.Set("X-Purge-Secret", "secret")
+
+	rw := httptest.NewRecorder()
+	c.ServeHTTP(rw, req)
+
+	var results []warmResult
+	if err = json.Unmarshal(rw.Body.Bytes(), &results); err != nil {
+		t.Fatalf("unexpected warm response %q: %v", rw.Body.String(), err)
+	}
+
+	want := []warmResult{
+		{URL: "/some/path", Status: http.StatusOK, Cached: true},
+		{URL: "http://other.host/some/path", Status: http.StatusOK, Cached: true},
+		{URL: "/private", Status: http.StatusOK},
+		{URL: "/missing", Status: http.StatusNotFound},
+	}
+
+	if len(results) != len(want)+1 {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	for i, res := range want {
+		if results[i] != res {
+			t.Errorf("unexpected result: want %+v, got: %+v", res, results[i])
+		}
+	}
+
+	if results[len(want)].Error == "" {
+		t.Errorf("expected an error for an invalid URL, got: %+v", results[len(want)])
+	}
+
+	c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://localhost/some/path", nil))
+
+	if calls != 4 {
+		t.Errorf("unexpected origin calls: want 4, got %d", calls)
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "http://localhost/_cache/warm", nil)
+	get.Header.Set("X-Purge-Secret", "secret")
+
+	rw = httptest.NewRecorder()
+	c.ServeHTTP(rw, get)
+
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status: want %d, got %d", http.StatusMethodNotAllowed, rw.Code)
+	}
+}